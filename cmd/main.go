@@ -1,25 +1,41 @@
 package main
 
 import (
+    "bytes"
+    "context"
     "crypto/sha256"
     "encoding/hex"
+    "errors"
     "flag"
-    "log"
+    "log/slog"
     "net"
     // "net/url"
     "os"
+    "os/signal"
+    "reflect"
     "sync/atomic"
+    "syscall"
     "time"
     "runtime"
+    "slices"
     "io"
     // "io/ioutil"
     "encoding/json"
     "net/http"
     "fmt"
-    "strings"
 
+    "github.com/dickiesanders/go-agent/internal/config"
+    "github.com/dickiesanders/go-agent/internal/identity"
+    "github.com/dickiesanders/go-agent/internal/logging"
     "github.com/dickiesanders/go-agent/internal/metrics"
-    "github.com/shirou/gopsutil/disk"
+    "github.com/dickiesanders/go-agent/internal/prometheus"
+    "github.com/dickiesanders/go-agent/internal/redact"
+    "github.com/dickiesanders/go-agent/internal/registration"
+    "github.com/dickiesanders/go-agent/internal/rotate"
+    "github.com/dickiesanders/go-agent/internal/sink"
+    "github.com/dickiesanders/go-agent/internal/spool"
+    "github.com/dickiesanders/go-agent/internal/statsd"
+    "github.com/dickiesanders/go-agent/internal/transport"
     "github.com/shirou/gopsutil/host"
     "github.com/shirou/gopsutil/process"
     // "github.com/yusufpapurcu/wmi" wmic
@@ -27,30 +43,21 @@ import (
 
 var isPaused int32 // 0 = running, 1 = paused
 
-// A struct to hold the collected metrics data
-type MetricsData struct {
-    CPUPercent    float64                    `json:"cpu_percent"`
-    MemoryUsage   uint64                     `json:"memory_usage"`
-    ProcessInfo   []metrics.ProcessInfo      `json:"process_info"`
-    NetworkStats  []metrics.NetworkStat      `json:"network_stats"`
-    ConnStats     []metrics.ConnectionStat   `json:"conn_stats"`
-    DiskIOStats   map[string]disk.IOCountersStat `json:"disk_io_stats"`
-    DiskUsageInfo []metrics.DiskUsageInfo   `json:"disk_usage_stats"`
-    Timestamp     time.Time                  `json:"timestamp"`
-    UniqueID        string                     `json:"unique_id"`
-}
-
 // OneTimeHostInfo holds information that is sent when the agent first registers
 type OneTimeHostInfo struct {
-    Hostname     string
-    FQDN         string
-    CPUInfo      *metrics.CPUInfo
-    IP           string
-    IsVirtual    bool
-    UniqueID     string
+    Hostname       string
+    FQDN           string
+    CPUInfo        *metrics.CPUInfo
+    IP             string
+    IsVirtual      bool
+    Virtualization string // Virtualization system, e.g. "kvm", if known
+    UniqueID       string
+    PreviousID     string `json:",omitempty"` // Legacy ID, sent until a registration succeeds
 }
 
-// GenerateUniqueID creates a unique, reproducible ID based on the API key, hostname, and IP.
+// GenerateUniqueID creates the ID earlier versions derived from the API key,
+// hostname, and IP. It is only reported so the backend can migrate history
+// to the persisted agent ID.
 func GenerateUniqueID(apiKey, hostname, ip string) string {
     data := apiKey + hostname + ip
     hash := sha256.Sum256([]byte(data))
@@ -63,32 +70,39 @@ func GenerateUniqueID(apiKey, hostname, ip string) string {
 // }
 
 // Simulate sending one-time host information to the mothership
-func registerAgentWithHostInfo(hostInfo OneTimeHostInfo, consoleFlag bool, logger *log.Logger) {
-    logger.Println("Registering agent with the following host information:")
-    logger.Printf("Hostname: %s\n", hostInfo.Hostname)
-    logger.Printf("FQDN: %s\n", hostInfo.FQDN)
-    logger.Printf("IP Address: %s\n", hostInfo.IP)
-    
+func registerAgentWithHostInfo(hostInfo OneTimeHostInfo, consoleFlag bool, logger *slog.Logger) {
+    attrs := []any{
+        "hostname", hostInfo.Hostname,
+        "fqdn", hostInfo.FQDN,
+        "ip", hostInfo.IP,
+        "is_virtual", hostInfo.IsVirtual,
+        "virtualization", hostInfo.Virtualization,
+        "unique_id", hostInfo.UniqueID, // Log the unique client ID
+    }
+    if hostInfo.PreviousID != "" {
+        attrs = append(attrs, "previous_id", hostInfo.PreviousID)
+    }
+
     // Improved formatting for CPU Info
     if hostInfo.CPUInfo != nil {
-        logger.Println("CPU Information:")
-        logger.Printf("  Brand Name: %s\n", hostInfo.CPUInfo.BrandName)
-        logger.Printf("  Physical Cores: %d\n", hostInfo.CPUInfo.PhysicalCores)
-        logger.Printf("  Threads per Core: %d\n", hostInfo.CPUInfo.ThreadsPerCore)
-        logger.Printf("  Vendor ID: %s\n", hostInfo.CPUInfo.VendorID)
-        logger.Printf("  Cache Line Size: %d bytes\n", hostInfo.CPUInfo.CacheLine)
-        logger.Printf("  Features: %v\n", hostInfo.CPUInfo.Features)
+        attrs = append(attrs, slog.Group("cpu",
+            "brand_name", hostInfo.CPUInfo.BrandName,
+            "physical_cores", hostInfo.CPUInfo.PhysicalCores,
+            "threads_per_core", hostInfo.CPUInfo.ThreadsPerCore,
+            "vendor_id", hostInfo.CPUInfo.VendorID,
+            "cache_line_bytes", hostInfo.CPUInfo.CacheLine,
+        ))
+        logger.Debug("CPU features", "features", hostInfo.CPUInfo.Features)
     } else {
-        logger.Println("CPU Information: Not available")
+        logger.Warn("CPU information not available")
     }
 
-    logger.Printf("Is Virtual: %v\n", hostInfo.IsVirtual)
-    logger.Printf("Unique Client ID: %s\n", hostInfo.UniqueID) // Log the unique client ID
+    logger.Info("Registering agent", attrs...)
 
     // Logic to send the host information to the mothership
 }
 
-// func pushHostInfoToServer(apiScheme string, apiURL string, apiKey string, hostInfo OneTimeHostInfo, queueName string, logger *log.Logger) {
+// func pushHostInfoToServer(apiScheme string, apiURL string, apiKey string, hostInfo OneTimeHostInfo, queueName string, logger *slog.Logger) {
 //     // Define the API endpoint for the registration queue
 //     apiEndpoint := fmt.Sprintf("%s://%s/%s", apiScheme, apiURL, queueName)
 //     authToken := apiKey
@@ -132,7 +146,7 @@ func registerAgentWithHostInfo(hostInfo OneTimeHostInfo, consoleFlag bool, logge
 // }
 
 // // Pushing data to the server in batches of up to 10 messages
-// func pushDataToServer(apiScheme string, apiURL string, apiKey string, data []MetricsData, queueName string, logger *log.Logger) {
+// func pushDataToServer(apiScheme string, apiURL string, apiKey string, data []MetricsData, queueName string, logger *slog.Logger) {
 //     // Define the API endpoint and the authorization token
 //     apiEndpoint := fmt.Sprintf("%s://%s/%s", apiScheme, apiURL, queueName)
 //     authToken := apiKey
@@ -177,21 +191,150 @@ func registerAgentWithHostInfo(hostInfo OneTimeHostInfo, consoleFlag bool, logge
 //     }
 // }
 
-func pushData(apiScheme, apiURL, apiKey, queueName string, data interface{}, logger *log.Logger, isLocal bool) {
+// uploader holds the API settings and HTTP client used for every push. A new
+// one is built whenever the configuration is reloaded.
+type uploader struct {
+    client    *transport.Client
+    apiScheme string
+    apiURL    string
+    apiKey    string
+    isLocal   bool
+    handshake bool // The server answers registrations with a credential
+    limits    transport.BatchLimits
+
+    logger    *slog.Logger
+    redactor  *redact.Redactor
+
+    // Sign requests instead of sending the token
+    signRequests bool
+
+    // Issued at registration, replaces apiKey for pushes
+    credential *registration.Credential
+}
+
+func newUploader(cfg *config.Config, logger *slog.Logger, redactor *redact.Redactor, credential *registration.Credential) (*uploader, error) {
+    apiScheme := "https"
+    if cfg.API.Insecure {
+        apiScheme = "http"
+    }
+
+    client, err := transport.NewClient(transport.Options{
+        ConnectTimeout: cfg.API.ConnectTimeout,
+        ReadTimeout:    cfg.API.ReadTimeout,
+        RequestTimeout: cfg.API.RequestTimeout,
+        Compression:    cfg.API.Compression,
+        Retry:          retryPolicy(cfg.API.Retry),
+        Proxy:          cfg.API.Proxy,
+        TLS: transport.TLSOptions{
+            CertFile:   cfg.API.TLS.CertFile,
+            KeyFile:    cfg.API.TLS.KeyFile,
+            CAFile:     cfg.API.TLS.CAFile,
+            MinVersion: cfg.API.TLS.MinVersion,
+            ServerName: cfg.API.TLS.ServerName,
+            Pins:       cfg.API.TLS.Pins,
+        },
+    }, logger)
+    if err != nil {
+        return nil, fmt.Errorf("setting up the API client: %w", err)
+    }
+
+    return &uploader{
+        client:       client,
+        apiScheme:    apiScheme,
+        apiURL:       cfg.API.URL,
+        apiKey:       cfg.API.Token,
+        isLocal:      cfg.API.Local,
+        handshake:    cfg.API.Register && !cfg.API.Local,
+        signRequests: cfg.API.SignRequests,
+        limits: transport.BatchLimits{
+            MaxSamples: cfg.API.Batch.MaxSamples,
+            MaxBytes:   cfg.API.Batch.MaxBytes,
+        },
+        logger:     logger,
+        redactor:   redactor,
+        credential: credential,
+    }, nil
+}
+
+// bootstrapKeyID names the shared bootstrap token in signed requests.
+const bootstrapKeyID = "bootstrap"
+
+// authorization returns the key ID and secret that authenticate pushes: the
+// agent's own credential once it has registered, and the shared bootstrap
+// token before.
+func (u *uploader) authorization() (keyID, token string) {
+    if agentID, token := u.credential.Get(); token != "" {
+        return agentID, token
+    }
+    return bootstrapKeyID, u.apiKey
+}
+
+// pushData sends data to the queue, retrying temporary failures, and returns
+// an error unless the server eventually answered with a 2xx status.
+func (u *uploader) pushData(ctx context.Context, queueName string, data interface{}) error {
     // Define the API endpoint
-    apiEndpoint := fmt.Sprintf("%s://%s/%s", apiScheme, apiURL, queueName)
-    authToken := apiKey
+    apiEndpoint := fmt.Sprintf("%s://%s/%s", u.apiScheme, u.apiURL, queueName)
+
+    contentType, requestData, err := u.encode(data)
+    if err != nil {
+        return err
+    }
+    keyID, token := u.authorization()
+    _, err = u.postBody(ctx, apiEndpoint, contentType, requestData, keyID, token)
+    return err
+}
+
+// errNoHandshake means the server took the registration but answered
+// without issuing a credential.
+var errNoHandshake = errors.New("server does not issue credentials")
+
+// register sends the host information to the registration queue and returns
+// what the server issued. A registered agent authenticates with its current
+// credential so the server rotates it; if the server no longer knows it, the
+// bootstrap token registers the agent anew. GoAWS cannot issue anything, so
+// in local mode, or without the handshake, a delivered message is all there
+// is and the returned state is nil.
+func (u *uploader) register(ctx context.Context, queueName string, hostInfo OneTimeHostInfo) (*registration.State, error) {
+    apiEndpoint := fmt.Sprintf("%s://%s/%s", u.apiScheme, u.apiURL, queueName)
+
+    contentType, requestData, err := u.encode(hostInfo)
+    if err != nil {
+        return nil, err
+    }
+    keyID, token := bootstrapKeyID, u.apiKey
+    if u.handshake {
+        keyID, token = u.authorization()
+    }
+    body, err := u.postBody(ctx, apiEndpoint, contentType, requestData, keyID, token)
+    var statusErr *transport.StatusError
+    if keyID != bootstrapKeyID && errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+        u.logger.Warn("The server rejected the agent credential, registering with the bootstrap token")
+        body, err = u.postBody(ctx, apiEndpoint, contentType, requestData, bootstrapKeyID, u.apiKey)
+    }
+    if err != nil || !u.handshake {
+        return nil, err
+    }
+
+    st, err := registration.ParseResponse(body)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", errNoHandshake, err)
+    }
+    return st, nil
+}
 
+// encode builds the request body for one message in the format of the
+// local or production API.
+func (u *uploader) encode(data interface{}) (string, string, error) {
     var requestData string
     var contentType string
 
     // Check if we are in a local or production environment
-    if isLocal {
+    if u.isLocal {
         // For local GoAWS, use x-www-form-urlencoded
         jsonData, err := json.Marshal(data)
         if err != nil {
-            logger.Printf("Error marshalling data: %v", err)
-            return
+            u.logger.Error("Error marshalling data", "err", err)
+            return "", "", err
         }
         requestData = fmt.Sprintf("Action=SendMessage&MessageBody=%s", string(jsonData))
         contentType = "application/x-www-form-urlencoded"
@@ -203,140 +346,119 @@ func pushData(apiScheme, apiURL, apiKey, queueName string, data interface{}, log
             // "Action":      "SendMessage",
         })
         if err != nil {
-            logger.Printf("Error marshalling JSON data: %v", err)
-            return
+            u.logger.Error("Error marshalling JSON data", "err", err)
+            return "", "", err
         }
         requestData = string(jsonData)
         contentType = "application/json"
     }
 
-    // Log the URL and request body
-    logger.Printf("Request URL: %s", apiEndpoint)
-    logger.Printf("Request Body: %s", requestData)
-
-    // Create a new HTTP POST request
-    req, err := http.NewRequest("POST", apiEndpoint, strings.NewReader(requestData))
-    if err != nil {
-        logger.Printf("Error creating HTTP request: %v", err)
-        return
-    }
-
-    // Set necessary headers
-    req.Header.Set("Content-Type", contentType)
-    req.Header.Set("Authorization", authToken)
-
-    // Log the headers
-    logger.Printf("Request Headers: Content-Type=%s, Authorization=%s", contentType, authToken)
-
-    // Send the HTTP request
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        logger.Printf("Error sending data to server: %v", err)
-        return
-    }
-    defer resp.Body.Close()
-
-    // Check the response status code
-    logger.Printf("Response Status: %d", resp.StatusCode)
-
-    // Check the response status code
-    if resp.StatusCode != http.StatusOK {
-        logger.Printf("Failed to push data to server. Status Code: %d", resp.StatusCode)
-    } else {
-        logger.Println("Data successfully pushed to the server")
-    }
+    return contentType, requestData, nil
 }
 
-func gatherBasicMetrics(logger *log.Logger) (float64, uint64) {
-    if atomic.LoadInt32(&isPaused) == 1 {
-        logger.Println("Data collection paused due to high resource usage")
-        return 0, 0
+// pushBatch sends several encoded samples to the queue in a single request.
+func (u *uploader) pushBatch(ctx context.Context, queueName string, samples []json.RawMessage) error {
+    if !u.isLocal {
+        // The gateway forwards the whole envelope as one SQS message
+        return u.pushData(ctx, queueName, transport.NewEnvelope(samples))
     }
 
-    cpuPercent, memoryUsage, err := metrics.GatherBasicMetrics()
-    if err != nil {
-        logger.Printf("Error gathering basic metrics: %v", err)
-    }
-    return cpuPercent, memoryUsage
+    // GoAWS speaks the SQS API directly, so every sample becomes one entry
+    // of a SendMessageBatch call
+    apiEndpoint := fmt.Sprintf("%s://%s/%s", u.apiScheme, u.apiURL, queueName)
+    requestData := transport.SendMessageBatchForm(samples).Encode()
+    keyID, token := u.authorization()
+    _, err := u.postBody(ctx, apiEndpoint, "application/x-www-form-urlencoded", requestData, keyID, token)
+    return err
 }
 
-func gatherProcessMetrics(logger *log.Logger) []metrics.ProcessInfo {
-    processInfoList, err := metrics.GatherProcessMetrics()
-    if err != nil {
-        logger.Printf("Error gathering process metrics: %v", err)
-        return nil
+// postBody sends an encoded request body, retrying temporary failures, and
+// returns the response body. The request is signed with token, or carries it
+// in the Authorization header when signing is disabled.
+func (u *uploader) postBody(ctx context.Context, apiEndpoint, contentType, requestData, keyID, token string) ([]byte, error) {
+    // Log the request, the payload only at trace level and redacted
+    u.logger.Debug("Sending request", "url", apiEndpoint, "content_type", contentType, "bytes", len(requestData))
+    if u.logger.Enabled(ctx, logging.LevelTrace) {
+        u.logger.Log(ctx, logging.LevelTrace, "Request payload", "body", u.redactor.Body(contentType, []byte(requestData)))
     }
-    return processInfoList
-}
 
-func gatherNetworkMetrics(logger *log.Logger) ([]metrics.NetworkStat, []metrics.ConnectionStat) {
-    netStats, connStats, err := metrics.GatherNetworkMetrics()
-    if err != nil {
-        logger.Printf("Error gathering network metrics: %v", err)
-        return nil, nil
+    // Send the HTTP POST request
+    header := http.Header{}
+    header.Set("Content-Type", contentType)
+    var signer transport.Signer
+    if u.signRequests {
+        signer = transport.HMACSigner{KeyID: keyID, Secret: []byte(token)}
+    } else {
+        header.Set("Authorization", token)
     }
-    return netStats, connStats
-}
-
-func gatherDiskMetrics(logger *log.Logger) map[string]disk.IOCountersStat {
-    diskIOStats, err := metrics.GatherDiskIOInfo()
+    body, err := u.client.PostResponse(ctx, apiEndpoint, header, []byte(requestData), signer)
     if err != nil {
-        logger.Printf("Error gathering disk metrics: %v", err)
-        return nil
+        if transport.IsRetryable(err) {
+            u.logger.Error("Error sending data to server, giving up for now", "url", apiEndpoint, "err", err)
+        } else {
+            u.logger.Error("Server permanently rejected data", "url", apiEndpoint, "err", err)
+        }
+        return nil, err
     }
-    return diskIOStats
-}
 
-func gatherDiskUsage(logger *log.Logger) []metrics.DiskUsageInfo {
-    diskUsageInfo, err := metrics.GatherDiskUsage()
-    if err != nil {
-        logger.Printf("Error gathering disk usage: %v", err)
-        return nil
-    }
-    return diskUsageInfo
+    u.logger.Info("Data successfully pushed to the server", "url", apiEndpoint)
+    return body, nil
 }
 
 // Gather one-time host information when the agent starts
-func gatherOneTimeHostInfo(logger *log.Logger, apiKey string) OneTimeHostInfo {
+func gatherOneTimeHostInfo(logger *slog.Logger) OneTimeHostInfo {
     // Gather Hostname and FQDN
     hostname, err := os.Hostname()
     if err != nil {
-        logger.Printf("Error gathering hostname: %v", err)
+        logger.Error("Error gathering hostname", "err", err)
     }
 
     // Assuming FQDN is the same as hostname on most systems
     fqdn := hostname
 
     // Gather CPU Information
-    cpuInfo, err := metrics.GatherCPUInfo()
+    cpuInfo, err := metrics.GatherCPUInfo(logger)
     if err != nil {
-        logger.Printf("Error gathering CPU info: %v", err)
+        logger.Warn("Error gathering CPU info", "err", err)
     }
 
     // Get IP address
     ip := getLocalIP(logger)
     // Check if the system is virtual
-    isVirtual := checkIfVirtual(logger)
-
-    // Generate a unique ID based on the API key, hostname, and IP
-    uniqueID := GenerateUniqueID(apiKey, hostname, ip)
+    isVirtual, virtualization := checkIfVirtual(logger)
 
     return OneTimeHostInfo{
-        Hostname:  hostname,
-        FQDN:      fqdn,
-        CPUInfo:   cpuInfo,
-        IP:        ip,
-        IsVirtual: isVirtual,
-        UniqueID:  uniqueID,
+        Hostname:       hostname,
+        FQDN:           fqdn,
+        CPUInfo:        cpuInfo,
+        IP:             ip,
+        IsVirtual:      isVirtual,
+        Virtualization: virtualization,
+    }
+}
+
+// sinkHost converts the registration information into the host description
+// the sinks attach to every sample.
+func sinkHost(hostInfo OneTimeHostInfo) sink.Host {
+    h := sink.Host{
+        Hostname:       hostInfo.Hostname,
+        FQDN:           hostInfo.FQDN,
+        IP:             hostInfo.IP,
+        UniqueID:       hostInfo.UniqueID,
+        IsVirtual:      hostInfo.IsVirtual,
+        Virtualization: hostInfo.Virtualization,
     }
+    if bootTime, err := host.BootTime(); err == nil {
+        h.BootTime = time.Unix(int64(bootTime), 0)
+    }
+    return h
 }
 
 // Get the local IP address
-func getLocalIP(logger *log.Logger) string {
+func getLocalIP(logger *slog.Logger) string {
     addrs, err := net.InterfaceAddrs()
     if err != nil {
-        logger.Printf("Error getting IP address: %v", err)
+        logger.Error("Error getting IP address", "err", err)
         return ""
     }
     for _, addr := range addrs {
@@ -349,36 +471,37 @@ func getLocalIP(logger *log.Logger) string {
     return ""
 }
 
-// Check if the system is virtual by querying host info
-func checkIfVirtual(logger *log.Logger) bool {
+// Check if the system is virtual by querying host info. The name of the
+// virtualization system is returned when it is known.
+func checkIfVirtual(logger *slog.Logger) (bool, string) {
     // Check if we're on Linux, macOS, or Windows
     switch runtime.GOOS {
     case "linux", "darwin":
         info, err := host.Info()
         if err != nil {
-            logger.Printf("Error checking if system is virtual: %v", err)
-            return false
+            logger.Warn("Error checking if system is virtual", "err", err)
+            return false, ""
         }
-        return info.VirtualizationSystem != ""
+        return info.VirtualizationSystem != "", info.VirtualizationSystem
     
     case "windows":
-        return checkIfVirtualWindows(logger)
+        return checkIfVirtualWindows(logger), ""
     
     default:
-        logger.Printf("Unsupported OS: %s", runtime.GOOS)
-        return false
+        logger.Warn("Unsupported OS", "os", runtime.GOOS)
+        return false, ""
     }
 }
 
 // Check if the system is virtual on Windows
-func checkIfVirtualWindows(logger *log.Logger) bool {
+func checkIfVirtualWindows(logger *slog.Logger) bool {
     // Uncomment the following block if WMI checks are enabled
     /*
     var cs []win32_ComputerSystem
     query := wmi.CreateQuery(&cs, "")
     err := wmi.Query(query, &cs)
     if err != nil {
-        logger.Printf("Error checking if system is virtual on Windows: %v", err)
+        logger.Warn("Error checking if system is virtual on Windows", "err", err)
         return false
     }
 
@@ -398,9 +521,23 @@ func checkIfVirtualWindows(logger *log.Logger) bool {
     return false
 }
 
+// Exit codes reported by the agent
+const (
+    exitOK          = 0 // Stopped cleanly with every sample pushed
+    exitError       = 1 // Failed to start
+    exitFlushFailed = 2 // Stopped, but samples are still buffered on disk
+)
+
 func main() {
+    os.Exit(run())
+}
+
+// run starts the agent and blocks until it receives SIGINT or SIGTERM. It
+// returns the process exit code.
+func run() int {
     // Define the console flag
     // loggingFlag := flag.Bool("log", true, "Enables logging output to file. Default is ture")
+    configFlag := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "Path to the YAML configuration file")
     consoleFlag := flag.Bool("console", false, "Enable console output for collected data")
     tokenFlag := flag.String("token", "1234567890", "Provide client authentication token")
     apiURLFlag := flag.String("api-url", "api.ulteriorlabs.io", "Override the default url")
@@ -408,156 +545,835 @@ func main() {
     isLocalFlag := flag.Bool("local", false, "Use local dev environment for GoAWS")
     flag.Parse()
 
-    var logger *log.Logger
-    // Always create a log file to store the output
-    file, err := os.OpenFile("console_output.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        log.Fatalf("Failed to create log file: %v", err)
+    // Flags given on the command line take precedence over the file and
+    // environment, also when the configuration is reloaded
+    loadConfig := func() (*config.Config, error) {
+        cfg, err := config.Load(*configFlag, nil)
+        if err != nil {
+            return nil, err
+        }
+        // Settings issued at registration sit between the defaults and the file
+        reg, err := registration.Load(cfg.StateDir)
+        if err != nil {
+            return nil, err
+        }
+        if reg != nil && len(reg.Config) > 0 {
+            if cfg, err = config.Load(*configFlag, reg.Config); err != nil {
+                return nil, err
+            }
+            if len(cfg.IgnoredServerSettings) > 0 {
+                slog.Warn("Ignoring settings the server may not change", "settings", cfg.IgnoredServerSettings)
+            }
+        }
+        flag.Visit(func(f *flag.Flag) {
+            switch f.Name {
+            case "console":
+                cfg.Console = *consoleFlag
+            case "token":
+                cfg.API.Token = *tokenFlag
+            case "api-url":
+                cfg.API.URL = *apiURLFlag
+            case "insecure":
+                cfg.API.Insecure = *insecureFlag
+            case "local":
+                cfg.API.Local = *isLocalFlag
+            }
+        })
+        return cfg, nil
     }
-    defer file.Close()
 
-    if *consoleFlag {
-        // Create a multi-writer to write to both stdout and the log file
-        multiWriter := io.MultiWriter(os.Stdout, file)
-        logger = log.New(multiWriter, "", log.LstdFlags)
-        logger.Println("Console flag enabled: true")
-    } else {
-        logger = log.New(file, "", log.LstdFlags)
+    cfg, err := loadConfig()
+    if err != nil {
+        slog.Error("Failed to load configuration", "err", err)
+        return exitError
     }
 
-    logger.Println("Starting the agent...")
+    // The level follows reloads, the other log settings need a restart
+    logLevel := new(slog.LevelVar)
+    level, _ := logging.ParseLevel(cfg.Log.Level)
+    logLevel.Set(level)
 
-    apiScheme := "https"
-    if *insecureFlag {
-        apiScheme = "http"
+    redactor := redact.New(cfg.Log.Redact)
+    logger, logOutputs, err := newLogger(cfg, logLevel, redactor)
+    if err != nil {
+        slog.Error("Failed to set up logging", "err", err)
+        return exitError
+    }
+    defer logOutputs.Close()
+    slog.SetDefault(logger)
+    if cfg.Console {
+        logger.Info("Console flag enabled")
     }
-    apiURL := *apiURLFlag
-    apiKey := *tokenFlag
-    isLocal := *isLocalFlag
 
+    // Cancelled on SIGINT or SIGTERM, which stops collection, the watchdog
+    // and any request in flight
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // SIGHUP, or a change to the config file when watching is enabled,
+    // reloads the configuration
+    reload := make(chan os.Signal, 1)
+    signal.Notify(reload, syscall.SIGHUP)
+    defer signal.Stop(reload)
+
+    logger.Info("Starting the agent")
+    if *configFlag != "" {
+        logger.Info("Loaded configuration", "path", *configFlag)
+        go watchConfigFile(ctx, *configFlag, cfg.ConfigWatchInterval, reload, logger)
+    }
+
+    // API settings and HTTP client shared by every push
+    credential := new(registration.Credential)
+    up, err := newUploader(cfg, logger, redactor, credential)
+    if err != nil {
+        logger.Error("Failed to start", "err", err)
+        return exitError
+    }
 
     // Register the agent with the mothership and send one-time host information
-    hostInfo := gatherOneTimeHostInfo(logger, apiKey)
-    registerAgentWithHostInfo(hostInfo, *consoleFlag, logger)
+    hostInfo := gatherOneTimeHostInfo(logger)
+
+    reg, err := registration.Load(cfg.StateDir)
+    if err != nil {
+        logger.Error("Failed to load the registration", "err", err)
+        return exitError
+    }
+
+    // The agent ID is created on first start and kept in the state directory.
+    // The ID derived from the token, hostname and IP is only worth reporting
+    // if an earlier agent may have used it.
+    var legacyID string
+    if installedBefore(cfg, reg) {
+        legacyID = GenerateUniqueID(up.apiKey, hostInfo.Hostname, hostInfo.IP)
+    }
+    id, created, err := identity.Load(ctx, identity.Options{
+        Dir:          cfg.StateDir,
+        Seeds:        cfg.Identity.Seed,
+        CloudTimeout: cfg.Identity.CloudTimeout,
+        LegacyID:     legacyID,
+    })
+    if err != nil {
+        logger.Error("Failed to load the agent ID", "err", err)
+        return exitError
+    }
+    if created {
+        logger.Info("Created a new agent ID", "id", id.ID, "source", id.Source)
+    }
+    hostInfo.UniqueID = id.ID
+    hostInfo.PreviousID = id.PreviousID
+
+    // A registered agent uses the ID and credential the server issued
+    if reg != nil {
+        hostInfo.UniqueID = reg.AgentID
+        credential.Set(reg.AgentID, reg.Credential)
+    }
+    registerAgentWithHostInfo(hostInfo, cfg.Console, logger)
 
     // Push one-time host information to the registration queue
     // pushHostInfoToServer(apiScheme, apiURL, apiKey, hostInfo, "register", logger)
-    pushData(apiScheme, apiURL, apiKey, "register", hostInfo, logger, isLocal)
+    // Registration runs in the background so the agent collects, buffers
+    // and exports while the server is unreachable. Until it succeeds pushes
+    // use the bootstrap token, after it the issued credential, ID and
+    // settings are picked up by the main loop. A reload meanwhile restarts
+    // it with the new settings.
+    registered := make(chan *registration.State, 1)
+    startRegistration := func(up *uploader, cfg *config.Config, hostInfo OneTimeHostInfo) (context.CancelFunc, <-chan struct{}) {
+        regCtx, cancel := context.WithCancel(ctx)
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            st, err := registerUntilAccepted(regCtx, up, cfg, hostInfo, id, logger)
+            if err != nil || st == nil {
+                return
+            }
+            credential.Set(st.AgentID, st.Credential)
+            registered <- st
+        }()
+        return cancel, done
+    }
+    stopRegistration, registrationDone := startRegistration(up, cfg, hostInfo)
+    defer func() { stopRegistration() }()
 
     // Get the current process using the PID
     pid := int32(os.Getpid())
     proc, err := process.NewProcess(pid)
     if err != nil {
-        logger.Fatal("Failed to create process object", err)
+        logger.Error("Failed to create process object", "err", err)
+        return exitError
+    }
+
+    // Start the watchdog goroutine, restarted with new thresholds on reload
+    watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+    go watchdog(watchdogCtx, proc, cfg.Watchdog, logger)
+
+    // Collectors that fill in each sample
+    registry := metrics.NewDefaultRegistry(logger)
+    if cfg.StatsD.Enabled {
+        startStatsD(ctx, registry, cfg.StatsD, logger)
+    }
+    applyCollectorSettings(registry, cfg, logger)
+
+    // Spool collected metrics to disk until they are pushed successfully
+    metricsBuffer, err := spool.Open(cfg.Buffer.Dir, spool.Options{
+        MaxBytes: cfg.Buffer.MaxBytes,
+        MaxAge:   cfg.Buffer.MaxAge,
+        Logger:   logger,
+    })
+    if err != nil {
+        logger.Error("Failed to open metrics buffer", "err", err)
+        stopWatchdog()
+        return exitError
+    }
+    if pending := metricsBuffer.Len(); pending > 0 {
+        logger.Info("Replaying buffered samples from a previous run", "samples", pending)
+    }
+
+    // Optional Prometheus scrape endpoint serving the latest sample
+    var exporter *prometheus.Exporter
+    if cfg.Prometheus.Enabled {
+        exporter = prometheus.NewExporter(cfg.Prometheus.TopProcesses)
+        go func() {
+            if err := exporter.ListenAndServe(ctx, cfg.Prometheus.Listen, cfg.Prometheus.Path, logger); err != nil {
+                logger.Error("Prometheus exporter stopped", "err", err)
+            }
+        }()
     }
 
-    // Start the watchdog goroutine
-    go watchdog(proc, logger)
+    // Every sample goes to the buffer for the API and to the optional
+    // exports, each written in the background with its own queue
+    router := newRouter(cfg, sinkHost(hostInfo), metricsBuffer, exporter, logger)
+    if exporter != nil {
+        exporter.SetSinkStats(router.Stats)
+    }
+    router.Run(ctx)
 
-    // Buffer to hold collected metrics every 30 seconds
-    var metricsBuffer []MetricsData
+    // Create a ticker for collecting data (every 30 seconds by default)
+    dataCollectionTicker := time.NewTicker(cfg.CollectionInterval)
+    // Create another ticker for pushing data (every 5 minutes by default)
+    dataPushTicker := time.NewTicker(cfg.PushInterval)
+    defer dataCollectionTicker.Stop()
+    defer dataPushTicker.Stop()
 
-    // Create a ticker for collecting data every 30 seconds
-    dataCollectionTicker := time.NewTicker(30 * time.Second)
-    // Create another ticker for pushing data every 5 minutes
-    dataPushTicker := time.NewTicker(5 * time.Minute)
+    // Closed when the push in flight, if any, is done
+    var pushDone chan struct{}
 
     for {
         select {
+        case <-ctx.Done():
+            stop()
+            stopWatchdog()
+            logger.Info("Shutting down, flushing buffered data")
+            // The sinks started draining with the cancellation, the final
+            // push gets what is left of the same shutdown timeout
+            flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.ShutdownTimeout)
+            defer cancel()
+            if pushDone != nil {
+                <-pushDone
+            }
+            router.Wait()
+            return shutdown(flushCtx, up, metricsBuffer, cfg.API.MetricsQueue, logger)
+
+        case st := <-registered:
+            if st.AgentID != hostInfo.UniqueID {
+                // The exports keep the ID they were started with
+                logger.Info("Using the agent ID issued at registration, restart the agent to apply it to the exports", "id", st.AgentID)
+                hostInfo.UniqueID = st.AgentID
+            }
+            if reg == nil || !bytes.Equal(st.Config, reg.Config) {
+                select {
+                case reload <- syscall.SIGHUP:
+                default:
+                }
+            }
+            reg = st
+
+        case <-reload:
+            newCfg, err := loadConfig()
+            var newUp *uploader
+            if err == nil {
+                newUp, err = newUploader(newCfg, logger, redactor, credential)
+            }
+            if err != nil {
+                logger.Error("Keeping the current configuration, reload failed", "err", err)
+                continue
+            }
+            logger.Info("Reloading configuration")
+            warnRestartRequired(cfg, newCfg, logger)
+            if level, err := logging.ParseLevel(newCfg.Log.Level); err == nil {
+                logLevel.Set(level)
+            }
+
+            // The buffer, the registry and the registration state carry over,
+            // everything derived from the settings is rebuilt
+            up = newUp
+            select {
+            case <-registrationDone:
+            default:
+                logger.Info("Restarting the registration with the reloaded configuration")
+                stopRegistration()
+                stopRegistration, registrationDone = startRegistration(newUp, newCfg, hostInfo)
+            }
+            applyCollectorSettings(registry, newCfg, logger)
+            dataCollectionTicker.Reset(newCfg.CollectionInterval)
+            dataPushTicker.Reset(newCfg.PushInterval)
+
+            stopWatchdog()
+            watchdogCtx, stopWatchdog = context.WithCancel(ctx)
+            go watchdog(watchdogCtx, proc, newCfg.Watchdog, logger)
+
+            cfg = newCfg
+
         case <-dataCollectionTicker.C:
-            logger.Println("Data collection tick")
-            // Collect metrics every 30 seconds
-            cpuPercent, memoryUsage := gatherBasicMetrics(logger)
-            processInfo := gatherProcessMetrics(logger)
-            netStats, connStats := gatherNetworkMetrics(logger)
-            diskIOStats := gatherDiskMetrics(logger)
-            diskUsageInfo := gatherDiskUsage(logger)
-
-            metricsData := MetricsData{
-                CPUPercent: cpuPercent,
-                MemoryUsage: memoryUsage,
-                ProcessInfo: processInfo,
-                NetworkStats: netStats,
-                ConnStats: connStats,
-                DiskIOStats: diskIOStats,
-                DiskUsageInfo: diskUsageInfo,
+            logger.Debug("Data collection tick")
+            if atomic.LoadInt32(&isPaused) == 1 {
+                logger.Info("Data collection paused due to high resource usage")
+                continue
+            }
+
+            // Collect metrics from every collector that is due
+            metricsData := metrics.MetricsData{
                 Timestamp: time.Now(),
                 UniqueID: hostInfo.UniqueID,
             }
+            if err := registry.Collect(ctx, metricsData.Timestamp, &metricsData); err != nil {
+                logger.Error("Error collecting metrics", "err", err)
+            }
 
-            // Add the collected data to the buffer
-            metricsBuffer = append(metricsBuffer, metricsData)
+            // Hand the sample to the buffer and the other sinks
+            router.Route(metricsData)
 
             // Log collected data
             logMetrics(metricsData, logger)
 
         case <-dataPushTicker.C:
-            // Push data to the server every 5 minutes
-            if len(metricsBuffer) > 0 {
-                for _, metricsData := range metricsBuffer {
-                    pushData(apiScheme, apiURL, apiKey, "agent", metricsData, logger, isLocal)
-                }
-                metricsBuffer = nil // Clear the buffer after pushing
-            } else {
-                logger.Println("No data to push to the server.")
+            logSinkStats(router.Stats(), logger)
+            if pushDone != nil {
+                logger.Info("Previous push still running, skipping this one")
+                continue
             }
+
+            // Push the buffered data to the server in the background, so a
+            // slow server doesn't hold up collection
+            pushDone = make(chan struct{})
+            go func(up *uploader, queueName string, done chan struct{}) {
+                defer close(done)
+                up.pushBuffered(ctx, metricsBuffer, queueName)
+            }(up, cfg.API.MetricsQueue, pushDone)
+
+        case <-pushDone:
+            pushDone = nil
         }
     }
 }
 
-// Log collected metrics data
-func logMetrics(metricsData MetricsData, logger *log.Logger) {
-    logger.Printf("Collected Metrics at %s:\n", metricsData.Timestamp)
-    logger.Printf("CPU Usage: %.2f%%\n", metricsData.CPUPercent)
-    logger.Printf("Memory Usage: %d bytes\n", metricsData.MemoryUsage)
-    logger.Println("Process Information:")
+// installedBefore reports whether an earlier agent ran on this host: it
+// registered, or it left samples in the buffer.
+func installedBefore(cfg *config.Config, reg *registration.State) bool {
+    if reg != nil {
+        return true
+    }
+    entries, err := os.ReadDir(cfg.Buffer.Dir)
+    return err == nil && len(entries) > 0
+}
+
+// startStatsD starts the StatsD listeners and registers the server as the
+// collector that adds the aggregates to each sample.
+func startStatsD(ctx context.Context, registry *metrics.Registry, cfg config.StatsDConfig, logger *slog.Logger) {
+    server := statsd.NewServer(cfg.MaxSeries, cfg.FlushInterval, logger)
+    registry.Register(server)
+
+    if cfg.UDPListen != "" {
+        go func() {
+            if err := server.ListenUDP(ctx, cfg.UDPListen); err != nil {
+                logger.Error("StatsD UDP listener stopped", "err", err)
+            }
+        }()
+    }
+    if cfg.UnixSocket != "" {
+        go func() {
+            if err := server.ListenUnix(ctx, cfg.UnixSocket); err != nil {
+                logger.Error("StatsD Unix socket listener stopped", "err", err)
+            }
+        }()
+    }
+}
+
+// newRouter sets up the sinks every sample is written to: the buffer the
+// API is pushed from, the Prometheus exporter and the enabled exports.
+func newRouter(cfg *config.Config, host sink.Host, buffer *spool.Spool, exporter *prometheus.Exporter, logger *slog.Logger) *sink.Router {
+    router := sink.NewRouter(cfg.ShutdownTimeout, logger)
+
+    // The API has its own retries when pushing from the buffer
+    router.Add(sink.NewSpool(buffer), sink.RouteOptions{QueueSize: 100})
+
+    if exporter != nil {
+        router.Add(exporter, sink.RouteOptions{QueueSize: 10})
+    }
+
+    if cfg.File.Enabled {
+        fileSink, err := sink.NewFile(cfg.File.Path, rotate.Options{
+            MaxBytes: cfg.File.MaxBytes,
+            MaxAge:   cfg.File.MaxAge,
+            Compress: cfg.File.Compress,
+            MaxFiles: cfg.File.MaxFiles,
+            OnError: func(err error) {
+                logger.Error("Error cleaning up rotated metrics files", "err", err)
+            },
+        })
+        if err != nil {
+            logger.Error("Not writing metrics to a file", "err", err)
+        } else {
+            router.Add(fileSink, sink.RouteOptions{QueueSize: cfg.File.QueueSize})
+            logger.Info("Writing metrics to a file", "path", cfg.File.Path)
+        }
+    }
+
+    if cfg.OTLP.Enabled {
+        client, err := transport.NewClient(transport.Options{
+            ConnectTimeout: cfg.OTLP.Timeout,
+            ReadTimeout:    cfg.OTLP.Timeout,
+            RequestTimeout: cfg.OTLP.Timeout,
+            Compression:    cfg.OTLP.Compression,
+        }, logger)
+        if err != nil {
+            logger.Error("Not exporting metrics over OTLP", "err", err)
+        } else {
+            router.Add(sink.NewOTLP(client, cfg.OTLP.Endpoint, cfg.OTLP.Headers, host, cfg.OTLP.TopProcesses), sink.RouteOptions{
+                QueueSize: cfg.OTLP.QueueSize,
+                Retry:     retryPolicy(cfg.OTLP.Retry),
+            })
+            logger.Info("Exporting metrics over OTLP", "endpoint", cfg.OTLP.Endpoint)
+        }
+    }
+
+    if cfg.InfluxDB.Enabled {
+        client, err := transport.NewClient(transport.Options{
+            ConnectTimeout: cfg.InfluxDB.Timeout,
+            ReadTimeout:    cfg.InfluxDB.Timeout,
+            RequestTimeout: cfg.InfluxDB.Timeout,
+            Compression:    cfg.InfluxDB.Compression,
+        }, logger)
+        if err != nil {
+            logger.Error("Not exporting metrics to InfluxDB", "err", err)
+        } else {
+            router.Add(sink.NewInfluxDB(client, cfg.InfluxDB.URL, cfg.InfluxDB.Token, host, cfg.InfluxDB.TopProcesses), sink.RouteOptions{
+                QueueSize: cfg.InfluxDB.QueueSize,
+                Retry:     retryPolicy(cfg.InfluxDB.Retry),
+            })
+            logger.Info("Exporting metrics to InfluxDB", "url", cfg.InfluxDB.URL)
+        }
+    }
+
+    if cfg.Graphite.Enabled {
+        router.Add(sink.NewGraphite(cfg.Graphite.Address, cfg.Graphite.Prefix, cfg.Graphite.Tags, cfg.Graphite.Timeout, host, cfg.Graphite.TopProcesses), sink.RouteOptions{
+            QueueSize: cfg.Graphite.QueueSize,
+            Retry:     retryPolicy(cfg.Graphite.Retry),
+        })
+        logger.Info("Exporting metrics to Graphite", "address", cfg.Graphite.Address)
+    }
+
+    return router
+}
+
+// retryPolicy converts the retry settings for the transport package.
+func retryPolicy(rc config.RetryConfig) transport.RetryPolicy {
+    return transport.RetryPolicy{
+        MaxAttempts:    rc.MaxAttempts,
+        InitialBackoff: rc.InitialBackoff,
+        MaxBackoff:     rc.MaxBackoff,
+        Multiplier:     rc.Multiplier,
+        Jitter:         rc.Jitter,
+    }
+}
+
+// logSinkStats logs how every sink is keeping up.
+func logSinkStats(stats []sink.Stats, logger *slog.Logger) {
+    for _, st := range stats {
+        attrs := []any{"sink", st.Name, "written", st.Written, "queued", st.Queued, "dropped", st.Dropped, "failed", st.Failed, "retries", st.Retries}
+        if st.Failed > 0 && st.LastError != "" {
+            attrs = append(attrs, "last_error", st.LastError)
+        }
+        logger.Info("Sink stats", attrs...)
+    }
+}
+
+// registerUntilAccepted sends the host information to the registration
+// queue until the server accepts it, waiting between rounds as between
+// retries, and stores what the server issued. It gives up when ctx ends or
+// when the server takes the host information without issuing a credential.
+// The returned state is nil in local mode and without the handshake.
+func registerUntilAccepted(ctx context.Context, up *uploader, cfg *config.Config, hostInfo OneTimeHostInfo, id *identity.Identity, logger *slog.Logger) (*registration.State, error) {
+    retry := retryPolicy(cfg.API.Retry)
+    for round := 1; ; round++ {
+        st, err := up.register(ctx, cfg.API.RegisterQueue, hostInfo)
+        if errors.Is(err, errNoHandshake) {
+            // Asking again would only queue the host information again
+            logger.Warn("Registration answered without a credential, pushing with the bootstrap token; set api.register to false for this server", "err", err)
+            st, err = nil, nil
+        }
+        if err == nil {
+            // The backend knows about the legacy ID now, stop sending it
+            if err := id.PreviousIDReported(); err != nil {
+                logger.Warn("Error updating the agent ID file", "err", err)
+            }
+            if st == nil {
+                return nil, nil
+            }
+            if err := st.Save(cfg.StateDir); err != nil {
+                logger.Error("Error storing the registration, the agent registers again on the next start", "err", err)
+            }
+            logger.Info("Agent registered", "id", st.AgentID)
+            return st, nil
+        }
+
+        delay := retry.Backoff(round)
+        logger.Error("Registration failed, retrying", "delay", delay.Round(time.Millisecond), "err", err)
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// newLogger sets up the agent's log from cfg. The console flag adds stdout
+// to the configured outputs.
+func newLogger(cfg *config.Config, level slog.Leveler, redactor *redact.Redactor) (*slog.Logger, io.Closer, error) {
+    outputs := cfg.Log.Outputs
+    if cfg.Console && !slices.Contains(outputs, logging.OutputStdout) {
+        outputs = append(slices.Clone(outputs), logging.OutputStdout)
+    }
+
+    return logging.New(logging.Options{
+        Format:  cfg.Log.Format,
+        Outputs: outputs,
+        Path:    cfg.Log.Path,
+        Rotate: rotate.Options{
+            MaxBytes: cfg.Log.MaxBytes,
+            MaxFiles: cfg.Log.MaxFiles,
+            Compress: cfg.Log.Compress,
+        },
+        Syslog: logging.SyslogOptions{
+            Network: cfg.Log.Syslog.Network,
+            Address: cfg.Log.Syslog.Address,
+            Tag:     cfg.Log.Syslog.Tag,
+        },
+        Redactor: redactor,
+    }, level)
+}
+
+// applyCollectorSettings enables, disables and re-times the registered
+// collectors according to cfg.
+func applyCollectorSettings(registry *metrics.Registry, cfg *config.Config, logger *slog.Logger) {
+    for name, cc := range cfg.Collectors {
+        if err := registry.SetEnabled(name, cc.IsEnabled()); err != nil {
+            logger.Warn("Ignoring settings for collector", "err", err)
+            continue
+        }
+        registry.SetInterval(name, cc.Interval)
+        if err := registry.SetExclude(name, cc.Exclude); err != nil {
+            logger.Warn("Ignoring settings for collector", "err", err)
+        }
+        if err := registry.SetFields(name, cc.Fields); err != nil {
+            logger.Warn("Ignoring settings for collector", "err", err)
+        }
+    }
+}
+
+// warnRestartRequired logs the changed settings that a reload cannot apply.
+func warnRestartRequired(oldCfg, newCfg *config.Config, logger *slog.Logger) {
+    oldLog, newLog := oldCfg.Log, newCfg.Log
+    oldLog.Level, newLog.Level = "", ""
+    if !reflect.DeepEqual(oldLog, newLog) || oldCfg.Console != newCfg.Console {
+        logger.Warn("Log settings changed, restart the agent to apply them")
+    }
+    if oldCfg.StateDir != newCfg.StateDir {
+        logger.Warn("State directory changed, restart the agent to apply it")
+    }
+    if oldCfg.Buffer != newCfg.Buffer {
+        logger.Warn("Buffer settings changed, restart the agent to apply them")
+    }
+    if oldCfg.Prometheus != newCfg.Prometheus {
+        logger.Warn("Prometheus settings changed, restart the agent to apply them")
+    }
+    if !reflect.DeepEqual(oldCfg.OTLP, newCfg.OTLP) {
+        logger.Warn("OTLP settings changed, restart the agent to apply them")
+    }
+    if oldCfg.File != newCfg.File {
+        logger.Warn("File export settings changed, restart the agent to apply them")
+    }
+    if oldCfg.StatsD != newCfg.StatsD {
+        logger.Warn("StatsD settings changed, restart the agent to apply them")
+    }
+    if oldCfg.InfluxDB != newCfg.InfluxDB {
+        logger.Warn("InfluxDB settings changed, restart the agent to apply them")
+    }
+    if oldCfg.Graphite != newCfg.Graphite {
+        logger.Warn("Graphite settings changed, restart the agent to apply them")
+    }
+}
+
+// watchConfigFile polls the config file and requests a reload when its
+// modification time changes. A zero interval disables watching.
+func watchConfigFile(ctx context.Context, path string, interval time.Duration, reload chan<- os.Signal, logger *slog.Logger) {
+    if interval <= 0 {
+        return
+    }
+
+    var lastMod time.Time
+    if info, err := os.Stat(path); err == nil {
+        lastMod = info.ModTime()
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        info, err := os.Stat(path)
+        if err != nil {
+            logger.Error("Error checking config file", "err", err)
+            continue
+        }
+        if info.ModTime().Equal(lastMod) {
+            continue
+        }
+        lastMod = info.ModTime()
+        logger.Info("Config file changed", "path", path)
+
+        select {
+        case reload <- syscall.SIGHUP:
+        default:
+            // A reload is already pending
+        }
+    }
+}
+
+// shutdown pushes what is left in the buffer, giving up when ctx ends, and
+// returns the exit code. Samples that could not be pushed stay on disk and are
+// replayed on the next start.
+func shutdown(ctx context.Context, up *uploader, buffer *spool.Spool, queueName string, logger *slog.Logger) int {
+    if err := up.pushBuffered(ctx, buffer, queueName); err != nil {
+        logger.Error("Final flush incomplete, samples remain buffered", "samples", buffer.Len(), "err", err)
+        return exitFlushFailed
+    }
+    logger.Info("Agent stopped")
+    return exitOK
+}
+
+// pushBuffered replays the spooled samples oldest first, grouped into batches
+// within the configured limits. It stops at the first failure so that samples
+// are always delivered in order, and only removes samples from the spool once
+// the server has accepted their batch. An error means samples were kept.
+func (u *uploader) pushBuffered(ctx context.Context, buffer *spool.Spool, queueName string) error {
+    records, err := buffer.Pending(0)
+    if err != nil {
+        u.logger.Error("Error reading buffered metrics", "err", err)
+        return err
+    }
+    if len(records) == 0 {
+        u.logger.Info("No data to push to the server")
+        return nil
+    }
+
+    limits := u.limits
+    if u.isLocal {
+        // SendMessageBatch has hard limits of its own
+        limits = limits.Min(transport.BatchLimits{
+            MaxSamples: transport.SQSMaxBatchEntries,
+            MaxBytes:   transport.SQSMaxBatchBytes,
+        })
+    }
+
+    sizes := make([]int, len(records))
+    for i, record := range records {
+        sizes[i] = len(record.Data)
+    }
+
+    sent := 0
+    for _, count := range transport.PlanBatches(sizes, limits) {
+        done, err := u.pushRecords(ctx, buffer, queueName, records[sent:sent+count])
+        sent += done
+        if err != nil {
+            u.logger.Warn("Keeping samples buffered until the next push", "samples", len(records)-sent)
+            return err
+        }
+    }
+    return nil
+}
+
+// pushRecords pushes one batch and removes it from the buffer once the server
+// accepted it. A batch the server rejects as invalid is sent again one sample
+// at a time, so that only the samples it cannot take are dropped. It returns
+// how many of the records are done with.
+func (u *uploader) pushRecords(ctx context.Context, buffer *spool.Spool, queueName string, batch []spool.Record) (int, error) {
+    samples := make([]json.RawMessage, len(batch))
+    ids := make([]string, len(batch))
+    for i, record := range batch {
+        samples[i] = record.Data
+        ids[i] = record.ID
+    }
+
+    err := u.pushBatch(ctx, queueName, samples)
+    switch {
+    case err == nil:
+        u.logger.Info("Pushed a batch", "samples", len(batch))
+    case !isRejectedPayload(err):
+        return 0, err
+    case len(batch) > 1:
+        u.logger.Warn("Server rejected a batch, pushing its samples one at a time", "samples", len(batch), "err", err)
+        for i := range batch {
+            if _, err := u.pushRecords(ctx, buffer, queueName, batch[i:i+1]); err != nil {
+                return i, err
+            }
+        }
+        return len(batch), nil
+    default:
+        // The server will never accept this sample, don't let it block the rest
+        u.logger.Error("Dropping a sample rejected by the server", "id", ids[0], "err", err)
+    }
+
+    if err := buffer.Ack(ids...); err != nil {
+        u.logger.Error("Error removing pushed samples from buffer", "err", err)
+    }
+    return len(batch), nil
+}
+
+// isRejectedPayload reports whether the server refused the pushed samples
+// themselves, so that sending them again can never succeed. A batch too large
+// for the server is split like an invalid one, a single sample it is still
+// too large for can never be delivered. Everything else, from authentication
+// and routing errors to rate limiting, is a problem of the setup or a passing
+// one and the data is kept until it is fixed.
+func isRejectedPayload(err error) bool {
+    var statusErr *transport.StatusError
+    if !errors.As(err, &statusErr) {
+        return false
+    }
+    switch statusErr.StatusCode {
+    case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+        return true
+    }
+    return false
+}
+
+// Log collected metrics data, a summary at info level and the details at
+// debug level
+func logMetrics(metricsData metrics.MetricsData, logger *slog.Logger) {
+    logger.Info("Collected metrics",
+        "timestamp", metricsData.Timestamp,
+        "cpu_percent", metricsData.CPUPercent,
+        "memory_bytes", memoryUsed(metricsData.Memory),
+        "processes", len(metricsData.ProcessInfo),
+        "connections", len(metricsData.ConnStats),
+    )
+    if !logger.Enabled(context.Background(), slog.LevelDebug) {
+        return
+    }
+
     for _, proc := range metricsData.ProcessInfo {
-        logger.Printf("PID: %d, Name: %s, CPU: %.2f%%, Memory: %d bytes\n",
-            proc.PID, proc.Name, proc.CPUPercent, proc.MemoryUsage)
+        attrs := []any{"pid", proc.PID, "name", proc.Name, "cpu_percent", proc.CPUPercent, "memory_bytes", proc.MemoryUsage}
+        if proc.Cmdline != "" {
+            attrs = append(attrs, "cmdline", proc.Cmdline)
+        }
+        if proc.Username != "" {
+            attrs = append(attrs, "username", proc.Username)
+        }
+        if proc.Status != "" {
+            attrs = append(attrs, "status", proc.Status)
+        }
+        logger.Debug("Process", attrs...)
+    }
+    if c := metricsData.CPU; c != nil {
+        for _, t := range append([]metrics.CPUTimes{c.Total}, c.Cores...) {
+            logger.Debug("CPU", "cpu", t.CPU, "usage", t.Usage, "user", t.User, "system", t.System,
+                "iowait", t.Iowait, "steal", t.Steal)
+        }
+        logger.Debug("Load", "load1", c.Load1, "load5", c.Load5, "load15", c.Load15,
+            "procs_running", c.ProcsRunning, "procs_blocked", c.ProcsBlocked)
+    }
+    if m := metricsData.Memory; m != nil {
+        logger.Debug("Memory", "total", m.Total, "available", m.Available, "used", m.Used, "free", m.Free,
+            "buffers", m.Buffers, "cached", m.Cached, "swap_total", m.SwapTotal, "swap_used", m.SwapUsed)
+    }
+    if p := metricsData.Pressure; p != nil && p.Memory != nil {
+        logger.Debug("Memory pressure", "some_avg10", p.Memory.Some.Avg10, "some_avg60", p.Memory.Some.Avg60)
     }
-    logger.Println("Disk I/O Statistics:")
     for name, io := range metricsData.DiskIOStats {
-        logger.Printf("Disk: %s, ReadBytes: %d, WriteBytes: %d\n", name, io.ReadBytes, io.WriteBytes)
+        attrs := []any{"disk", name, "read_bytes", io.ReadBytes, "write_bytes", io.WriteBytes}
+        if s := io.Stats; s != nil {
+            attrs = append(attrs, "reads_per_sec", s.ReadsPerSec, "writes_per_sec", s.WritesPerSec,
+                "read_bytes_per_sec", s.ReadBytesPerSec, "write_bytes_per_sec", s.WriteBytesPerSec,
+                "await_ms", s.Await, "queue_depth", s.QueueDepth, "util_percent", s.UtilPercent)
+        }
+        logger.Debug("Disk I/O", attrs...)
     }
-    logger.Println("Disk Usage Statistics:")
     for _, disk := range metricsData.DiskUsageInfo {
-        logger.Printf("Device: %s, Total: %d, Free: %d, Used: %d, UsedPercent: %d, Mountpoint:%s\n", disk.Device, disk.Total, disk.Free, disk.Used, disk.UsedPercent, disk.Mountpoint)
+        logger.Debug("Disk usage", "device", disk.Device, "total", disk.Total, "free", disk.Free, "used", disk.Used, "used_percent", disk.UsedPercent, "mountpoint", disk.Mountpoint)
     }
-    logger.Println("Network I/O Statistics:")
     for _, io := range metricsData.NetworkStats {
-        logger.Printf("Interface: %s - Bytes Sent: %d, Bytes Received: %d\n", io.Name, io.BytesSent, io.BytesRecv)
+        attrs := []any{"interface", io.Name, "bytes_sent", io.BytesSent, "bytes_received", io.BytesRecv,
+            "errors_in", io.ErrIn, "errors_out", io.ErrOut, "drops_in", io.DropIn, "drops_out", io.DropOut}
+        if r := io.Rates; r != nil {
+            attrs = append(attrs, "bytes_sent_per_sec", r.BytesSent, "bytes_received_per_sec", r.BytesRecv,
+                "packets_sent_per_sec", r.PacketsSent, "packets_received_per_sec", r.PacketsRecv)
+        }
+        logger.Debug("Network I/O", attrs...)
     }
-    logger.Println("Active Network Connections:")
     for _, conn := range metricsData.ConnStats {
-        logger.Printf("Local Address: %s:%d -> Remote Address: %s:%d\n", conn.LocalAddr, conn.LocalPort, conn.RemoteAddr, conn.RemotePort)
+        logger.Debug("Network connection",
+            "local_addr", fmt.Sprintf("%s:%d", conn.LocalAddr, conn.LocalPort),
+            "remote_addr", fmt.Sprintf("%s:%d", conn.RemoteAddr, conn.RemotePort))
     }
 }
 
-func watchdog(proc *process.Process, logger *log.Logger) {
+// memoryUsed returns the used memory of a sample, 0 if it has none
+func memoryUsed(m *metrics.MemoryInfo) uint64 {
+    if m == nil {
+        return 0
+    }
+    return m.Used
+}
+
+func watchdog(ctx context.Context, proc *process.Process, cfg config.WatchdogConfig, logger *slog.Logger) {
+    ticker := time.NewTicker(cfg.Interval)
+    defer ticker.Stop()
+
     for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
         // Monitor CPU usage
         cpuPercent, err := proc.CPUPercent()
         if err != nil {
-            logger.Printf("Error getting CPU usage: %v", err)
+            logger.Error("Error getting CPU usage", "err", err)
             continue
         }
 
         // Monitor memory usage
         memInfo, err := proc.MemoryInfo()
         if err != nil {
-            logger.Printf("Error getting memory usage: %v", err)
+            logger.Error("Error getting memory usage", "err", err)
             continue
         }
 
-        // Define thresholds (3-5%)
-        if cpuPercent > 30 || float64(memInfo.RSS)/float64(memInfo.VMS)*100 > 5 {
-            logger.Println("Pausing data collection due to high resource usage")
+        // Compare against the configured thresholds
+        memPercent := float64(memInfo.RSS) / float64(memInfo.VMS) * 100
+        if cpuPercent > cfg.CPUPausePercent || memPercent > cfg.MemoryPausePercent {
+            logger.Warn("Pausing data collection due to high resource usage")
             atomic.StoreInt32(&isPaused, 1) // Pause data collection
-        } else if cpuPercent < 25 && float64(memInfo.RSS)/float64(memInfo.VMS)*100 < 3 {
-            logger.Println("Resuming data collection")
+        } else if cpuPercent < cfg.CPUResumePercent && memPercent < cfg.MemoryResumePercent {
+            logger.Info("Resuming data collection")
             atomic.StoreInt32(&isPaused, 0) // Resume data collection
         }
-
-        time.Sleep(5 * time.Second) // Check every 5 seconds
     }
 }
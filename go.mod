@@ -3,9 +3,11 @@ module github.com/dickiesanders/go-agent
 go 1.23
 
 require (
-	github.com/StackExchange/wmi v1.2.1
+	github.com/klauspost/compress v1.18.0
 	github.com/klauspost/cpuid/v2 v2.2.8
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,660 @@
+// Package config loads the agent settings from a YAML file and applies
+// GOAGENT_* environment variable overrides on top of it.
+package config
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "reflect"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/logging"
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+    "gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of every environment variable override.
+const EnvPrefix = "GOAGENT_"
+
+// Config holds all agent settings.
+type Config struct {
+    Console             bool                       `yaml:"console"`
+    CollectionInterval  time.Duration              `yaml:"collection_interval"`
+    PushInterval        time.Duration              `yaml:"push_interval"`
+    ShutdownTimeout     time.Duration              `yaml:"shutdown_timeout"`
+    ConfigWatchInterval time.Duration              `yaml:"config_watch_interval"` // 0 disables watching
+    StateDir            string                     `yaml:"state_dir"`             // Agent ID and other state kept across restarts
+    Identity            IdentityConfig             `yaml:"identity"`
+    API                 APIConfig                  `yaml:"api"`
+    Buffer              BufferConfig               `yaml:"buffer"`
+    Prometheus          PrometheusConfig           `yaml:"prometheus"`
+    OTLP                OTLPConfig                 `yaml:"otlp"`
+    InfluxDB            InfluxDBConfig             `yaml:"influxdb"`
+    StatsD              StatsDConfig               `yaml:"statsd"`
+    File                FileConfig                 `yaml:"file"`
+    Graphite            GraphiteConfig             `yaml:"graphite"`
+    Log                 LogConfig                  `yaml:"log"`
+    Watchdog            WatchdogConfig             `yaml:"watchdog"`
+    Collectors          map[string]CollectorConfig `yaml:"collectors"`
+
+    // Settings the server issued but may not change, left out by Load
+    IgnoredServerSettings []string `yaml:"-"`
+}
+
+// APIConfig describes the upload endpoint.
+type APIConfig struct {
+    URL           string `yaml:"url"`
+    Token         string `yaml:"token"`
+    Insecure      bool   `yaml:"insecure"` // Use plain HTTP instead of HTTPS
+    Local         bool   `yaml:"local"`    // Use the GoAWS form encoding
+    RegisterQueue string `yaml:"register_queue"`
+    MetricsQueue  string `yaml:"metrics_queue"`
+    Register      bool   `yaml:"register"` // Expect an agent ID and credential in answer to the registration
+
+    ConnectTimeout time.Duration `yaml:"connect_timeout"`
+    ReadTimeout    time.Duration `yaml:"read_timeout"`
+    RequestTimeout time.Duration `yaml:"request_timeout"`
+    Retry          RetryConfig   `yaml:"retry"`
+    Batch          BatchConfig   `yaml:"batch"`
+    Compression    string        `yaml:"compression"` // none, gzip or zstd
+    TLS            TLSConfig     `yaml:"tls"`
+    Proxy          string        `yaml:"proxy"`         // Proxy URL, "direct" for none, empty to use HTTP(S)_PROXY
+    SignRequests   bool          `yaml:"sign_requests"` // HMAC-sign requests instead of sending the token
+}
+
+// TLSConfig controls the TLS connection to the API. Insecure switches to
+// plain HTTP and ignores these settings.
+type TLSConfig struct {
+    CertFile   string   `yaml:"cert_file"`   // Client certificate for mutual TLS
+    KeyFile    string   `yaml:"key_file"`    // Key of the client certificate
+    CAFile     string   `yaml:"ca_file"`     // PEM bundle trusted in addition to the system roots
+    MinVersion string   `yaml:"min_version"` // 1.0, 1.1, 1.2 or 1.3
+    ServerName string   `yaml:"server_name"` // Name the server certificate must match, if not the URL host
+    Pins       []string `yaml:"pins"`        // Base64 SHA-256 hashes of trusted public keys
+}
+
+// BatchConfig limits how many samples go into one upload. Zero means no
+// limit. The local GoAWS path is additionally capped at the SQS
+// SendMessageBatch limits of 10 entries and 256KB.
+type BatchConfig struct {
+    MaxSamples int `yaml:"max_samples"`
+    MaxBytes   int `yaml:"max_bytes"`
+}
+
+// RetryConfig describes how failed pushes are retried with exponential
+// backoff. Jitter is the fraction of each delay that is randomized.
+type RetryConfig struct {
+    MaxAttempts    int           `yaml:"max_attempts"`
+    InitialBackoff time.Duration `yaml:"initial_backoff"`
+    MaxBackoff     time.Duration `yaml:"max_backoff"`
+    Multiplier     float64       `yaml:"multiplier"`
+    Jitter         float64       `yaml:"jitter"`
+}
+
+// IdentityConfig controls how the agent ID is created on first start. Once
+// stored in the state directory the ID no longer changes.
+type IdentityConfig struct {
+    Seed         []string      `yaml:"seed"`          // Any of machine-id and cloud, tried in order before a random ID
+    CloudTimeout time.Duration `yaml:"cloud_timeout"` // Limit for the cloud instance ID lookup
+}
+
+// BufferConfig describes the on-disk spool that holds samples until they are
+// pushed successfully.
+type BufferConfig struct {
+    Dir      string        `yaml:"dir"`
+    MaxBytes int64         `yaml:"max_bytes"` // 0 means unlimited
+    MaxAge   time.Duration `yaml:"max_age"`   // 0 means keep forever
+}
+
+// PrometheusConfig describes the optional scrape endpoint that serves the
+// latest sample.
+type PrometheusConfig struct {
+    Enabled      bool   `yaml:"enabled"`
+    Listen       string `yaml:"listen"`
+    Path         string `yaml:"path"`
+    TopProcesses int    `yaml:"top_processes"` // 0 exports every process
+}
+
+// OTLPConfig describes the optional OpenTelemetry OTLP/HTTP metrics export.
+type OTLPConfig struct {
+    Enabled      bool              `yaml:"enabled"`
+    Endpoint     string            `yaml:"endpoint"`
+    Headers      map[string]string `yaml:"headers"`     // Sent with every request, e.g. for authentication
+    Compression  string            `yaml:"compression"` // none or gzip
+    Timeout      time.Duration     `yaml:"timeout"`
+    QueueSize    int               `yaml:"queue_size"` // Samples held while the collector is slow
+    Retry        RetryConfig       `yaml:"retry"`
+    TopProcesses int               `yaml:"top_processes"`
+}
+
+// InfluxDBConfig describes the optional export in InfluxDB line protocol.
+// URL is the full write endpoint including the database or bucket, e.g.
+// http://localhost:8086/api/v2/write?org=acme&bucket=agents&precision=ns.
+type InfluxDBConfig struct {
+    Enabled      bool          `yaml:"enabled"`
+    URL          string        `yaml:"url"`
+    Token        string        `yaml:"token"`       // Sent as "Authorization: Token <token>"
+    Compression  string        `yaml:"compression"` // none or gzip
+    Timeout      time.Duration `yaml:"timeout"`
+    QueueSize    int           `yaml:"queue_size"`
+    Retry        RetryConfig   `yaml:"retry"`
+    TopProcesses int           `yaml:"top_processes"`
+}
+
+// GraphiteConfig describes the optional export to Carbon over the plaintext
+// TCP protocol.
+type GraphiteConfig struct {
+    Enabled      bool          `yaml:"enabled"`
+    Address      string        `yaml:"address"`
+    Prefix       string        `yaml:"prefix"` // Prepended to every metric path
+    Tags         bool          `yaml:"tags"`   // Append Graphite 1.1 tags
+    Timeout      time.Duration `yaml:"timeout"`
+    QueueSize    int           `yaml:"queue_size"`
+    Retry        RetryConfig   `yaml:"retry"`
+    TopProcesses int           `yaml:"top_processes"`
+}
+
+// FileConfig describes the optional local export that writes every sample
+// as a JSON line, rotated by size and age.
+type FileConfig struct {
+    Enabled   bool          `yaml:"enabled"`
+    Path      string        `yaml:"path"`
+    MaxBytes  int64         `yaml:"max_bytes"` // Rotate at this size, 0 disables
+    MaxAge    time.Duration `yaml:"max_age"`   // Rotate at this age, 0 disables
+    Compress  bool          `yaml:"compress"`  // Gzip rotated files
+    MaxFiles  int           `yaml:"max_files"` // Rotated files to keep, 0 keeps all
+    QueueSize int           `yaml:"queue_size"`
+}
+
+// StatsDConfig describes the optional StatsD/DogStatsD listener for custom
+// application metrics. An empty address or path disables that listener.
+type StatsDConfig struct {
+    Enabled       bool          `yaml:"enabled"`
+    UDPListen     string        `yaml:"udp_listen"`
+    UnixSocket    string        `yaml:"unix_socket"`
+    FlushInterval time.Duration `yaml:"flush_interval"` // 0 flushes on every collection tick
+    MaxSeries     int           `yaml:"max_series"`     // Distinct metrics kept between flushes, 0 means unlimited
+}
+
+// LogConfig describes the agent's own log. Only the level is applied on
+// reload, the other settings need a restart.
+type LogConfig struct {
+    Level    string       `yaml:"level"`     // trace, debug, info, warn or error
+    Format   string       `yaml:"format"`    // logfmt or json
+    Outputs  []string     `yaml:"outputs"`   // Any of file, stderr, stdout and syslog
+    Path     string       `yaml:"path"`      // Log file for the file output
+    MaxBytes int64        `yaml:"max_bytes"` // Rotate the log file at this size, 0 disables
+    MaxFiles int          `yaml:"max_files"` // Rotated log files to keep, 0 keeps all
+    Compress bool         `yaml:"compress"`  // Gzip rotated log files
+    Syslog   SyslogConfig `yaml:"syslog"`
+    Redact   []string     `yaml:"redact"` // Fields masked in log records and payload dumps, on top of secrets
+}
+
+// SyslogConfig selects the syslog daemon for the syslog log output. An empty
+// network and address use the local daemon.
+type SyslogConfig struct {
+    Network string `yaml:"network"` // udp, tcp or empty
+    Address string `yaml:"address"`
+    Tag     string `yaml:"tag"`
+}
+
+// WatchdogConfig holds the self-monitoring thresholds. Collection is paused
+// when either pause threshold is exceeded and resumed once both usages drop
+// below the resume thresholds.
+type WatchdogConfig struct {
+    Interval            time.Duration `yaml:"interval"`
+    CPUPausePercent     float64       `yaml:"cpu_pause_percent"`
+    CPUResumePercent    float64       `yaml:"cpu_resume_percent"`
+    MemoryPausePercent  float64       `yaml:"memory_pause_percent"`
+    MemoryResumePercent float64       `yaml:"memory_resume_percent"`
+}
+
+// CollectorConfig holds per-collector settings. A zero interval runs the
+// collector on every collection tick.
+type CollectorConfig struct {
+    Enabled  *bool         `yaml:"enabled"`
+    Interval time.Duration `yaml:"interval"`
+    Exclude  []string      `yaml:"exclude"` // Device name patterns to skip (diskio), unset uses the collector's defaults
+    Fields   []string      `yaml:"fields"`  // Optional fields to collect (process), see metrics.ProcessFields
+}
+
+// IsEnabled reports whether the collector should run. Collectors are enabled
+// unless explicitly turned off.
+func (c CollectorConfig) IsEnabled() bool {
+    return c.Enabled == nil || *c.Enabled
+}
+
+// defaultSinkRetry is the retry policy of the optional exports. They retry
+// less than the API since samples queue up in memory meanwhile.
+var defaultSinkRetry = RetryConfig{
+    MaxAttempts:    3,
+    InitialBackoff: time.Second,
+    MaxBackoff:     30 * time.Second,
+    Multiplier:     2,
+    Jitter:         0.2,
+}
+
+// Default returns the settings the agent uses when no file is given.
+func Default() *Config {
+    return &Config{
+        CollectionInterval: 30 * time.Second,
+        PushInterval:       5 * time.Minute,
+        ShutdownTimeout:    30 * time.Second,
+        StateDir:           "state",
+        Identity: IdentityConfig{
+            CloudTimeout: 2 * time.Second,
+        },
+        API: APIConfig{
+            URL:           "api.ulteriorlabs.io",
+            Token:         "1234567890",
+            RegisterQueue: "register",
+            MetricsQueue:  "agent",
+            Register:      false,
+            TLS: TLSConfig{
+                MinVersion: "1.2",
+            },
+            SignRequests: false,
+
+            ConnectTimeout: 10 * time.Second,
+            ReadTimeout:    30 * time.Second,
+            RequestTimeout: time.Minute,
+            Retry: RetryConfig{
+                MaxAttempts:    5,
+                InitialBackoff: time.Second,
+                MaxBackoff:     time.Minute,
+                Multiplier:     2,
+                Jitter:         0.2,
+            },
+            // A batch is sent as one SQS message, which is limited to 256KB
+            Batch: BatchConfig{
+                MaxSamples: 100,
+                MaxBytes:   256 << 10,
+            },
+        },
+        Buffer: BufferConfig{
+            Dir:      "spool",
+            MaxBytes: 64 << 20,
+            MaxAge:   24 * time.Hour,
+        },
+        Prometheus: PrometheusConfig{
+            Listen:       ":9273",
+            Path:         "/metrics",
+            TopProcesses: 10,
+        },
+        OTLP: OTLPConfig{
+            Endpoint:     "http://localhost:4318/v1/metrics",
+            Compression:  "gzip",
+            Timeout:      10 * time.Second,
+            QueueSize:    100,
+            Retry:        defaultSinkRetry,
+            TopProcesses: 10,
+        },
+        InfluxDB: InfluxDBConfig{
+            URL:          "http://localhost:8086/api/v2/write?org=goagent&bucket=goagent&precision=ns",
+            Compression:  "gzip",
+            Timeout:      10 * time.Second,
+            QueueSize:    100,
+            Retry:        defaultSinkRetry,
+            TopProcesses: 10,
+        },
+        Graphite: GraphiteConfig{
+            Address:      "localhost:2003",
+            Prefix:       "goagent",
+            Timeout:      10 * time.Second,
+            QueueSize:    100,
+            Retry:        defaultSinkRetry,
+            TopProcesses: 10,
+        },
+        File: FileConfig{
+            Path:      "metrics.jsonl",
+            MaxBytes:  64 << 20,
+            MaxAge:    24 * time.Hour,
+            Compress:  true,
+            MaxFiles:  7,
+            QueueSize: 100,
+        },
+        StatsD: StatsDConfig{
+            UDPListen: "127.0.0.1:8125",
+            MaxSeries: 10000,
+        },
+        Log: LogConfig{
+            Level:    "info",
+            Format:   "logfmt",
+            Outputs:  []string{"file"},
+            Path:     "console_output.log",
+            MaxBytes: 10 << 20,
+            MaxFiles: 5,
+            Syslog: SyslogConfig{
+                Tag: "go-agent",
+            },
+            Redact: []string{"remote_addr", "cmdline"},
+        },
+        Watchdog: WatchdogConfig{
+            Interval:            5 * time.Second,
+            CPUPausePercent:     30,
+            CPUResumePercent:    25,
+            MemoryPausePercent:  5,
+            MemoryResumePercent: 3,
+        },
+        Collectors: map[string]CollectorConfig{
+            "basic":     {},
+            "process":   {},
+            "network":   {},
+            "diskio":    {},
+            "diskusage": {},
+        },
+    }
+}
+
+// serverSettable lists the settings the server may issue at registration,
+// each with everything below it: the intervals, the collectors and the
+// options of the exports that don't say where data goes or comes from.
+var serverSettable = []string{
+    "collection_interval",
+    "push_interval",
+    "collectors",
+    "prometheus.top_processes",
+    "otlp.compression", "otlp.timeout", "otlp.queue_size", "otlp.retry", "otlp.top_processes",
+    "influxdb.compression", "influxdb.timeout", "influxdb.queue_size", "influxdb.retry", "influxdb.top_processes",
+    "graphite.tags", "graphite.timeout", "graphite.queue_size", "graphite.retry", "graphite.top_processes",
+    "file.max_bytes", "file.max_age", "file.compress", "file.max_files", "file.queue_size",
+    "statsd.flush_interval", "statsd.max_series",
+}
+
+// filterSettings removes the settings the server may not issue from
+// settings and returns their dotted names, sorted. prefix is prepended to
+// the names, for example "otlp." for the OTLP section.
+func filterSettings(settings map[string]any, prefix string) []string {
+    var ignored []string
+    for key, value := range settings {
+        name := prefix + key
+        if slices.Contains(serverSettable, name) {
+            continue
+        }
+        if nested, ok := value.(map[string]any); ok {
+            ignored = append(ignored, filterSettings(nested, name+".")...)
+            if len(nested) == 0 {
+                delete(settings, key)
+            }
+            continue
+        }
+        ignored = append(ignored, name)
+        delete(settings, key)
+    }
+    sort.Strings(ignored)
+    return ignored
+}
+
+// Load reads the YAML file at path over the defaults and then applies the
+// environment overrides. An empty path skips the file. server holds the
+// settings issued at registration, in the same layout; they are applied
+// over the defaults and under the file. Only the settings in serverSettable
+// are taken from it, the others are listed in IgnoredServerSettings.
+func Load(path string, server []byte) (*Config, error) {
+    cfg := Default()
+
+    if len(server) > 0 {
+        var settings map[string]any
+        if err := yaml.Unmarshal(server, &settings); err != nil {
+            return nil, fmt.Errorf("parsing server-issued settings: %w", err)
+        }
+        cfg.IgnoredServerSettings = filterSettings(settings, "")
+        allowed, err := yaml.Marshal(settings)
+        if err != nil {
+            return nil, fmt.Errorf("parsing server-issued settings: %w", err)
+        }
+        if err := yaml.Unmarshal(allowed, cfg); err != nil {
+            return nil, fmt.Errorf("parsing server-issued settings: %w", err)
+        }
+    }
+
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("reading config file: %w", err)
+        }
+        if err := yaml.Unmarshal(data, cfg); err != nil {
+            return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+        }
+    }
+
+    if err := applyEnv(reflect.ValueOf(cfg).Elem(), EnvPrefix, os.LookupEnv); err != nil {
+        return nil, err
+    }
+
+    if err := cfg.Validate(); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// Validate checks the settings for values the agent cannot run with.
+func (c *Config) Validate() error {
+    if c.CollectionInterval <= 0 {
+        return fmt.Errorf("collection_interval must be positive")
+    }
+    if c.PushInterval <= 0 {
+        return fmt.Errorf("push_interval must be positive")
+    }
+    if c.ShutdownTimeout <= 0 {
+        return fmt.Errorf("shutdown_timeout must be positive")
+    }
+    if c.StateDir == "" {
+        return fmt.Errorf("state_dir must not be empty")
+    }
+    for _, seed := range c.Identity.Seed {
+        if seed != "machine-id" && seed != "cloud" {
+            return fmt.Errorf("identity.seed must be any of machine-id and cloud, not %q", seed)
+        }
+    }
+    if c.Identity.CloudTimeout <= 0 {
+        return fmt.Errorf("identity.cloud_timeout must be positive")
+    }
+    if c.Watchdog.Interval <= 0 {
+        return fmt.Errorf("watchdog.interval must be positive")
+    }
+    if c.API.Retry.MaxAttempts < 1 {
+        return fmt.Errorf("api.retry.max_attempts must be at least 1")
+    }
+    if c.API.Retry.Jitter < 0 || c.API.Retry.Jitter > 1 {
+        return fmt.Errorf("api.retry.jitter must be between 0 and 1")
+    }
+    for name, rc := range map[string]RetryConfig{"otlp": c.OTLP.Retry, "influxdb": c.InfluxDB.Retry, "graphite": c.Graphite.Retry} {
+        if rc.Jitter < 0 || rc.Jitter > 1 {
+            return fmt.Errorf("%s.retry.jitter must be between 0 and 1", name)
+        }
+    }
+    switch c.API.Compression {
+    case "", "none", "gzip", "zstd":
+    default:
+        return fmt.Errorf("api.compression must be one of none, gzip or zstd")
+    }
+    if (c.API.TLS.CertFile == "") != (c.API.TLS.KeyFile == "") {
+        return fmt.Errorf("api.tls.cert_file and api.tls.key_file must be set together")
+    }
+    if _, err := transport.ParseTLSVersion(c.API.TLS.MinVersion); err != nil {
+        return fmt.Errorf("api.tls.min_version must be one of 1.0, 1.1, 1.2 or 1.3")
+    }
+    for _, pin := range c.API.TLS.Pins {
+        if _, err := transport.ParsePin(pin); err != nil {
+            return fmt.Errorf("api.tls.pins: %w", err)
+        }
+    }
+    if _, err := transport.ParseProxy(c.API.Proxy); err != nil {
+        return fmt.Errorf("api.proxy: %w", err)
+    }
+    if c.API.Batch.MaxSamples < 0 || c.API.Batch.MaxBytes < 0 {
+        return fmt.Errorf("api.batch limits must not be negative")
+    }
+    if c.Buffer.Dir == "" {
+        return fmt.Errorf("buffer.dir must be set")
+    }
+    if c.Buffer.MaxBytes < 0 || c.Buffer.MaxAge < 0 {
+        return fmt.Errorf("buffer limits must not be negative")
+    }
+    if c.Prometheus.Enabled && (c.Prometheus.Listen == "" || !strings.HasPrefix(c.Prometheus.Path, "/")) {
+        return fmt.Errorf("prometheus.listen must be set and prometheus.path must start with /")
+    }
+    if c.OTLP.Enabled && c.OTLP.Endpoint == "" {
+        return fmt.Errorf("otlp.endpoint must be set")
+    }
+    if c.InfluxDB.Enabled && c.InfluxDB.URL == "" {
+        return fmt.Errorf("influxdb.url must be set")
+    }
+    if c.Graphite.Enabled && c.Graphite.Address == "" {
+        return fmt.Errorf("graphite.address must be set")
+    }
+    if c.File.Enabled && c.File.Path == "" {
+        return fmt.Errorf("file.path must be set")
+    }
+    if c.File.MaxBytes < 0 || c.File.MaxAge < 0 || c.File.MaxFiles < 0 {
+        return fmt.Errorf("file limits must not be negative")
+    }
+    if c.StatsD.Enabled && c.StatsD.UDPListen == "" && c.StatsD.UnixSocket == "" {
+        return fmt.Errorf("statsd.udp_listen or statsd.unix_socket must be set")
+    }
+    if c.StatsD.FlushInterval < 0 || c.StatsD.MaxSeries < 0 {
+        return fmt.Errorf("statsd limits must not be negative")
+    }
+    if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+        return fmt.Errorf("log.level must be one of trace, debug, info, warn or error")
+    }
+    switch strings.ToLower(c.Log.Format) {
+    case "logfmt", "json":
+    default:
+        return fmt.Errorf("log.format must be logfmt or json")
+    }
+    for _, output := range c.Log.Outputs {
+        switch strings.ToLower(output) {
+        case "file":
+            if c.Log.Path == "" {
+                return fmt.Errorf("log.path must be set for the file output")
+            }
+        case "stderr", "stdout", "syslog":
+        default:
+            return fmt.Errorf("log.outputs must be any of file, stderr, stdout and syslog, not %q", output)
+        }
+    }
+    if c.Log.MaxBytes < 0 || c.Log.MaxFiles < 0 {
+        return fmt.Errorf("log limits must not be negative")
+    }
+    if c.API.URL == "" {
+        return fmt.Errorf("api.url must be set")
+    }
+    for name, cc := range c.Collectors {
+        if cc.Interval < 0 {
+            return fmt.Errorf("collectors.%s.interval must not be negative", name)
+        }
+        if _, err := metrics.ParseProcessFields(cc.Fields); err != nil {
+            return fmt.Errorf("collectors.%s.fields: %w", name, err)
+        }
+        for _, pattern := range cc.Exclude {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return fmt.Errorf("collectors.%s.exclude: invalid pattern %q", name, pattern)
+            }
+        }
+    }
+    return nil
+}
+
+// applyEnv walks the struct and overrides every field whose variable is set.
+// Variable names are the upper-cased yaml keys joined by underscores, for
+// example GOAGENT_API_URL or GOAGENT_COLLECTORS_PROCESS_INTERVAL.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+        if key == "" || key == "-" {
+            continue
+        }
+        name := prefix + strings.ToUpper(key)
+        fv := v.Field(i)
+
+        switch {
+        case fv.Kind() == reflect.Struct:
+            if err := applyEnv(fv, name+"_", lookup); err != nil {
+                return err
+            }
+        case fv.Kind() == reflect.Map && fv.Type().Elem().Kind() == reflect.Struct:
+            // Only keys already present in the map can be overridden
+            for _, mk := range fv.MapKeys() {
+                elem := reflect.New(fv.Type().Elem()).Elem()
+                elem.Set(fv.MapIndex(mk))
+                if err := applyEnv(elem, name+"_"+strings.ToUpper(mk.String())+"_", lookup); err != nil {
+                    return err
+                }
+                fv.SetMapIndex(mk, elem)
+            }
+        default:
+            raw, ok := lookup(name)
+            if !ok {
+                continue
+            }
+            if err := setValue(fv, raw); err != nil {
+                return fmt.Errorf("invalid value for %s: %w", name, err)
+            }
+        }
+    }
+    return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+    if v.Type() == reflect.TypeOf(time.Duration(0)) {
+        d, err := time.ParseDuration(raw)
+        if err != nil {
+            return err
+        }
+        v.SetInt(int64(d))
+        return nil
+    }
+
+    switch v.Kind() {
+    case reflect.String:
+        v.SetString(raw)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(raw)
+        if err != nil {
+            return err
+        }
+        v.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+            return err
+        }
+        v.SetInt(n)
+    case reflect.Float64:
+        f, err := strconv.ParseFloat(raw, 64)
+        if err != nil {
+            return err
+        }
+        v.SetFloat(f)
+    case reflect.Ptr:
+        elem := reflect.New(v.Type().Elem())
+        if err := setValue(elem.Elem(), raw); err != nil {
+            return err
+        }
+        v.Set(elem)
+    case reflect.Slice:
+        if v.Type().Elem().Kind() != reflect.String {
+            return fmt.Errorf("unsupported type %s", v.Type())
+        }
+        var items []string
+        for _, item := range strings.Split(raw, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                items = append(items, item)
+            }
+        }
+        v.Set(reflect.ValueOf(items))
+    default:
+        return fmt.Errorf("unsupported type %s", v.Type())
+    }
+    return nil
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "slices"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Each layer overrides the ones before it: defaults, server-issued settings,
+// the file and the environment.
+func TestLoadPrecedence(t *testing.T) {
+    server := []byte("collection_interval: 10s\npush_interval: 1m\nshutdown_timeout: 5s\n")
+    path := filepath.Join(t.TempDir(), "agent.yaml")
+    if err := os.WriteFile(path, []byte("push_interval: 2m\nshutdown_timeout: 6s\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv(EnvPrefix+"SHUTDOWN_TIMEOUT", "7s")
+
+    cfg, err := Load(path, server)
+    if err != nil {
+        t.Fatalf("Load() error = %v", err)
+    }
+    tests := []struct {
+        name      string
+        got, want time.Duration
+    }{
+        {"default", cfg.Watchdog.Interval, Default().Watchdog.Interval},
+        {"server over default", cfg.CollectionInterval, 10 * time.Second},
+        {"file over server", cfg.PushInterval, 2 * time.Minute},
+        {"environment over file", cfg.ShutdownTimeout, 7 * time.Second},
+    }
+    for _, tt := range tests {
+        if tt.got != tt.want {
+            t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+        }
+    }
+}
+
+func TestLoadErrors(t *testing.T) {
+    dir := t.TempDir()
+    invalid := filepath.Join(dir, "invalid.yaml")
+    os.WriteFile(invalid, []byte("push_interval: [\n"), 0600)
+    negative := filepath.Join(dir, "negative.yaml")
+    os.WriteFile(negative, []byte("push_interval: -1s\n"), 0600)
+
+    tests := []struct {
+        name, path string
+        want       string
+    }{
+        {"missing file", filepath.Join(dir, "missing.yaml"), "reading config file"},
+        {"invalid YAML", invalid, "parsing config file"},
+        {"invalid value", negative, "push_interval must be positive"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := Load(tt.path, nil)
+            if err == nil || !strings.Contains(err.Error(), tt.want) {
+                t.Errorf("Load() error = %v, want one containing %q", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestApplyEnv(t *testing.T) {
+    env := map[string]string{
+        "GOAGENT_API_URL":                         "api.example.com",
+        "GOAGENT_API_INSECURE":                    "true",
+        "GOAGENT_API_RETRY_MAX_ATTEMPTS":          "9",
+        "GOAGENT_API_RETRY_JITTER":                "0.5",
+        "GOAGENT_PUSH_INTERVAL":                   "90s",
+        "GOAGENT_LOG_OUTPUTS":                     "stderr, syslog",
+        "GOAGENT_COLLECTORS_PROCESS_ENABLED":      "false",
+        "GOAGENT_COLLECTORS_UNCONFIGURED_ENABLED": "false",
+    }
+    cfg := Default()
+    cfg.Collectors = map[string]CollectorConfig{"process": {}}
+    lookup := func(key string) (string, bool) {
+        v, ok := env[key]
+        return v, ok
+    }
+    if err := applyEnv(reflect.ValueOf(cfg).Elem(), EnvPrefix, lookup); err != nil {
+        t.Fatalf("applyEnv() error = %v", err)
+    }
+
+    if cfg.API.URL != "api.example.com" || !cfg.API.Insecure || cfg.API.Retry.MaxAttempts != 9 || cfg.API.Retry.Jitter != 0.5 {
+        t.Errorf("API settings = %+v", cfg.API)
+    }
+    if cfg.PushInterval != 90*time.Second {
+        t.Errorf("PushInterval = %v, want 1m30s", cfg.PushInterval)
+    }
+    if want := []string{"stderr", "syslog"}; !slices.Equal(cfg.Log.Outputs, want) {
+        t.Errorf("Log.Outputs = %q, want %q", cfg.Log.Outputs, want)
+    }
+    if cfg.Collectors["process"].IsEnabled() {
+        t.Errorf("process collector still enabled")
+    }
+    if _, ok := cfg.Collectors["unconfigured"]; ok {
+        t.Errorf("environment added a collector that is not in the map")
+    }
+
+    env = map[string]string{"GOAGENT_PUSH_INTERVAL": "soon"}
+    if err := applyEnv(reflect.ValueOf(Default()).Elem(), EnvPrefix, lookup); err == nil {
+        t.Errorf("applyEnv() accepted an invalid duration")
+    }
+}
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        name   string
+        change func(c *Config)
+        want   string // Part of the error, empty for none
+    }{
+        {"defaults", func(c *Config) {}, ""},
+        {"zero collection interval", func(c *Config) { c.CollectionInterval = 0 }, "collection_interval"},
+        {"zero cloud timeout", func(c *Config) { c.Identity.CloudTimeout = 0 }, "identity.cloud_timeout"},
+        {"unknown seed", func(c *Config) { c.Identity.Seed = []string{"mac"} }, "identity.seed"},
+        {"no attempts", func(c *Config) { c.API.Retry.MaxAttempts = 0 }, "api.retry.max_attempts"},
+        {"sink jitter", func(c *Config) { c.Graphite.Retry.Jitter = 2 }, "graphite.retry.jitter"},
+        {"unknown compression", func(c *Config) { c.API.Compression = "brotli" }, "api.compression"},
+        {"certificate without key", func(c *Config) { c.API.TLS.CertFile = "agent.pem" }, "api.tls.cert_file"},
+        {"OTLP without endpoint", func(c *Config) { c.OTLP.Enabled, c.OTLP.Endpoint = true, "" }, "otlp.endpoint"},
+        {"file log without path", func(c *Config) { c.Log.Outputs, c.Log.Path = []string{"file"}, "" }, "log.path"},
+        {"unknown log level", func(c *Config) { c.Log.Level = "verbose" }, "log.level"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := Default()
+            tt.change(cfg)
+            err := cfg.Validate()
+            switch {
+            case tt.want == "" && err != nil:
+                t.Errorf("Validate() error = %v", err)
+            case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+                t.Errorf("Validate() error = %v, want one about %s", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestLoadServerSettings(t *testing.T) {
+    server := []byte(`
+collection_interval: 10s
+state_dir: /tmp/elsewhere
+api:
+  url: attacker.example.com
+collectors:
+  process:
+    interval: 1m
+otlp:
+  enabled: true
+  endpoint: http://attacker.example.com/v1/metrics
+  queue_size: 7
+  retry:
+    max_attempts: 2
+file:
+  path: /etc/passwd
+  max_files: 3
+`)
+    cfg, err := Load("", server)
+    if err != nil {
+        t.Fatalf("Load() error = %v", err)
+    }
+
+    def := Default()
+    if cfg.CollectionInterval != 10*time.Second || cfg.Collectors["process"].Interval != time.Minute {
+        t.Errorf("intervals not applied: %v, %v", cfg.CollectionInterval, cfg.Collectors["process"].Interval)
+    }
+    if cfg.OTLP.QueueSize != 7 || cfg.OTLP.Retry.MaxAttempts != 2 || cfg.File.MaxFiles != 3 {
+        t.Errorf("export options not applied: %+v, %+v", cfg.OTLP, cfg.File)
+    }
+    if cfg.StateDir != def.StateDir || cfg.API.URL != def.API.URL || cfg.OTLP.Enabled ||
+        cfg.OTLP.Endpoint != def.OTLP.Endpoint || cfg.File.Path != def.File.Path {
+        t.Errorf("server changed a setting it may not: %+v", cfg)
+    }
+
+    want := []string{"api.url", "file.path", "otlp.enabled", "otlp.endpoint", "state_dir"}
+    if !slices.Equal(cfg.IgnoredServerSettings, want) {
+        t.Errorf("IgnoredServerSettings = %q, want %q", cfg.IgnoredServerSettings, want)
+    }
+}
@@ -0,0 +1,147 @@
+// Package identity keeps the agent's ID stable. The ID is generated once,
+// optionally from the machine ID or the cloud instance ID, and stored in the
+// state directory, so hostname, address and token changes keep the same
+// agent.
+package identity
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const fileName = "identity.json"
+
+// Seeds
+const (
+    SeedMachineID = "machine-id"
+    SeedCloud     = "cloud"
+)
+
+// Sources of an ID
+const (
+    SourceRandom    = "random"
+    SourceMachineID = "machine-id"
+    SourceAWS       = "aws"
+    SourceGCP       = "gcp"
+    SourceAzure     = "azure"
+)
+
+// Options controls how a new ID is created.
+type Options struct {
+    Dir          string        // State directory
+    Seeds        []string      // Tried in order before falling back to a random ID
+    CloudTimeout time.Duration // Limit for the cloud metadata lookup
+    LegacyID     string        // ID used before it was persisted, reported once
+}
+
+// Identity is the agent's persisted ID.
+type Identity struct {
+    ID        string    `json:"id"`
+    Source    string    `json:"source"`
+    CreatedAt time.Time `json:"created_at"`
+
+    // PreviousID is the legacy ID until the backend has been told about it
+    PreviousID string `json:"previous_id,omitempty"`
+
+    path string
+}
+
+// Load reads the identity from the state directory, creating and storing
+// a new one on first start. created reports whether the ID is new.
+func Load(ctx context.Context, opts Options) (id *Identity, created bool, err error) {
+    if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+        return nil, false, fmt.Errorf("creating state directory: %w", err)
+    }
+    path := filepath.Join(opts.Dir, fileName)
+
+    data, err := os.ReadFile(path)
+    if err == nil {
+        id = &Identity{path: path}
+        if err := json.Unmarshal(data, id); err != nil {
+            return nil, false, fmt.Errorf("reading %s: %w", path, err)
+        }
+        if id.ID == "" {
+            return nil, false, fmt.Errorf("reading %s: no agent ID", path)
+        }
+        return id, false, nil
+    }
+    if !errors.Is(err, os.ErrNotExist) {
+        return nil, false, err
+    }
+
+    id = &Identity{
+        CreatedAt:  time.Now().UTC(),
+        PreviousID: opts.LegacyID,
+        path:       path,
+    }
+    id.ID, id.Source, err = newID(ctx, opts)
+    if err != nil {
+        return nil, false, err
+    }
+    if err := id.save(); err != nil {
+        return nil, false, err
+    }
+    return id, true, nil
+}
+
+// newID derives the ID from the first seed that is available, or makes a
+// random one. Seed values are hashed so the ID does not reveal them.
+func newID(ctx context.Context, opts Options) (string, string, error) {
+    for _, seed := range opts.Seeds {
+        var source, value string
+        switch seed {
+        case SeedMachineID:
+            source, value = SourceMachineID, machineID()
+        case SeedCloud:
+            source, value = cloudInstanceID(ctx, opts.CloudTimeout)
+        default:
+            return "", "", fmt.Errorf("unknown identity seed %q", seed)
+        }
+        if value != "" {
+            sum := sha256.Sum256([]byte("go-agent/" + source + "/" + value))
+            return hex.EncodeToString(sum[:]), source, nil
+        }
+    }
+
+    buf := make([]byte, sha256.Size)
+    if _, err := rand.Read(buf); err != nil {
+        return "", "", fmt.Errorf("generating agent ID: %w", err)
+    }
+    return hex.EncodeToString(buf), SourceRandom, nil
+}
+
+// PreviousIDReported forgets the legacy ID once the backend has it.
+func (id *Identity) PreviousIDReported() error {
+    if id.PreviousID == "" {
+        return nil
+    }
+    id.PreviousID = ""
+    return id.save()
+}
+
+func (id *Identity) save() error {
+    data, err := json.MarshalIndent(id, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    // Write to a temporary file first so a crash never leaves a partial file
+    tmp := id.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("writing %s: %w", id.path, err)
+    }
+    if err := os.Rename(tmp, id.path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("writing %s: %w", id.path, err)
+    }
+    return nil
+}
@@ -0,0 +1,93 @@
+package identity
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLoadKeepsTheID(t *testing.T) {
+    dir := t.TempDir()
+    opts := Options{Dir: dir, LegacyID: "legacy"}
+
+    first, created, err := Load(context.Background(), opts)
+    if err != nil || !created {
+        t.Fatalf("first Load() = %v, %v, want a new ID", created, err)
+    }
+    if first.Source != SourceRandom || len(first.ID) != 64 || first.PreviousID != "legacy" {
+        t.Errorf("first Load() = %+v, want a random ID reporting the legacy one", first)
+    }
+
+    // A changed legacy ID, for example after a new token, does not matter
+    opts.LegacyID = "other"
+    second, created, err := Load(context.Background(), opts)
+    if err != nil || created || second.ID != first.ID || second.PreviousID != "legacy" {
+        t.Fatalf("second Load() = %+v, %v, %v, want the stored identity", second, created, err)
+    }
+
+    if err := second.PreviousIDReported(); err != nil {
+        t.Fatalf("PreviousIDReported() error = %v", err)
+    }
+    third, _, err := Load(context.Background(), opts)
+    if err != nil || third.ID != first.ID || third.PreviousID != "" {
+        t.Errorf("Load() after PreviousIDReported() = %+v, %v, want no previous ID", third, err)
+    }
+}
+
+func TestLoadSeeds(t *testing.T) {
+    dir := t.TempDir()
+    machineID := filepath.Join(dir, "machine-id")
+    os.WriteFile(machineID, []byte("0123456789abcdef\n"), 0600)
+    uninitialized := filepath.Join(dir, "uninitialized")
+    os.WriteFile(uninitialized, []byte("uninitialized\n"), 0600)
+
+    tests := []struct {
+        name       string
+        paths      []string
+        seeds      []string
+        wantSource string
+        wantErr    bool
+    }{
+        {"no seeds", []string{machineID}, nil, SourceRandom, false},
+        {"machine ID", []string{machineID}, []string{SeedMachineID}, SourceMachineID, false},
+        {"second path", []string{filepath.Join(dir, "missing"), machineID}, []string{SeedMachineID}, SourceMachineID, false},
+        {"uninitialized machine ID", []string{uninitialized}, []string{SeedMachineID}, SourceRandom, false},
+        {"unknown seed", nil, []string{"mac"}, "", true},
+    }
+    defer func(paths []string) { machineIDPaths = paths }(machineIDPaths)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            machineIDPaths = tt.paths
+            id, _, err := Load(context.Background(), Options{Dir: t.TempDir(), Seeds: tt.seeds})
+            if tt.wantErr {
+                if err == nil {
+                    t.Errorf("Load() succeeded")
+                }
+                return
+            }
+            if err != nil || id.Source != tt.wantSource {
+                t.Fatalf("Load() = %+v, %v, want source %s", id, err, tt.wantSource)
+            }
+            if tt.wantSource == SourceMachineID {
+                // The ID is derived from the machine ID without revealing it
+                again, _, _ := Load(context.Background(), Options{Dir: t.TempDir(), Seeds: tt.seeds})
+                if again.ID != id.ID || id.ID == "0123456789abcdef" {
+                    t.Errorf("machine ID seeded IDs %s and %s", id.ID, again.ID)
+                }
+            }
+        })
+    }
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+    for name, content := range map[string]string{"not JSON": "{", "no ID": `{"source": "random"}`} {
+        t.Run(name, func(t *testing.T) {
+            dir := t.TempDir()
+            os.WriteFile(filepath.Join(dir, fileName), []byte(content), 0600)
+            if _, _, err := Load(context.Background(), Options{Dir: dir}); err == nil {
+                t.Errorf("Load() accepted %q", content)
+            }
+        })
+    }
+}
@@ -0,0 +1,113 @@
+package identity
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// machineIDPaths are read in order; the second is used by older systems
+// without systemd.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// machineID returns the host's machine ID, or "" when there is none.
+func machineID() string {
+    for _, path := range machineIDPaths {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            continue
+        }
+        if id := strings.TrimSpace(string(data)); id != "" && id != "uninitialized" {
+            return id
+        }
+    }
+    return ""
+}
+
+// metadataHost serves the instance metadata of AWS, Google Cloud and Azure.
+const metadataHost = "http://169.254.169.254"
+
+type cloudResult struct {
+    source, id string
+}
+
+// cloudInstanceID asks the metadata services of the supported clouds at
+// the same time and returns the first instance ID found, or "" when the
+// host is not a cloud instance.
+func cloudInstanceID(ctx context.Context, timeout time.Duration) (string, string) {
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    lookups := map[string]func(context.Context) string{
+        SourceAWS:   awsInstanceID,
+        SourceGCP:   gcpInstanceID,
+        SourceAzure: azureInstanceID,
+    }
+    results := make(chan cloudResult, len(lookups))
+    for source, lookup := range lookups {
+        go func() {
+            results <- cloudResult{source, lookup(ctx)}
+        }()
+    }
+
+    for range lookups {
+        if r := <-results; r.id != "" {
+            return r.source, r.id
+        }
+    }
+    return "", ""
+}
+
+// awsInstanceID uses IMDSv2, which needs a session token first.
+func awsInstanceID(ctx context.Context) string {
+    token := metadataGet(ctx, http.MethodPut, metadataHost+"/latest/api/token",
+        "X-aws-ec2-metadata-token-ttl-seconds", "60")
+    if token == "" {
+        return ""
+    }
+    return metadataGet(ctx, http.MethodGet, metadataHost+"/latest/meta-data/instance-id",
+        "X-aws-ec2-metadata-token", token)
+}
+
+func gcpInstanceID(ctx context.Context) string {
+    return metadataGet(ctx, http.MethodGet, metadataHost+"/computeMetadata/v1/instance/id",
+        "Metadata-Flavor", "Google")
+}
+
+func azureInstanceID(ctx context.Context) string {
+    return metadataGet(ctx, http.MethodGet, metadataHost+"/metadata/instance/compute/vmId?api-version=2021-02-01&format=text",
+        "Metadata", "true")
+}
+
+// metadataGet returns the trimmed response body, or "" on any failure.
+func metadataGet(ctx context.Context, method, url, header, value string) string {
+    req, err := http.NewRequestWithContext(ctx, method, url, nil)
+    if err != nil {
+        return ""
+    }
+    req.Header.Set(header, value)
+
+    // Metadata services are link-local, never go through a proxy
+    client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+    resp, err := client.Do(req)
+    if err != nil {
+        return ""
+    }
+    defer resp.Body.Close()
+
+    // Check the response status code
+    if resp.StatusCode != http.StatusOK {
+        return ""
+    }
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,187 @@
+// Package logging builds the agent's structured logger: leveled log/slog
+// records in logfmt or JSON, written to any combination of a rotating file,
+// the standard streams and syslog.
+package logging
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "strings"
+
+    "github.com/dickiesanders/go-agent/internal/redact"
+    "github.com/dickiesanders/go-agent/internal/rotate"
+)
+
+// Log outputs
+const (
+    OutputFile   = "file"
+    OutputStderr = "stderr"
+    OutputStdout = "stdout"
+    OutputSyslog = "syslog"
+)
+
+// Log formats
+const (
+    FormatLogfmt = "logfmt"
+    FormatJSON   = "json"
+)
+
+// LevelTrace is below debug and enables full request payload dumps.
+const LevelTrace = slog.LevelDebug - 4
+
+// Options configures the logger.
+type Options struct {
+    Format  string   // logfmt or json
+    Outputs []string // Any of the Output constants
+    Path    string   // Log file for OutputFile
+    Rotate  rotate.Options
+    Syslog  SyslogOptions
+
+    // Redactor, if set, masks secrets and sensitive fields in every record
+    Redactor *redact.Redactor
+}
+
+// SyslogOptions selects the syslog daemon. An empty network and address use
+// the local daemon.
+type SyslogOptions struct {
+    Network string
+    Address string
+    Tag     string
+}
+
+// ParseLevel parses trace, debug, info, warn or error, in any case.
+func ParseLevel(s string) (slog.Level, error) {
+    if strings.EqualFold(s, "trace") {
+        return LevelTrace, nil
+    }
+    var level slog.Level
+    err := level.UnmarshalText([]byte(s))
+    return level, err
+}
+
+// New returns a logger writing every record at or above level to all
+// outputs. The level is consulted on every record, so a *slog.LevelVar can
+// change it at runtime. The returned closer releases the outputs.
+func New(opts Options, level slog.Leveler) (*slog.Logger, io.Closer, error) {
+    var handlers multiHandler
+    var closers closers
+
+    for _, output := range opts.Outputs {
+        switch strings.ToLower(output) {
+        case OutputFile:
+            w, err := rotate.Open(opts.Path, opts.Rotate)
+            if err != nil {
+                closers.Close()
+                return nil, nil, fmt.Errorf("opening log file: %w", err)
+            }
+            closers = append(closers, w)
+            handlers = append(handlers, newHandler(w, opts, level, false))
+        case OutputStderr:
+            handlers = append(handlers, newHandler(os.Stderr, opts, level, false))
+        case OutputStdout:
+            handlers = append(handlers, newHandler(os.Stdout, opts, level, false))
+        case OutputSyslog:
+            h, c, err := newSyslogHandler(opts, level)
+            if err != nil {
+                closers.Close()
+                return nil, nil, fmt.Errorf("connecting to syslog: %w", err)
+            }
+            closers = append(closers, c)
+            handlers = append(handlers, h)
+        default:
+            closers.Close()
+            return nil, nil, fmt.Errorf("unknown log output %q", output)
+        }
+    }
+
+    if len(handlers) == 1 {
+        return slog.New(handlers[0]), closers, nil
+    }
+    return slog.New(handlers), closers, nil
+}
+
+// newHandler formats records for w. Syslog adds its own timestamp, so the
+// record time can be left out.
+func newHandler(w io.Writer, opts Options, level slog.Leveler, omitTime bool) slog.Handler {
+    replace := func(groups []string, a slog.Attr) slog.Attr {
+        if len(groups) == 0 {
+            switch a.Key {
+            case slog.TimeKey:
+                if omitTime {
+                    return slog.Attr{}
+                }
+                return a
+            case slog.LevelKey:
+                if a.Value.Any() == LevelTrace {
+                    return slog.String(a.Key, "TRACE")
+                }
+                return a
+            case slog.MessageKey:
+                return a
+            }
+        }
+        if opts.Redactor != nil {
+            return opts.Redactor.ReplaceAttr(groups, a)
+        }
+        return a
+    }
+
+    handlerOpts := &slog.HandlerOptions{Level: level, ReplaceAttr: replace}
+    if strings.EqualFold(opts.Format, FormatJSON) {
+        return slog.NewJSONHandler(w, handlerOpts)
+    }
+    return slog.NewTextHandler(w, handlerOpts)
+}
+
+// multiHandler passes every record to several handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    for _, h := range m {
+        if h.Enabled(ctx, level) {
+            return true
+        }
+    }
+    return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+    var errs []error
+    for _, h := range m {
+        if h.Enabled(ctx, r.Level) {
+            errs = append(errs, h.Handle(ctx, r.Clone()))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    out := make(multiHandler, len(m))
+    for i, h := range m {
+        out[i] = h.WithAttrs(attrs)
+    }
+    return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+    out := make(multiHandler, len(m))
+    for i, h := range m {
+        out[i] = h.WithGroup(name)
+    }
+    return out
+}
+
+// closers closes several outputs.
+type closers []io.Closer
+
+func (c closers) Close() error {
+    var errs []error
+    for _, closer := range c {
+        errs = append(errs, closer.Close())
+    }
+    return errors.Join(errs...)
+}
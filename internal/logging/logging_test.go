@@ -0,0 +1,93 @@
+package logging
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/dickiesanders/go-agent/internal/redact"
+)
+
+func TestParseLevel(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    slog.Level
+        wantErr bool
+    }{
+        {"trace", LevelTrace, false},
+        {"TRACE", LevelTrace, false},
+        {"debug", slog.LevelDebug, false},
+        {"Info", slog.LevelInfo, false},
+        {"warn", slog.LevelWarn, false},
+        {"error", slog.LevelError, false},
+        {"verbose", 0, true},
+    }
+    for _, tt := range tests {
+        got, err := ParseLevel(tt.in)
+        if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+            t.Errorf("ParseLevel(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestNewFileOutput(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "agent.log")
+    level := new(slog.LevelVar)
+    logger, closer, err := New(Options{
+        Format:   FormatJSON,
+        Outputs:  []string{OutputFile},
+        Path:     path,
+        Redactor: redact.New([]string{"hostname"}),
+    }, level)
+    if err != nil {
+        t.Fatalf("New() error = %v", err)
+    }
+
+    logger.Debug("Hidden at info")
+    level.Set(LevelTrace)
+    logger.Log(context.Background(), LevelTrace, "Request payload", "token", "abc", "hostname", "web-1", "port", 80)
+    closer.Close()
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+    if len(lines) != 1 {
+        t.Fatalf("got %d records, want 1:\n%s", len(lines), data)
+    }
+    var record map[string]any
+    if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+        t.Fatalf("record is not JSON: %v", err)
+    }
+    want := map[string]any{"level": "TRACE", "msg": "Request payload", "token": redact.Mask, "hostname": redact.Mask, "port": 80.0}
+    for key, value := range want {
+        if record[key] != value {
+            t.Errorf("%s = %v, want %v", key, record[key], value)
+        }
+    }
+    if _, ok := record["time"]; !ok {
+        t.Errorf("record has no time")
+    }
+}
+
+func TestNewErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        opts Options
+    }{
+        {"unknown output", Options{Outputs: []string{"kafka"}}},
+        {"file in a missing directory", Options{Outputs: []string{OutputFile}, Path: "/dev/null/agent.log"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, _, err := New(tt.opts, slog.LevelInfo); err == nil {
+                t.Errorf("New() succeeded")
+            }
+        })
+    }
+}
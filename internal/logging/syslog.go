@@ -0,0 +1,76 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "log/syslog"
+    "strings"
+    "sync"
+)
+
+// newSyslogHandler connects to the syslog daemon. Records are sent with the
+// syslog severity matching their level.
+func newSyslogHandler(opts Options, level slog.Leveler) (slog.Handler, io.Closer, error) {
+    w, err := syslog.Dial(opts.Syslog.Network, opts.Syslog.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, opts.Syslog.Tag)
+    if err != nil {
+        return nil, nil, err
+    }
+    out := &syslogWriter{w: w}
+    return &syslogHandler{inner: newHandler(out, opts, level, true), out: out}, w, nil
+}
+
+// syslogWriter sends each formatted record with the severity of the record
+// being handled.
+type syslogWriter struct {
+    mu    sync.Mutex // Held while a record is formatted and sent
+    w     *syslog.Writer
+    level slog.Level
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+    msg := strings.TrimSuffix(string(p), "\n")
+
+    var err error
+    switch {
+    case s.level >= slog.LevelError:
+        err = s.w.Err(msg)
+    case s.level >= slog.LevelWarn:
+        err = s.w.Warning(msg)
+    case s.level >= slog.LevelInfo:
+        err = s.w.Info(msg)
+    default:
+        err = s.w.Debug(msg)
+    }
+    if err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+type syslogHandler struct {
+    inner slog.Handler
+    out   *syslogWriter
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+    h.out.mu.Lock()
+    defer h.out.mu.Unlock()
+    h.out.level = r.Level
+    return h.inner.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return &syslogHandler{inner: h.inner.WithAttrs(attrs), out: h.out}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+    return &syslogHandler{inner: h.inner.WithGroup(name), out: h.out}
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logging
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "runtime"
+)
+
+func newSyslogHandler(opts Options, level slog.Leveler) (slog.Handler, io.Closer, error) {
+    return nil, nil, fmt.Errorf("syslog is not available on %s", runtime.GOOS)
+}
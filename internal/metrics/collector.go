@@ -0,0 +1,270 @@
+package metrics
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// MetricsData holds one sample of collected metrics. Each collector fills in
+// its own section of the struct.
+type MetricsData struct {
+    CPUPercent    float64               `json:"cpu_percent"`
+    CPU           *CPUStats             `json:"cpu,omitempty"`
+    Memory        *MemoryInfo           `json:"memory,omitempty"`
+    Pressure      *Pressure             `json:"pressure,omitempty"` // Linux only
+    ProcessInfo   []ProcessInfo         `json:"process_info"`
+    NetworkStats  []NetworkStat         `json:"network_stats"`
+    ConnStats     []ConnectionStat      `json:"conn_stats"`
+    DiskIOStats   map[string]DiskIOStat `json:"disk_io_stats"`
+    DiskUsageInfo []DiskUsageInfo       `json:"disk_usage_stats"`
+    CustomMetrics []CustomMetric        `json:"custom_metrics,omitempty"`
+    Timestamp     time.Time             `json:"timestamp"`
+    UniqueID      string                `json:"unique_id"`
+}
+
+// Merge fills the sections of d that no collector filled in with those of
+// prev, so that exporters serving current values keep the series of
+// collectors that were not due. Custom metrics are aggregates of one
+// interval and are not carried over.
+func (d *MetricsData) Merge(prev *MetricsData) {
+    if prev == nil {
+        return
+    }
+    if d.CPU == nil && prev.CPU != nil {
+        d.CPU, d.CPUPercent = prev.CPU, prev.CPUPercent
+    }
+    if d.Memory == nil {
+        d.Memory = prev.Memory
+    }
+    if d.Pressure == nil {
+        d.Pressure = prev.Pressure
+    }
+    if d.ProcessInfo == nil {
+        d.ProcessInfo = prev.ProcessInfo
+    }
+    if d.NetworkStats == nil && d.ConnStats == nil {
+        d.NetworkStats, d.ConnStats = prev.NetworkStats, prev.ConnStats
+    }
+    if d.DiskIOStats == nil {
+        d.DiskIOStats = prev.DiskIOStats
+    }
+    if d.DiskUsageInfo == nil {
+        d.DiskUsageInfo = prev.DiskUsageInfo
+    }
+}
+
+// CustomMetric is a metric pushed to the agent by a local application,
+// aggregated over one flush interval.
+type CustomMetric struct {
+    Name string            `json:"name"`
+    Type string            `json:"type"` // counter, gauge, timer, histogram, distribution or set
+    Tags map[string]string `json:"tags,omitempty"`
+    // Value is the counter total, the gauge value or the number of unique
+    // set members. Timers, histograms and distributions use Stats instead.
+    Value float64            `json:"value"`
+    Stats *DistributionStats `json:"stats,omitempty"`
+}
+
+// DistributionStats summarizes the values of a timer, histogram or
+// distribution received during one flush interval.
+type DistributionStats struct {
+    Count  float64 `json:"count"` // Corrected for the sample rate
+    Sum    float64 `json:"sum"`
+    Min    float64 `json:"min"`
+    Max    float64 `json:"max"`
+    Mean   float64 `json:"mean"`
+    Median float64 `json:"median"`
+    P90    float64 `json:"p90"`
+    P95    float64 `json:"p95"`
+    P99    float64 `json:"p99"`
+}
+
+// Collector gathers one group of metrics into a MetricsData sample.
+type Collector interface {
+    // Name identifies the collector in the registry and in configuration.
+    Name() string
+    // Interval is how often the collector should run. Zero means on every
+    // collection tick.
+    Interval() time.Duration
+    // Collect fills in the collector's section of data.
+    Collect(ctx context.Context, data *MetricsData) error
+}
+
+type registration struct {
+    collector Collector
+    enabled   bool
+    interval  time.Duration // Overrides the collector's own interval when set
+    lastRun   time.Time
+}
+
+func (reg *registration) due(now time.Time) bool {
+    interval := reg.interval
+    if interval == 0 {
+        interval = reg.collector.Interval()
+    }
+    return interval <= 0 || reg.lastRun.IsZero() || now.Sub(reg.lastRun) >= interval
+}
+
+// Registry keeps the set of collectors and runs the ones that are due.
+type Registry struct {
+    mu         sync.Mutex
+    collectors []*registration
+    byName     map[string]*registration
+}
+
+// NewRegistry returns an empty collector registry.
+func NewRegistry() *Registry {
+    return &Registry{byName: make(map[string]*registration)}
+}
+
+// NewDefaultRegistry returns a registry with all built-in collectors enabled,
+// logging to logger. New collectors only need to be added here to be picked
+// up by the agent.
+func NewDefaultRegistry(logger *slog.Logger) *Registry {
+    r := NewRegistry()
+    for _, c := range []Collector{
+        &BasicCollector{Logger: logger},
+        &ProcessCollector{Logger: logger},
+        &NetworkCollector{Logger: logger},
+        &DiskIOCollector{Logger: logger},
+        &DiskUsageCollector{Logger: logger},
+    } {
+        // Built-in names are unique, so this cannot fail
+        _ = r.Register(c)
+    }
+    return r
+}
+
+// Register adds an enabled collector to the registry.
+func (r *Registry) Register(c Collector) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if _, ok := r.byName[c.Name()]; ok {
+        return fmt.Errorf("collector %q already registered", c.Name())
+    }
+    reg := &registration{collector: c, enabled: true}
+    r.collectors = append(r.collectors, reg)
+    r.byName[c.Name()] = reg
+    return nil
+}
+
+// SetEnabled turns a registered collector on or off.
+func (r *Registry) SetEnabled(name string, enabled bool) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    reg, ok := r.byName[name]
+    if !ok {
+        return fmt.Errorf("unknown collector %q", name)
+    }
+    reg.enabled = enabled
+    return nil
+}
+
+// SetInterval overrides how often a registered collector runs. Zero restores
+// the collector's own interval.
+func (r *Registry) SetInterval(name string, interval time.Duration) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    reg, ok := r.byName[name]
+    if !ok {
+        return fmt.Errorf("unknown collector %q", name)
+    }
+    reg.interval = interval
+    return nil
+}
+
+// excluder is implemented by collectors that can skip devices by name.
+type excluder interface {
+    SetExclude(patterns []string) error
+}
+
+// SetExclude sets the device name patterns a registered collector skips. nil
+// restores the collector's defaults.
+func (r *Registry) SetExclude(name string, patterns []string) error {
+    r.mu.Lock()
+    reg, ok := r.byName[name]
+    r.mu.Unlock()
+    if !ok {
+        return fmt.Errorf("unknown collector %q", name)
+    }
+
+    e, ok := reg.collector.(excluder)
+    if !ok {
+        if patterns == nil {
+            return nil
+        }
+        return fmt.Errorf("collector %q does not support exclude", name)
+    }
+    return e.SetExclude(patterns)
+}
+
+// fieldSetter is implemented by collectors with optional fields.
+type fieldSetter interface {
+    SetFields(names []string) error
+}
+
+// SetFields enables optional fields of a registered collector. nil disables
+// them all.
+func (r *Registry) SetFields(name string, fields []string) error {
+    r.mu.Lock()
+    reg, ok := r.byName[name]
+    r.mu.Unlock()
+    if !ok {
+        return fmt.Errorf("unknown collector %q", name)
+    }
+
+    f, ok := reg.collector.(fieldSetter)
+    if !ok {
+        if len(fields) == 0 {
+            return nil
+        }
+        return fmt.Errorf("collector %q has no optional fields", name)
+    }
+    return f.SetFields(fields)
+}
+
+// Names returns the names of all registered collectors in registration order.
+func (r *Registry) Names() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    names := make([]string, 0, len(r.collectors))
+    for _, reg := range r.collectors {
+        names = append(names, reg.collector.Name())
+    }
+    return names
+}
+
+// Collect runs every enabled collector whose interval has elapsed at now and
+// returns the combined errors. A failing collector does not stop the others.
+func (r *Registry) Collect(ctx context.Context, now time.Time, data *MetricsData) error {
+    r.mu.Lock()
+    var due []*registration
+    for _, reg := range r.collectors {
+        if !reg.enabled || !reg.due(now) {
+            continue
+        }
+        reg.lastRun = now
+        due = append(due, reg)
+    }
+    r.mu.Unlock()
+
+    var errs []error
+    for _, reg := range due {
+        if err := ctx.Err(); err != nil {
+            errs = append(errs, err)
+            break
+        }
+        if err := reg.collector.Collect(ctx, data); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", reg.collector.Name(), err))
+        }
+    }
+    return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMerge(t *testing.T) {
+    prev := &MetricsData{
+        CPUPercent:    12,
+        CPU:           &CPUStats{},
+        Memory:        &MemoryInfo{Total: 1},
+        ProcessInfo:   []ProcessInfo{{PID: 1}},
+        NetworkStats:  []NetworkStat{{Name: "eth0"}},
+        ConnStats:     []ConnectionStat{},
+        DiskIOStats:   map[string]DiskIOStat{"sda": {}},
+        DiskUsageInfo: []DiskUsageInfo{{Mountpoint: "/"}},
+        CustomMetrics: []CustomMetric{{Name: "hits"}},
+    }
+
+    // Only the network collector ran
+    d := MetricsData{NetworkStats: []NetworkStat{{Name: "eth1"}}}
+    d.Merge(prev)
+
+    if d.CPU != prev.CPU || d.CPUPercent != 12 || d.Memory != prev.Memory {
+        t.Errorf("basic section not carried over: %+v", d)
+    }
+    if len(d.ProcessInfo) != 1 || len(d.DiskIOStats) != 1 || len(d.DiskUsageInfo) != 1 {
+        t.Errorf("process or disk sections not carried over: %+v", d)
+    }
+    if d.NetworkStats[0].Name != "eth1" || d.ConnStats != nil {
+        t.Errorf("network section mixed with the previous one: %+v, %+v", d.NetworkStats, d.ConnStats)
+    }
+    if d.CustomMetrics != nil {
+        t.Errorf("custom metrics carried over: %+v", d.CustomMetrics)
+    }
+
+    // Nothing to merge from
+    empty := MetricsData{}
+    empty.Merge(nil)
+    if empty.CPU != nil {
+        t.Errorf("Merge(nil) filled in sections")
+    }
+}
+
+type countingCollector struct {
+    name     string
+    interval time.Duration
+    runs     int
+}
+
+func (c *countingCollector) Name() string            { return c.name }
+func (c *countingCollector) Interval() time.Duration { return c.interval }
+func (c *countingCollector) Collect(ctx context.Context, data *MetricsData) error {
+    c.runs++
+    return nil
+}
+
+func TestRegistryCollectDue(t *testing.T) {
+    every := &countingCollector{name: "every"}
+    slow := &countingCollector{name: "slow", interval: time.Minute}
+    off := &countingCollector{name: "off"}
+
+    r := NewRegistry()
+    for _, c := range []Collector{every, slow, off} {
+        if err := r.Register(c); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := r.Register(&countingCollector{name: "every"}); err == nil {
+        t.Errorf("registering a duplicate name succeeded")
+    }
+    r.SetEnabled("off", false)
+
+    start := time.Now()
+    for i := 0; i < 4; i++ {
+        r.Collect(context.Background(), start.Add(time.Duration(i)*30*time.Second), &MetricsData{})
+    }
+    if every.runs != 4 || slow.runs != 2 || off.runs != 0 {
+        t.Errorf("runs = %d, %d, %d, want 4, 2, 0", every.runs, slow.runs, off.runs)
+    }
+
+    // An override replaces the collector's own interval
+    r.SetInterval("slow", 30*time.Second)
+    r.Collect(context.Background(), start.Add(2*time.Minute), &MetricsData{})
+    if slow.runs != 3 {
+        t.Errorf("slow ran %d times after the override, want 3", slow.runs)
+    }
+}
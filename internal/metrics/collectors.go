@@ -0,0 +1,358 @@
+package metrics
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "math"
+    "path"
+    "sync"
+    "time"
+
+    "github.com/shirou/gopsutil/cpu"
+    "github.com/shirou/gopsutil/disk"
+)
+
+// BasicCollector gathers the CPU time breakdown, memory and swap usage, and
+// pressure stall information. CPU percentages and rates are computed since
+// the previous run; the first run reports the averages since boot.
+type BasicCollector struct {
+    Every  time.Duration
+    Logger *slog.Logger
+
+    // Counters of the previous run
+    prevCPU    *CPUCounters
+    prevMemory *MemoryInfo
+    prevTime   time.Time
+}
+
+func (c *BasicCollector) Name() string            { return "basic" }
+func (c *BasicCollector) Interval() time.Duration { return c.Every }
+
+func (c *BasicCollector) Collect(ctx context.Context, data *MetricsData) error {
+    now := time.Now()
+    cpuCounters, memoryInfo, err := GatherBasicMetrics(c.Logger)
+    if err != nil {
+        return err
+    }
+
+    cpuStats := cpuStats(c.prevCPU, cpuCounters, now.Sub(c.prevTime))
+    if c.prevMemory != nil {
+        r := newRateCounter(now.Sub(c.prevTime))
+        rates := &SwapRates{
+            InPerSec:  r.rate(c.prevMemory.SwapIn, memoryInfo.SwapIn),
+            OutPerSec: r.rate(c.prevMemory.SwapOut, memoryInfo.SwapOut),
+        }
+        if r.ok {
+            memoryInfo.SwapRates = rates
+        }
+    }
+    c.prevCPU, c.prevMemory, c.prevTime = cpuCounters, memoryInfo, now
+
+    data.CPUPercent = cpuStats.Total.Usage
+    data.CPU = cpuStats
+    data.Memory = memoryInfo
+    data.Pressure = GatherPressure(c.Logger)
+    return nil
+}
+
+// ProcessCollector gathers per-process CPU and memory usage, and the
+// optional fields that are enabled.
+type ProcessCollector struct {
+    Every  time.Duration
+    Logger *slog.Logger
+
+    mu     sync.Mutex
+    fields ProcessFieldSet
+}
+
+func (c *ProcessCollector) Name() string            { return "process" }
+func (c *ProcessCollector) Interval() time.Duration { return c.Every }
+
+func (c *ProcessCollector) Collect(ctx context.Context, data *MetricsData) error {
+    c.mu.Lock()
+    fields := c.fields
+    c.mu.Unlock()
+
+    processInfo, err := GatherProcessMetrics(c.Logger, fields)
+    if err != nil {
+        return err
+    }
+    data.ProcessInfo = processInfo
+    return nil
+}
+
+// SetFields enables the optional fields named, see ProcessFields.
+func (c *ProcessCollector) SetFields(names []string) error {
+    fields, err := ParseProcessFields(names)
+    if err != nil {
+        return err
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.fields = fields
+    return nil
+}
+
+// NetworkCollector gathers per-interface network counters with their rates
+// since the previous run, and active connections.
+type NetworkCollector struct {
+    Every  time.Duration
+    Logger *slog.Logger
+
+    // Counters of the previous run by interface
+    prev     map[string]NetworkStat
+    prevTime time.Time
+}
+
+func (c *NetworkCollector) Name() string            { return "network" }
+func (c *NetworkCollector) Interval() time.Duration { return c.Every }
+
+func (c *NetworkCollector) Collect(ctx context.Context, data *MetricsData) error {
+    // The counters are read first, so this is close to their read time
+    now := time.Now()
+    netStats, connStats, err := GatherNetworkMetrics(c.Logger)
+    if err != nil {
+        return err
+    }
+
+    prev := make(map[string]NetworkStat, len(netStats))
+    for i, cur := range netStats {
+        if last, ok := c.prev[cur.Name]; ok {
+            netStats[i].Rates = networkRates(last, cur, now.Sub(c.prevTime))
+        }
+        prev[cur.Name] = cur
+    }
+    c.prev, c.prevTime = prev, now
+
+    // Non-nil even without connections, nil means not collected
+    if connStats == nil {
+        connStats = []ConnectionStat{}
+    }
+    data.NetworkStats = netStats
+    data.ConnStats = connStats
+    return nil
+}
+
+// DefaultDiskExclude are the device name patterns the disk IO collector
+// skips unless configured otherwise: partitions, loop devices and RAM disks,
+// so that only whole devices are reported.
+var DefaultDiskExclude = []string{"loop*", "ram*", "zram*", "sd*[0-9]", "hd*[0-9]", "vd*[0-9]", "xvd*[0-9]", "nvme*p[0-9]*", "mmcblk*p[0-9]*"}
+
+// DiskIOCollector gathers per-device disk IO counters and, like iostat -x,
+// the rates, latencies and utilization since the previous run.
+type DiskIOCollector struct {
+    Every  time.Duration
+    Logger *slog.Logger
+
+    mu       sync.Mutex
+    exclude  []string // Patterns as in path.Match, nil means DefaultDiskExclude
+    prev     map[string]disk.IOCountersStat
+    prevTime time.Time
+}
+
+func (c *DiskIOCollector) Name() string            { return "diskio" }
+func (c *DiskIOCollector) Interval() time.Duration { return c.Every }
+
+func (c *DiskIOCollector) Collect(ctx context.Context, data *MetricsData) error {
+    now := time.Now()
+    ioCounters, err := GatherDiskIOInfo(c.Logger)
+    if err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    diskIOStats := make(map[string]DiskIOStat, len(ioCounters))
+    prev := make(map[string]disk.IOCountersStat, len(ioCounters))
+    for name, cur := range ioCounters {
+        if c.excluded(name) {
+            continue
+        }
+        stat := DiskIOStat{IOCountersStat: cur}
+        if last, ok := c.prev[name]; ok {
+            stat.Stats = diskIORates(last, cur, now.Sub(c.prevTime))
+        }
+        diskIOStats[name] = stat
+        prev[name] = cur
+    }
+    c.prev, c.prevTime = prev, now
+
+    data.DiskIOStats = diskIOStats
+    return nil
+}
+
+// DiskUsageCollector gathers size and usage for every mounted partition.
+type DiskUsageCollector struct {
+    Every  time.Duration
+    Logger *slog.Logger
+}
+
+func (c *DiskUsageCollector) Name() string            { return "diskusage" }
+func (c *DiskUsageCollector) Interval() time.Duration { return c.Every }
+
+func (c *DiskUsageCollector) Collect(ctx context.Context, data *MetricsData) error {
+    diskUsageInfo, err := GatherDiskUsage(c.Logger)
+    if err != nil {
+        return err
+    }
+    data.DiskUsageInfo = diskUsageInfo
+    return nil
+}
+
+// networkRates computes the rates of an interface between two samples, nil
+// if its counters were reset in between.
+func networkRates(prev, cur NetworkStat, elapsed time.Duration) *NetworkRates {
+    r := newRateCounter(elapsed)
+    rates := &NetworkRates{
+        BytesSent:   r.rate(prev.BytesSent, cur.BytesSent),
+        BytesRecv:   r.rate(prev.BytesRecv, cur.BytesRecv),
+        PacketsSent: r.rate(prev.PacketsSent, cur.PacketsSent),
+        PacketsRecv: r.rate(prev.PacketsRecv, cur.PacketsRecv),
+    }
+    if !r.ok {
+        return nil
+    }
+    return rates
+}
+
+// SetExclude sets the device name patterns to skip, in path.Match syntax.
+// nil restores DefaultDiskExclude.
+func (c *DiskIOCollector) SetExclude(patterns []string) error {
+    for _, pattern := range patterns {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return fmt.Errorf("invalid device pattern %q", pattern)
+        }
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.exclude = patterns
+    return nil
+}
+
+// excluded reports whether a device is skipped.
+func (c *DiskIOCollector) excluded(device string) bool {
+    patterns := c.exclude
+    if patterns == nil {
+        patterns = DefaultDiskExclude
+    }
+    for _, pattern := range patterns {
+        if ok, _ := path.Match(pattern, device); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// diskIORates derives the statistics of a device between two samples, nil
+// if its counters were reset in between.
+func diskIORates(prev, cur disk.IOCountersStat, elapsed time.Duration) *DiskIORates {
+    r := newRateCounter(elapsed)
+    reads := r.delta(prev.ReadCount, cur.ReadCount)
+    writes := r.delta(prev.WriteCount, cur.WriteCount)
+    readTime := r.delta(prev.ReadTime, cur.ReadTime)
+    writeTime := r.delta(prev.WriteTime, cur.WriteTime)
+    ioTime := r.delta(prev.IoTime, cur.IoTime)
+    weightedIO := r.delta(prev.WeightedIO, cur.WeightedIO)
+
+    rates := &DiskIORates{
+        ReadsPerSec:        r.perSecond(reads),
+        WritesPerSec:       r.perSecond(writes),
+        MergedReadsPerSec:  r.rate(prev.MergedReadCount, cur.MergedReadCount),
+        MergedWritesPerSec: r.rate(prev.MergedWriteCount, cur.MergedWriteCount),
+        ReadBytesPerSec:    r.rate(prev.ReadBytes, cur.ReadBytes),
+        WriteBytesPerSec:   r.rate(prev.WriteBytes, cur.WriteBytes),
+        ReadAwait:          average(readTime, reads),
+        WriteAwait:         average(writeTime, writes),
+        Await:              average(readTime+writeTime, reads+writes),
+        ServiceTime:        average(ioTime, reads+writes),
+    }
+    if !r.ok {
+        return nil
+    }
+    rates.QueueDepth = float64(weightedIO) / r.millis()
+    // The busy time can run slightly ahead of the wall clock
+    rates.UtilPercent = math.Min(100, float64(ioTime)/r.millis()*100)
+    return rates
+}
+
+// average divides total by count, 0 when nothing was counted.
+func average(total, count uint64) float64 {
+    if count == 0 {
+        return 0
+    }
+    return float64(total) / float64(count)
+}
+
+// cpuStats computes the CPU statistics between two samples. Without a
+// previous sample the percentages are the averages since boot.
+func cpuStats(prev, cur *CPUCounters, elapsed time.Duration) *CPUStats {
+    stats := &CPUStats{
+        Load1:           cur.Load.Load1,
+        Load5:           cur.Load.Load5,
+        Load15:          cur.Load.Load15,
+        ContextSwitches: cur.ContextSwitches,
+        Interrupts:      cur.Interrupts,
+        ProcsRunning:    cur.ProcsRunning,
+        ProcsBlocked:    cur.ProcsBlocked,
+    }
+    if prev == nil {
+        prev = &CPUCounters{}
+    } else {
+        r := newRateCounter(elapsed)
+        rates := &CPURates{
+            ContextSwitchesPerSec: r.rate(prev.ContextSwitches, cur.ContextSwitches),
+            InterruptsPerSec:      r.rate(prev.Interrupts, cur.Interrupts),
+        }
+        if r.ok {
+            stats.Rates = rates
+        }
+    }
+
+    stats.Total = cpuTimes(prev.Total, cur.Total)
+    prevCores := make(map[string]cpu.TimesStat, len(prev.Cores))
+    for _, core := range prev.Cores {
+        prevCores[core.CPU] = core
+    }
+    for _, core := range cur.Cores {
+        // A core that just came online is compared to zero, like on boot
+        stats.Cores = append(stats.Cores, cpuTimes(prevCores[core.CPU], core))
+    }
+    return stats
+}
+
+// cpuTimes computes the share of time in each state between two samples of
+// a CPU, in percent.
+func cpuTimes(prev, cur cpu.TimesStat) CPUTimes {
+    // Times only go down when a core was reset, count those as no time
+    delta := func(prev, cur float64) float64 { return math.Max(0, cur-prev) }
+    user := delta(prev.User, cur.User)
+    nice := delta(prev.Nice, cur.Nice)
+    system := delta(prev.System, cur.System)
+    idle := delta(prev.Idle, cur.Idle)
+    iowait := delta(prev.Iowait, cur.Iowait)
+    irq := delta(prev.Irq, cur.Irq)
+    softirq := delta(prev.Softirq, cur.Softirq)
+    steal := delta(prev.Steal, cur.Steal)
+
+    // Guest time is already part of user and nice time
+    total := user + nice + system + idle + iowait + irq + softirq + steal
+    times := CPUTimes{CPU: cur.CPU}
+    if total == 0 {
+        return times
+    }
+    percent := func(v float64) float64 { return v / total * 100 }
+    times.User = percent(user)
+    times.Nice = percent(nice)
+    times.System = percent(system)
+    times.Idle = percent(idle)
+    times.Iowait = percent(iowait)
+    times.Irq = percent(irq)
+    times.Softirq = percent(softirq)
+    times.Steal = percent(steal)
+    times.Guest = percent(delta(prev.Guest, cur.Guest))
+    times.GuestNice = percent(delta(prev.GuestNice, cur.GuestNice))
+    times.Usage = 100 - times.Idle - times.Iowait
+    return times
+}
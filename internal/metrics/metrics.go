@@ -4,21 +4,44 @@ package metrics
 
 import (
     "fmt" // Import fmt to fix the undefined error
-    "log"
+    "log/slog"
+    "sort"
 
     "github.com/klauspost/cpuid/v2"     // For CPU information
     "github.com/shirou/gopsutil/cpu"    // Keep for CPU percentage collection
     "github.com/shirou/gopsutil/disk"
     "github.com/shirou/gopsutil/host"
+    "github.com/shirou/gopsutil/load"
     "github.com/shirou/gopsutil/mem"
     "github.com/shirou/gopsutil/net"
     "github.com/shirou/gopsutil/process"
 )
 
+// NetworkStat holds the cumulative counters of one network interface.
 type NetworkStat struct {
-    Name       string
-    BytesSent  uint64
-    BytesRecv  uint64
+    Name        string
+    BytesSent   uint64
+    BytesRecv   uint64
+    PacketsSent uint64
+    PacketsRecv uint64
+    ErrIn       uint64
+    ErrOut      uint64
+    DropIn      uint64
+    DropOut     uint64
+    FifoIn      uint64 // FIFO buffer overruns
+    FifoOut     uint64
+
+    // Rates since the previous sample, missing on the first sample of an
+    // interface and after its counters were reset
+    Rates *NetworkRates `json:",omitempty"`
+}
+
+// NetworkRates holds per-second rates of an interface's counters.
+type NetworkRates struct {
+    BytesSent   float64
+    BytesRecv   float64
+    PacketsSent float64
+    PacketsRecv float64
 }
 
 type ConnectionStat struct {
@@ -44,6 +67,143 @@ type ProcessInfo struct {
     Name        string
     CPUPercent  float64
     MemoryUsage uint64
+
+    // Optional fields, only filled in when enabled, see ProcessFields
+    Cmdline     string              `json:",omitempty"` // Arguments with secrets masked
+    Username    string              `json:",omitempty"`
+    Status      string              `json:",omitempty"` // State letter as shown by ps, e.g. R or S
+    PPID        int32               `json:",omitempty"`
+    CreateTime  int64               `json:",omitempty"` // Unix milliseconds
+    Threads     int32               `json:",omitempty"`
+    FDs         int32               `json:",omitempty"` // Open file descriptors, handles on Windows
+    IO          *ProcessIO          `json:",omitempty"`
+    CtxSwitches *ProcessCtxSwitches `json:",omitempty"`
+    VMS         uint64              `json:",omitempty"` // Virtual memory size
+    Swap        uint64              `json:",omitempty"` // Swapped out memory, Linux only
+}
+
+// ProcessIO holds the IO a process did since it started.
+type ProcessIO struct {
+    ReadCount  uint64
+    WriteCount uint64
+    ReadBytes  uint64
+    WriteBytes uint64
+}
+
+// ProcessCtxSwitches holds the context switches of a process since it started.
+type ProcessCtxSwitches struct {
+    Voluntary   int64
+    Involuntary int64
+}
+
+// DiskIOStat holds the cumulative counters of one disk device.
+type DiskIOStat struct {
+    disk.IOCountersStat
+
+    // Statistics since the previous sample, missing on the first sample of a
+    // device and after its counters were reset
+    Stats *DiskIORates `json:"stats,omitempty"`
+}
+
+// DiskIORates holds the statistics of a disk device over one interval, as
+// reported by iostat -x. Times are in milliseconds.
+type DiskIORates struct {
+    ReadsPerSec        float64 `json:"readsPerSec"`        // r/s
+    WritesPerSec       float64 `json:"writesPerSec"`       // w/s
+    MergedReadsPerSec  float64 `json:"mergedReadsPerSec"`  // rrqm/s
+    MergedWritesPerSec float64 `json:"mergedWritesPerSec"` // wrqm/s
+    ReadBytesPerSec    float64 `json:"readBytesPerSec"`
+    WriteBytesPerSec   float64 `json:"writeBytesPerSec"`
+    ReadAwait          float64 `json:"readAwait"`   // r_await, average time per completed read
+    WriteAwait         float64 `json:"writeAwait"`  // w_await
+    Await              float64 `json:"await"`       // Average time per completed read or write
+    ServiceTime        float64 `json:"svctm"`       // Time the device was busy per completed read or write
+    QueueDepth         float64 `json:"queueDepth"`  // aqu-sz, average number of requests in flight
+    UtilPercent        float64 `json:"utilPercent"` // %util, share of the interval the device was busy
+}
+
+// CPUCounters holds the cumulative CPU times, load averages and scheduler
+// counters that CPUStats are computed from.
+type CPUCounters struct {
+    Total           cpu.TimesStat
+    Cores           []cpu.TimesStat
+    Load            load.AvgStat
+    ContextSwitches uint64
+    Interrupts      uint64
+    ProcsRunning    int
+    ProcsBlocked    int
+}
+
+// CPUStats holds the CPU time breakdown in total and per core, the load
+// averages and the scheduler counters.
+type CPUStats struct {
+    Total           CPUTimes   `json:"total"`
+    Cores           []CPUTimes `json:"cores"`
+    Load1           float64    `json:"load1"`
+    Load5           float64    `json:"load5"`
+    Load15          float64    `json:"load15"`
+    ContextSwitches uint64     `json:"context_switches"` // Since boot
+    Interrupts      uint64     `json:"interrupts"`       // Since boot, Linux only
+    ProcsRunning    int        `json:"procs_running"`
+    ProcsBlocked    int        `json:"procs_blocked"` // Waiting for IO
+
+    // Rates since the previous sample, missing on the first sample
+    Rates *CPURates `json:"rates,omitempty"`
+}
+
+// CPURates holds the context switches and interrupts per second.
+type CPURates struct {
+    ContextSwitchesPerSec float64 `json:"context_switches_per_sec"`
+    InterruptsPerSec      float64 `json:"interrupts_per_sec"`
+}
+
+// CPUTimes holds the share of time in percent a CPU spent in each state over
+// one interval. Guest time is also counted in user and nice time.
+type CPUTimes struct {
+    CPU       string  `json:"cpu"`   // cpu-total, cpu0, cpu1...
+    Usage     float64 `json:"usage"` // Everything but idle and iowait
+    User      float64 `json:"user"`
+    Nice      float64 `json:"nice"`
+    System    float64 `json:"system"`
+    Idle      float64 `json:"idle"`
+    Iowait    float64 `json:"iowait"`
+    Irq       float64 `json:"irq"`
+    Softirq   float64 `json:"softirq"`
+    Steal     float64 `json:"steal"`
+    Guest     float64 `json:"guest"`
+    GuestNice float64 `json:"guest_nice"`
+}
+
+// MemoryInfo holds the host's memory and swap usage in bytes.
+type MemoryInfo struct {
+    Total       uint64  `json:"total"`
+    Available   uint64  `json:"available"` // Free for new allocations without swapping
+    Used        uint64  `json:"used"`
+    UsedPercent float64 `json:"used_percent"`
+    Free        uint64  `json:"free"`
+    Buffers     uint64  `json:"buffers"`
+    Cached      uint64  `json:"cached"`
+    Slab        uint64  `json:"slab"`
+    Dirty       uint64  `json:"dirty"`
+    Writeback   uint64  `json:"writeback"`
+
+    SwapTotal uint64 `json:"swap_total"`
+    SwapUsed  uint64 `json:"swap_used"`
+    SwapIn    uint64 `json:"swap_in"`  // Swapped in since boot
+    SwapOut   uint64 `json:"swap_out"` // Swapped out since boot
+
+    // Swap rates since the previous sample, missing on the first sample
+    SwapRates *SwapRates `json:"swap_rates,omitempty"`
+
+    HugePagesTotal uint64 `json:"huge_pages_total"`
+    HugePagesFree  uint64 `json:"huge_pages_free"`
+    HugePageSize   uint64 `json:"huge_page_size"`
+}
+
+// SwapRates holds the bytes swapped in and out per second.
+type SwapRates struct {
+    InPerSec  float64 `json:"in_per_sec"`
+    OutPerSec float64 `json:"out_per_sec"`
 }
 
 type DiskUsageInfo struct {
@@ -55,31 +215,98 @@ type DiskUsageInfo struct {
     Mountpoint  string  `json:"mountpoint"`   // Mounted on
 }
 
-func GatherBasicMetrics() (float64, uint64, error) {
-    // Gather CPU percentage using gopsutil/cpu
-    cpuPercents, err := cpu.Percent(0, false)
+// GatherBasicMetrics collects the CPU counters and memory usage. CPU usage
+// is computed from two samples, see BasicCollector.
+func GatherBasicMetrics(logger *slog.Logger) (*CPUCounters, *MemoryInfo, error) {
+    cpuCounters, err := GatherCPUCounters(logger)
     if err != nil {
-        log.Printf("Error gathering CPU percentage: %v", err)
-        return 0, 0, err
+        return nil, nil, err
     }
-    cpuPercent := cpuPercents[0]
 
-    // Gather Memory usage
+    memoryInfo, err := GatherMemoryInfo(logger)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return cpuCounters, memoryInfo, nil
+}
+
+// GatherCPUCounters collects the cumulative CPU times in total and per core,
+// the load averages and the scheduler counters
+func GatherCPUCounters(logger *slog.Logger) (*CPUCounters, error) {
+    total, err := cpu.Times(false)
+    if err == nil && len(total) == 0 {
+        err = fmt.Errorf("no CPU times reported")
+    }
+    if err != nil {
+        logger.Debug("Error gathering CPU times", "err", err)
+        return nil, err
+    }
+    cores, err := cpu.Times(true)
+    if err != nil {
+        logger.Debug("Error gathering per-core CPU times", "err", err)
+        return nil, err
+    }
+    counters := &CPUCounters{Total: total[0], Cores: cores}
+
+    // Load averages and scheduler counters are not available everywhere
+    if avg, err := load.Avg(); err != nil {
+        logger.Debug("Error gathering load averages", "err", err)
+    } else {
+        counters.Load = *avg
+    }
+    if misc, err := load.Misc(); err != nil {
+        logger.Debug("Error gathering scheduler counters", "err", err)
+    } else {
+        counters.ContextSwitches = uint64(misc.Ctxt)
+        counters.ProcsRunning = misc.ProcsRunning
+        counters.ProcsBlocked = misc.ProcsBlocked
+    }
+    counters.Interrupts = gatherInterrupts(logger)
+
+    return counters, nil
+}
+
+// GatherMemoryInfo collects memory, swap and huge page usage
+func GatherMemoryInfo(logger *slog.Logger) (*MemoryInfo, error) {
     vmStat, err := mem.VirtualMemory()
     if err != nil {
-        log.Printf("Error gathering Memory usage: %v", err)
-        return 0, 0, err
+        logger.Debug("Error gathering memory usage", "err", err)
+        return nil, err
+    }
+
+    swapStat, err := mem.SwapMemory()
+    if err != nil {
+        logger.Debug("Error gathering swap usage", "err", err)
+        return nil, err
     }
-    memoryUsage := vmStat.Used
 
-    return cpuPercent, memoryUsage, nil
+    return &MemoryInfo{
+        Total:          vmStat.Total,
+        Available:      vmStat.Available,
+        Used:           vmStat.Used,
+        UsedPercent:    vmStat.UsedPercent,
+        Free:           vmStat.Free,
+        Buffers:        vmStat.Buffers,
+        Cached:         vmStat.Cached,
+        Slab:           vmStat.Slab,
+        Dirty:          vmStat.Dirty,
+        Writeback:      vmStat.Writeback,
+        SwapTotal:      swapStat.Total,
+        SwapUsed:       swapStat.Used,
+        SwapIn:         swapStat.Sin,
+        SwapOut:        swapStat.Sout,
+        HugePagesTotal: vmStat.HugePagesTotal,
+        HugePagesFree:  vmStat.HugePagesFree,
+        HugePageSize:   vmStat.HugePageSize,
+    }, nil
 }
 
-func GatherNetworkMetrics() ([]NetworkStat, []ConnectionStat, error) {
-    // Gather Network I/O counters
-    netIOCounters, err := net.IOCounters(false)
+func GatherNetworkMetrics(logger *slog.Logger) ([]NetworkStat, []ConnectionStat, error) {
+    // Gather Network I/O counters per interface
+    netIOCounters, err := net.IOCounters(true)
     if err != nil {
-        log.Printf("Error gathering Network I/O counters: %v", err)
+        logger.Debug("Error gathering network IO counters", "err", err)
         return nil, nil, err
     }
 
@@ -87,16 +314,24 @@ func GatherNetworkMetrics() ([]NetworkStat, []ConnectionStat, error) {
     var netStats []NetworkStat
     for _, io := range netIOCounters {
         netStats = append(netStats, NetworkStat{
-            Name:      io.Name,
-            BytesSent: io.BytesSent,
-            BytesRecv: io.BytesRecv,
+            Name:        io.Name,
+            BytesSent:   io.BytesSent,
+            BytesRecv:   io.BytesRecv,
+            PacketsSent: io.PacketsSent,
+            PacketsRecv: io.PacketsRecv,
+            ErrIn:       io.Errin,
+            ErrOut:      io.Errout,
+            DropIn:      io.Dropin,
+            DropOut:     io.Dropout,
+            FifoIn:      io.Fifoin,
+            FifoOut:     io.Fifoout,
         })
     }
 
     // Gather Open Ports and Active Connections
     netConnections, err := net.Connections("inet")
     if err != nil {
-        log.Printf("Error gathering Network connections: %v", err)
+        logger.Debug("Error gathering network connections", "err", err)
         return nil, nil, err
     }
 
@@ -113,22 +348,22 @@ func GatherNetworkMetrics() ([]NetworkStat, []ConnectionStat, error) {
     return netStats, connStats, nil
 }
 
-func GatherOSInfo() (string, string, string) {
+func GatherOSInfo(logger *slog.Logger) (string, string, string) {
     info, err := host.Info()
     if err != nil {
-        log.Printf("Error gathering OS information: %v", err)
+        logger.Warn("Error gathering OS information", "err", err)
         return "", "", ""
     }
     return info.Platform, info.PlatformVersion, info.KernelVersion
 }
 
 // GatherCPUInfo collects detailed CPU information using klauspost/cpuid
-func GatherCPUInfo() (*CPUInfo, error) {
+func GatherCPUInfo(logger *slog.Logger) (*CPUInfo, error) {
     cpu := cpuid.CPU
 
     // Check if the CPU information is valid
     if cpu.BrandName == "" {
-        log.Printf("Unable to gather CPU information")
+        logger.Debug("Unable to gather CPU information")
         return nil, fmt.Errorf("unable to gather CPU information")
     }
 
@@ -145,21 +380,21 @@ func GatherCPUInfo() (*CPUInfo, error) {
     return cpuInfo, nil
 }
 
-func GatherDiskIOInfo() (map[string]disk.IOCountersStat, error) {
+func GatherDiskIOInfo(logger *slog.Logger) (map[string]disk.IOCountersStat, error) {
     ioCounters, err := disk.IOCounters()
     if err != nil {
-        log.Printf("Error gathering Disk I/O information: %v", err)
+        logger.Debug("Error gathering disk IO information", "err", err)
         return nil, err
     }
     return ioCounters, nil
 }
 
 // GatherDiskUsage collects disk size and usage information for all partitions
-func GatherDiskUsage() ([]DiskUsageInfo, error) {
+func GatherDiskUsage(logger *slog.Logger) ([]DiskUsageInfo, error) {
     // Get all partitions/mount points
     partitions, err := disk.Partitions(true)
     if err != nil {
-        log.Printf("Error gathering disk partitions: %v", err)
+        logger.Debug("Error gathering disk partitions", "err", err)
         return nil, err
     }
 
@@ -169,7 +404,7 @@ func GatherDiskUsage() ([]DiskUsageInfo, error) {
     for _, partition := range partitions {
         usageStat, err := disk.Usage(partition.Mountpoint)
         if err != nil {
-            log.Printf("Error gathering disk usage for partition %s: %v", partition.Mountpoint, err)
+            logger.Debug("Error gathering disk usage", "mountpoint", partition.Mountpoint, "err", err)
             continue
         }
 
@@ -189,10 +424,11 @@ func GatherDiskUsage() ([]DiskUsageInfo, error) {
 
 
 // GatherProcessMetrics collects information about running processes, including CPU and memory usage
-func GatherProcessMetrics() ([]ProcessInfo, error) {
+// and the enabled optional fields
+func GatherProcessMetrics(logger *slog.Logger, fields ProcessFieldSet) ([]ProcessInfo, error) {
     processes, err := process.Processes()
     if err != nil {
-        log.Printf("Error gathering process information: %v", err)
+        logger.Debug("Error gathering process information", "err", err)
         return nil, err
     }
 
@@ -206,31 +442,50 @@ func GatherProcessMetrics() ([]ProcessInfo, error) {
             if err.Error() == "EOF" || err.Error() == "operation not permitted" {
                 continue
             }
-            log.Printf("Error getting process name for PID %d: %v", proc.Pid, err)
+            logger.Debug("Error getting process name", "pid", proc.Pid, "err", err)
             continue
         }
 
         // Attempt to get CPU usage
         cpuPercent, err := proc.CPUPercent()
         if err != nil {
-            log.Printf("Error getting process CPU usage for PID %d: %v", proc.Pid, err)
+            logger.Debug("Error getting process CPU usage", "pid", proc.Pid, "err", err)
             continue
         }
 
         // Attempt to get memory usage
         memInfo, err := proc.MemoryInfo()
         if err != nil {
-            log.Printf("Error getting process memory usage for PID %d: %v", proc.Pid, err)
+            logger.Debug("Error getting process memory usage", "pid", proc.Pid, "err", err)
             continue
         }
 
-        processInfoList = append(processInfoList, ProcessInfo{
+        info := ProcessInfo{
             PID:         proc.Pid,
             Name:        name,
             CPUPercent:  cpuPercent,
             MemoryUsage: memInfo.RSS,
-        })
+        }
+        if fields["memory"] {
+            info.VMS = memInfo.VMS
+            info.Swap = memInfo.Swap
+        }
+        gatherProcessFields(proc, &info, fields)
+
+        processInfoList = append(processInfoList, info)
     }
 
     return processInfoList, nil
 }
+
+// TopProcessesByCPU returns the n processes with the highest CPU usage,
+// busiest first. Zero returns all of them.
+func TopProcessesByCPU(procs []ProcessInfo, n int) []ProcessInfo {
+    sorted := make([]ProcessInfo, len(procs))
+    copy(sorted, procs)
+    sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CPUPercent > sorted[j].CPUPercent })
+    if n > 0 && len(sorted) > n {
+        sorted = sorted[:n]
+    }
+    return sorted
+}
@@ -0,0 +1,25 @@
+package metrics
+
+// Pressure holds the Linux pressure stall information (PSI) for CPU, memory
+// and IO. A resource is missing when the kernel does not report it.
+type Pressure struct {
+    CPU    *PressureStat `json:"cpu,omitempty"`
+    Memory *PressureStat `json:"memory,omitempty"`
+    IO     *PressureStat `json:"io,omitempty"`
+}
+
+// PressureStat holds how long some tasks, or all non-idle tasks at once,
+// were stalled waiting for a resource.
+type PressureStat struct {
+    Some PressureLine  `json:"some"`
+    Full *PressureLine `json:"full,omitempty"` // Missing for CPU on older kernels
+}
+
+// PressureLine holds the share of time in percent that tasks were stalled,
+// averaged over 10s, 60s and 300s, and the total stall time.
+type PressureLine struct {
+    Avg10  float64 `json:"avg10"`
+    Avg60  float64 `json:"avg60"`
+    Avg300 float64 `json:"avg300"`
+    Total  uint64  `json:"total"` // Microseconds
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// pressureDir is where the kernel reports PSI, since Linux 4.20
+const pressureDir = "/proc/pressure"
+
+// GatherPressure reads the pressure stall information of CPU, memory and IO.
+// It returns nil if the kernel was built or booted without PSI.
+func GatherPressure(logger *slog.Logger) *Pressure {
+    p := &Pressure{
+        CPU:    readPressure("cpu", logger),
+        Memory: readPressure("memory", logger),
+        IO:     readPressure("io", logger),
+    }
+    if p.CPU == nil && p.Memory == nil && p.IO == nil {
+        return nil
+    }
+    return p
+}
+
+// readPressure reads one resource's file, nil if it cannot be read.
+func readPressure(name string, logger *slog.Logger) *PressureStat {
+    path := filepath.Join(pressureDir, name)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        // Reading fails with EOPNOTSUPP when PSI is disabled at boot
+        if !errors.Is(err, os.ErrNotExist) {
+            logger.Debug("Error reading pressure stall information", "path", path, "err", err)
+        }
+        return nil
+    }
+
+    stat, err := parsePressure(string(data))
+    if err != nil {
+        logger.Debug("Error parsing pressure stall information", "path", path, "err", err)
+        return nil
+    }
+    return stat
+}
+
+// parsePressure parses the lines of a /proc/pressure file, of the form
+// "some avg10=0.00 avg60=0.00 avg300=0.00 total=0".
+func parsePressure(data string) (*PressureStat, error) {
+    var stat PressureStat
+    seenSome := false
+    for _, text := range strings.Split(data, "\n") {
+        fields := strings.Fields(text)
+        if len(fields) == 0 {
+            continue
+        }
+
+        var line PressureLine
+        for _, field := range fields[1:] {
+            key, value, _ := strings.Cut(field, "=")
+            var err error
+            switch key {
+            case "avg10":
+                line.Avg10, err = strconv.ParseFloat(value, 64)
+            case "avg60":
+                line.Avg60, err = strconv.ParseFloat(value, 64)
+            case "avg300":
+                line.Avg300, err = strconv.ParseFloat(value, 64)
+            case "total":
+                line.Total, err = strconv.ParseUint(value, 10, 64)
+            }
+            if err != nil {
+                return nil, fmt.Errorf("invalid field %q", field)
+            }
+        }
+
+        switch fields[0] {
+        case "some":
+            stat.Some = line
+            seenSome = true
+        case "full":
+            stat.Full = &line
+        }
+    }
+    if !seenSome {
+        return nil, errors.New(`no "some" line`)
+    }
+    return &stat, nil
+}
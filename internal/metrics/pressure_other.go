@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package metrics
+
+import "log/slog"
+
+// GatherPressure returns nil, pressure stall information is Linux only.
+func GatherPressure(logger *slog.Logger) *Pressure {
+    return nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+    "fmt"
+
+    "github.com/dickiesanders/go-agent/internal/redact"
+    "github.com/shirou/gopsutil/process"
+)
+
+// ProcessFields are the names of the optional process fields. Each one costs
+// extra reads per process, so they are only collected when enabled.
+var ProcessFields = []string{"cmdline", "username", "status", "ppid", "create_time", "threads", "fds", "io", "ctx_switches", "memory"}
+
+// ProcessFieldSet holds the enabled optional process fields.
+type ProcessFieldSet map[string]bool
+
+// ParseProcessFields checks the names of optional process fields.
+func ParseProcessFields(names []string) (ProcessFieldSet, error) {
+    known := make(map[string]bool, len(ProcessFields))
+    for _, name := range ProcessFields {
+        known[name] = true
+    }
+
+    fields := make(ProcessFieldSet, len(names))
+    for _, name := range names {
+        if !known[name] {
+            return nil, fmt.Errorf("unknown process field %q", name)
+        }
+        fields[name] = true
+    }
+    return fields, nil
+}
+
+// gatherProcessFields fills in the enabled optional fields, except memory. A
+// field that cannot be read, often for lack of permission on processes of
+// other users, is left empty.
+func gatherProcessFields(proc *process.Process, info *ProcessInfo, fields ProcessFieldSet) {
+    if fields["cmdline"] {
+        if args, err := proc.CmdlineSlice(); err == nil {
+            info.Cmdline = redact.CommandLine(args)
+        }
+    }
+    if fields["username"] {
+        info.Username, _ = proc.Username()
+    }
+    if fields["status"] {
+        info.Status, _ = proc.Status()
+    }
+    if fields["ppid"] {
+        info.PPID, _ = proc.Ppid()
+    }
+    if fields["create_time"] {
+        info.CreateTime, _ = proc.CreateTime()
+    }
+    if fields["threads"] {
+        info.Threads, _ = proc.NumThreads()
+    }
+    if fields["fds"] {
+        info.FDs, _ = proc.NumFDs()
+    }
+    if fields["io"] {
+        if io, err := proc.IOCounters(); err == nil {
+            info.IO = &ProcessIO{
+                ReadCount:  io.ReadCount,
+                WriteCount: io.WriteCount,
+                ReadBytes:  io.ReadBytes,
+                WriteBytes: io.WriteBytes,
+            }
+        }
+    }
+    if fields["ctx_switches"] {
+        if ctx, err := proc.NumCtxSwitches(); err == nil {
+            info.CtxSwitches = &ProcessCtxSwitches{
+                Voluntary:   ctx.Voluntary,
+                Involuntary: ctx.Involuntary,
+            }
+        }
+    }
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+    "log/slog"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// gatherInterrupts returns the number of interrupts serviced since boot, the
+// first number on the intr line of /proc/stat.
+func gatherInterrupts(logger *slog.Logger) uint64 {
+    data, err := os.ReadFile("/proc/stat")
+    if err != nil {
+        logger.Debug("Error reading interrupt count", "err", err)
+        return 0
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 2 || fields[0] != "intr" {
+            continue
+        }
+        n, err := strconv.ParseUint(fields[1], 10, 64)
+        if err != nil {
+            logger.Debug("Error parsing interrupt count", "err", err)
+        }
+        return n
+    }
+    return 0
+}
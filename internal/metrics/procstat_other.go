@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package metrics
+
+import "log/slog"
+
+// gatherInterrupts returns 0, the interrupt count is only read on Linux.
+func gatherInterrupts(logger *slog.Logger) uint64 {
+    return 0
+}
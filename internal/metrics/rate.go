@@ -0,0 +1,59 @@
+package metrics
+
+import (
+    "math"
+    "time"
+)
+
+// counterDelta returns how much a cumulative counter grew from prev to cur.
+// A counter that went down has either wrapped around 32 bits or been reset,
+// for example when an interface was recreated. It is taken as a wrap only
+// when prev was in the upper half of the 32-bit range; a reset returns false
+// so no rate is computed across it.
+func counterDelta(prev, cur uint64) (uint64, bool) {
+    if cur >= prev {
+        return cur - prev, true
+    }
+    if prev <= math.MaxUint32 && prev > math.MaxUint32/2 {
+        return math.MaxUint32 - prev + cur + 1, true
+    }
+    return 0, false
+}
+
+// rateCounter computes deltas and per-second rates of cumulative counters
+// over the same interval. ok turns false once any counter was reset.
+type rateCounter struct {
+    elapsed time.Duration
+    ok      bool
+}
+
+func newRateCounter(elapsed time.Duration) *rateCounter {
+    return &rateCounter{elapsed: elapsed, ok: elapsed > 0}
+}
+
+// delta returns how much a counter grew from prev to cur.
+func (r *rateCounter) delta(prev, cur uint64) uint64 {
+    delta, ok := counterDelta(prev, cur)
+    if !ok {
+        r.ok = false
+    }
+    return delta
+}
+
+// rate returns the per-second rate of a counter that went from prev to cur.
+func (r *rateCounter) rate(prev, cur uint64) float64 {
+    return r.perSecond(r.delta(prev, cur))
+}
+
+// perSecond spreads delta over the interval.
+func (r *rateCounter) perSecond(delta uint64) float64 {
+    if !r.ok {
+        return 0
+    }
+    return float64(delta) / r.elapsed.Seconds()
+}
+
+// millis returns the interval in milliseconds.
+func (r *rateCounter) millis() float64 {
+    return float64(r.elapsed) / float64(time.Millisecond)
+}
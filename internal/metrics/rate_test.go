@@ -0,0 +1,60 @@
+package metrics
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+func TestCounterDelta(t *testing.T) {
+    tests := []struct {
+        name      string
+        prev, cur uint64
+        want      uint64
+        ok        bool
+    }{
+        {"unchanged", 100, 100, 0, true},
+        {"grew", 100, 250, 150, true},
+        {"grew past 32 bits", math.MaxUint32, math.MaxUint32 + 10, 10, true},
+        {"32-bit wrap", math.MaxUint32 - 5, 4, 10, true},
+        {"32-bit wrap to zero", math.MaxUint32, 0, 1, true},
+        {"wrap from upper half", math.MaxUint32/2 + 1, 0, math.MaxUint32/2 + 1, true},
+        {"reset from lower half", math.MaxUint32 / 2, 10, 0, false},
+        {"reset to zero", 5000, 0, 0, false},
+        {"64-bit counter went down", math.MaxUint32 + 100, 50, 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, ok := counterDelta(tt.prev, tt.cur)
+            if got != tt.want || ok != tt.ok {
+                t.Errorf("counterDelta(%d, %d) = %d, %v, want %d, %v", tt.prev, tt.cur, got, ok, tt.want, tt.ok)
+            }
+        })
+    }
+}
+
+func TestRateCounter(t *testing.T) {
+    r := newRateCounter(2 * time.Second)
+    if got := r.rate(100, 300); got != 100 {
+        t.Errorf("rate(100, 300) = %v, want 100", got)
+    }
+    if got := r.millis(); got != 2000 {
+        t.Errorf("millis() = %v, want 2000", got)
+    }
+
+    // One reset counter invalidates every rate of the interval
+    if got := r.delta(5000, 0); got != 0 {
+        t.Errorf("delta(5000, 0) = %d, want 0", got)
+    }
+    if r.ok {
+        t.Errorf("ok = true after a reset")
+    }
+    if got := r.rate(100, 300); got != 0 {
+        t.Errorf("rate(100, 300) after a reset = %v, want 0", got)
+    }
+
+    // Without an interval there is nothing to divide by
+    if got := newRateCounter(0).rate(100, 300); got != 0 {
+        t.Errorf("rate over no time = %v, want 0", got)
+    }
+}
@@ -0,0 +1,413 @@
+// Package prometheus exposes the latest collected sample in the Prometheus
+// text exposition format so the agent can also serve as a scrape target.
+package prometheus
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/sink"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter serves the most recent sample it was given.
+type Exporter struct {
+    mu           sync.RWMutex
+    latest       *metrics.MetricsData
+    topProcesses int
+    sinkStats    func() []sink.Stats
+}
+
+// NewExporter returns an exporter that reports the topProcesses processes
+// with the highest CPU usage. Zero reports all of them.
+func NewExporter(topProcesses int) *Exporter {
+    return &Exporter{topProcesses: topProcesses}
+}
+
+// Update replaces the sample served on the next scrape. Sections missing
+// from data because their collector was not due keep their last values.
+func (e *Exporter) Update(data metrics.MetricsData) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    data.Merge(e.latest)
+    e.latest = &data
+}
+
+// SetSinkStats makes the exporter also report the delivery counters of
+// every sink, as returned by stats.
+func (e *Exporter) SetSinkStats(stats func() []sink.Stats) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.sinkStats = stats
+}
+
+// Name and Write make the exporter a sink, so it receives samples from the
+// router like every other destination.
+func (e *Exporter) Name() string { return "prometheus" }
+
+func (e *Exporter) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    for _, s := range samples {
+        e.Update(s)
+    }
+    return nil
+}
+
+// ServeHTTP writes the latest sample in the text exposition format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    e.mu.RLock()
+    latest := e.latest
+    sinkStats := e.sinkStats
+    e.mu.RUnlock()
+
+    w.Header().Set("Content-Type", ContentType)
+    bw := bufio.NewWriter(w)
+    if latest != nil {
+        e.write(bw, latest)
+    }
+    if sinkStats != nil {
+        writeSinkStats(bw, sinkStats())
+    }
+    bw.Flush()
+}
+
+// ListenAndServe serves the exporter on addr under path until ctx is done.
+func (e *Exporter) ListenAndServe(ctx context.Context, addr, path string, logger *slog.Logger) error {
+    mux := http.NewServeMux()
+    mux.Handle(path, e)
+
+    server := &http.Server{
+        Addr:              addr,
+        Handler:           mux,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
+
+    logger.Info("Serving Prometheus metrics", "address", addr, "path", path)
+    if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+func (e *Exporter) write(w *bufio.Writer, data *metrics.MetricsData) {
+    gauge(w, "goagent_last_collection_timestamp_seconds", "Unix time of the latest sample.")
+    value(w, "goagent_last_collection_timestamp_seconds", nil, float64(data.Timestamp.UnixNano())/1e9)
+
+    gauge(w, "goagent_cpu_usage_percent", "Total CPU usage in percent.")
+    value(w, "goagent_cpu_usage_percent", nil, data.CPUPercent)
+
+    if c := data.CPU; c != nil {
+        gauge(w, "goagent_cpu_state_percent", "Share of CPU time per state in percent, in total and per core.")
+        for _, t := range append([]metrics.CPUTimes{c.Total}, c.Cores...) {
+            for _, s := range cpuStates(t) {
+                value(w, "goagent_cpu_state_percent", labels("cpu", t.CPU, "state", s.name), s.value)
+            }
+        }
+
+        cpuGauges := []struct {
+            name, help string
+            value      float64
+        }{
+            {"goagent_load1", "Load average over 1 minute.", c.Load1},
+            {"goagent_load5", "Load average over 5 minutes.", c.Load5},
+            {"goagent_load15", "Load average over 15 minutes.", c.Load15},
+            {"goagent_procs_running", "Processes running or ready to run.", float64(c.ProcsRunning)},
+            {"goagent_procs_blocked", "Processes blocked waiting for IO.", float64(c.ProcsBlocked)},
+        }
+        for _, g := range cpuGauges {
+            gauge(w, g.name, g.help)
+            value(w, g.name, nil, g.value)
+        }
+        counter(w, "goagent_context_switches_total", "Context switches since boot.")
+        value(w, "goagent_context_switches_total", nil, float64(c.ContextSwitches))
+        counter(w, "goagent_interrupts_total", "Interrupts serviced since boot.")
+        value(w, "goagent_interrupts_total", nil, float64(c.Interrupts))
+    }
+
+    if m := data.Memory; m != nil {
+        memoryGauges := []struct {
+            name, help string
+            value      uint64
+        }{
+            {"goagent_memory_total_bytes", "Total memory in bytes.", m.Total},
+            {"goagent_memory_available_bytes", "Memory available for new allocations without swapping, in bytes.", m.Available},
+            {"goagent_memory_used_bytes", "Used memory in bytes.", m.Used},
+            {"goagent_memory_free_bytes", "Unused memory in bytes.", m.Free},
+            {"goagent_memory_buffers_bytes", "Memory used for block device buffers in bytes.", m.Buffers},
+            {"goagent_memory_cached_bytes", "Memory used for the page cache in bytes.", m.Cached},
+            {"goagent_memory_slab_bytes", "Memory used by kernel slab caches in bytes.", m.Slab},
+            {"goagent_memory_dirty_bytes", "Memory waiting to be written back to disk in bytes.", m.Dirty},
+            {"goagent_memory_writeback_bytes", "Memory being written back to disk in bytes.", m.Writeback},
+            {"goagent_swap_total_bytes", "Total swap space in bytes.", m.SwapTotal},
+            {"goagent_swap_used_bytes", "Used swap space in bytes.", m.SwapUsed},
+            {"goagent_hugepages_total", "Number of huge pages.", m.HugePagesTotal},
+            {"goagent_hugepages_free", "Number of unused huge pages.", m.HugePagesFree},
+            {"goagent_hugepage_size_bytes", "Size of a huge page in bytes.", m.HugePageSize},
+        }
+        for _, g := range memoryGauges {
+            gauge(w, g.name, g.help)
+            value(w, g.name, nil, float64(g.value))
+        }
+        counter(w, "goagent_swap_in_bytes_total", "Bytes swapped in since boot.")
+        value(w, "goagent_swap_in_bytes_total", nil, float64(m.SwapIn))
+        counter(w, "goagent_swap_out_bytes_total", "Bytes swapped out since boot.")
+        value(w, "goagent_swap_out_bytes_total", nil, float64(m.SwapOut))
+    }
+
+    if p := data.Pressure; p != nil {
+        resources := []struct {
+            name string
+            stat *metrics.PressureStat
+        }{{"cpu", p.CPU}, {"memory", p.Memory}, {"io", p.IO}}
+        counter(w, "goagent_pressure_waiting_seconds_total", "Time some tasks were stalled waiting for the resource.")
+        for _, r := range resources {
+            if r.stat != nil {
+                value(w, "goagent_pressure_waiting_seconds_total", labels("resource", r.name), float64(r.stat.Some.Total)/1e6)
+            }
+        }
+        counter(w, "goagent_pressure_stalled_seconds_total", "Time all non-idle tasks were stalled waiting for the resource.")
+        for _, r := range resources {
+            if r.stat != nil && r.stat.Full != nil {
+                value(w, "goagent_pressure_stalled_seconds_total", labels("resource", r.name), float64(r.stat.Full.Total)/1e6)
+            }
+        }
+    }
+
+    if len(data.NetworkStats) > 0 {
+        netCounters := []struct {
+            name, help string
+            value      func(n metrics.NetworkStat) uint64
+        }{
+            {"goagent_network_sent_bytes_total", "Bytes sent per network interface.", func(n metrics.NetworkStat) uint64 { return n.BytesSent }},
+            {"goagent_network_received_bytes_total", "Bytes received per network interface.", func(n metrics.NetworkStat) uint64 { return n.BytesRecv }},
+            {"goagent_network_sent_packets_total", "Packets sent per network interface.", func(n metrics.NetworkStat) uint64 { return n.PacketsSent }},
+            {"goagent_network_received_packets_total", "Packets received per network interface.", func(n metrics.NetworkStat) uint64 { return n.PacketsRecv }},
+            {"goagent_network_transmit_errors_total", "Transmit errors per network interface.", func(n metrics.NetworkStat) uint64 { return n.ErrOut }},
+            {"goagent_network_receive_errors_total", "Receive errors per network interface.", func(n metrics.NetworkStat) uint64 { return n.ErrIn }},
+            {"goagent_network_transmit_drops_total", "Outgoing packets dropped per network interface.", func(n metrics.NetworkStat) uint64 { return n.DropOut }},
+            {"goagent_network_receive_drops_total", "Incoming packets dropped per network interface.", func(n metrics.NetworkStat) uint64 { return n.DropIn }},
+            {"goagent_network_transmit_fifo_overruns_total", "Transmit FIFO overruns per network interface.", func(n metrics.NetworkStat) uint64 { return n.FifoOut }},
+            {"goagent_network_receive_fifo_overruns_total", "Receive FIFO overruns per network interface.", func(n metrics.NetworkStat) uint64 { return n.FifoIn }},
+        }
+        for _, c := range netCounters {
+            counter(w, c.name, c.help)
+            for _, n := range data.NetworkStats {
+                value(w, c.name, labels("interface", n.Name), float64(c.value(n)))
+            }
+        }
+    }
+
+    if data.ConnStats != nil {
+        gauge(w, "goagent_network_connections", "Number of open inet connections.")
+        value(w, "goagent_network_connections", nil, float64(len(data.ConnStats)))
+    }
+
+    if len(data.DiskIOStats) > 0 {
+        devices := make([]string, 0, len(data.DiskIOStats))
+        for name := range data.DiskIOStats {
+            devices = append(devices, name)
+        }
+        sort.Strings(devices)
+
+        diskCounters := []struct {
+            name, help string
+            value      func(name string) float64
+        }{
+            {"goagent_disk_read_bytes_total", "Bytes read per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].ReadBytes) }},
+            {"goagent_disk_written_bytes_total", "Bytes written per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].WriteBytes) }},
+            {"goagent_disk_reads_completed_total", "Reads completed per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].ReadCount) }},
+            {"goagent_disk_writes_completed_total", "Writes completed per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].WriteCount) }},
+            {"goagent_disk_io_time_seconds_total", "Time spent doing IO per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].IoTime) / 1000 }},
+            {"goagent_disk_read_time_seconds_total", "Time spent on completed reads per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].ReadTime) / 1000 }},
+            {"goagent_disk_write_time_seconds_total", "Time spent on completed writes per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].WriteTime) / 1000 }},
+            {"goagent_disk_io_time_weighted_seconds_total", "Time spent doing IO weighted by requests in flight per disk device.", func(d string) float64 { return float64(data.DiskIOStats[d].WeightedIO) / 1000 }},
+        }
+        for _, c := range diskCounters {
+            counter(w, c.name, c.help)
+            for _, device := range devices {
+                value(w, c.name, labels("device", device), c.value(device))
+            }
+        }
+        gauge(w, "goagent_disk_io_now", "Requests in flight per disk device.")
+        for _, device := range devices {
+            value(w, "goagent_disk_io_now", labels("device", device), float64(data.DiskIOStats[device].IopsInProgress))
+        }
+    }
+
+    if len(data.DiskUsageInfo) > 0 {
+        usageGauges := []struct {
+            name, help string
+            value      func(u metrics.DiskUsageInfo) float64
+        }{
+            {"goagent_filesystem_size_bytes", "Filesystem size in bytes.", func(u metrics.DiskUsageInfo) float64 { return float64(u.Total) }},
+            {"goagent_filesystem_free_bytes", "Filesystem free space in bytes.", func(u metrics.DiskUsageInfo) float64 { return float64(u.Free) }},
+            {"goagent_filesystem_used_bytes", "Filesystem used space in bytes.", func(u metrics.DiskUsageInfo) float64 { return float64(u.Used) }},
+            {"goagent_filesystem_used_percent", "Filesystem used space in percent.", func(u metrics.DiskUsageInfo) float64 { return u.UsedPercent }},
+        }
+        for _, g := range usageGauges {
+            gauge(w, g.name, g.help)
+            for _, u := range data.DiskUsageInfo {
+                value(w, g.name, labels("device", u.Device, "mountpoint", u.Mountpoint), g.value(u))
+            }
+        }
+    }
+
+    if procs := metrics.TopProcessesByCPU(data.ProcessInfo, e.topProcesses); len(procs) > 0 {
+        gauge(w, "goagent_process_cpu_percent", "CPU usage in percent of the busiest processes.")
+        for _, p := range procs {
+            value(w, "goagent_process_cpu_percent", processLabels(p), p.CPUPercent)
+        }
+        gauge(w, "goagent_process_resident_memory_bytes", "Resident memory of the busiest processes.")
+        for _, p := range procs {
+            value(w, "goagent_process_resident_memory_bytes", processLabels(p), float64(p.MemoryUsage))
+        }
+
+        // Optional fields are only written for the processes that have them
+        io := func(get func(io *metrics.ProcessIO) uint64) func(p metrics.ProcessInfo) (float64, bool) {
+            return func(p metrics.ProcessInfo) (float64, bool) {
+                if p.IO == nil {
+                    return 0, false
+                }
+                return float64(get(p.IO)), true
+            }
+        }
+        ctxSwitches := func(get func(ctx *metrics.ProcessCtxSwitches) int64) func(p metrics.ProcessInfo) (float64, bool) {
+            return func(p metrics.ProcessInfo) (float64, bool) {
+                if p.CtxSwitches == nil {
+                    return 0, false
+                }
+                return float64(get(p.CtxSwitches)), true
+            }
+        }
+        optional := []struct {
+            name, help string
+            counter    bool
+            value      func(p metrics.ProcessInfo) (float64, bool)
+        }{
+            {"goagent_process_virtual_memory_bytes", "Virtual memory size of the busiest processes.", false, func(p metrics.ProcessInfo) (float64, bool) { return float64(p.VMS), p.VMS > 0 }},
+            {"goagent_process_swap_bytes", "Swapped out memory of the busiest processes.", false, func(p metrics.ProcessInfo) (float64, bool) { return float64(p.Swap), p.Swap > 0 }},
+            {"goagent_process_start_time_seconds", "Start time of the busiest processes since the Unix epoch.", false, func(p metrics.ProcessInfo) (float64, bool) { return float64(p.CreateTime) / 1000, p.CreateTime > 0 }},
+            {"goagent_process_threads", "Threads of the busiest processes.", false, func(p metrics.ProcessInfo) (float64, bool) { return float64(p.Threads), p.Threads > 0 }},
+            {"goagent_process_open_fds", "Open file descriptors of the busiest processes.", false, func(p metrics.ProcessInfo) (float64, bool) { return float64(p.FDs), p.FDs > 0 }},
+            {"goagent_process_read_bytes_total", "Bytes read by the busiest processes.", true, io(func(io *metrics.ProcessIO) uint64 { return io.ReadBytes })},
+            {"goagent_process_written_bytes_total", "Bytes written by the busiest processes.", true, io(func(io *metrics.ProcessIO) uint64 { return io.WriteBytes })},
+            {"goagent_process_voluntary_context_switches_total", "Voluntary context switches of the busiest processes.", true, ctxSwitches(func(ctx *metrics.ProcessCtxSwitches) int64 { return ctx.Voluntary })},
+            {"goagent_process_involuntary_context_switches_total", "Involuntary context switches of the busiest processes.", true, ctxSwitches(func(ctx *metrics.ProcessCtxSwitches) int64 { return ctx.Involuntary })},
+        }
+        for _, o := range optional {
+            written := false
+            for _, p := range procs {
+                v, ok := o.value(p)
+                if !ok {
+                    continue
+                }
+                if !written {
+                    if o.counter {
+                        counter(w, o.name, o.help)
+                    } else {
+                        gauge(w, o.name, o.help)
+                    }
+                    written = true
+                }
+                value(w, o.name, processLabels(p), v)
+            }
+        }
+    }
+}
+
+func writeSinkStats(w *bufio.Writer, stats []sink.Stats) {
+    if len(stats) == 0 {
+        return
+    }
+
+    sinkCounters := []struct {
+        name, help string
+        value      func(s sink.Stats) float64
+    }{
+        {"goagent_sink_written_samples_total", "Samples written per sink.", func(s sink.Stats) float64 { return float64(s.Written) }},
+        {"goagent_sink_dropped_samples_total", "Samples dropped per sink because its queue was full.", func(s sink.Stats) float64 { return float64(s.Dropped) }},
+        {"goagent_sink_failed_samples_total", "Samples given up on per sink after the last attempt.", func(s sink.Stats) float64 { return float64(s.Failed) }},
+        {"goagent_sink_retries_total", "Repeated write attempts per sink.", func(s sink.Stats) float64 { return float64(s.Retries) }},
+    }
+    for _, c := range sinkCounters {
+        counter(w, c.name, c.help)
+        for _, s := range stats {
+            value(w, c.name, labels("sink", s.Name), c.value(s))
+        }
+    }
+
+    gauge(w, "goagent_sink_queued_samples", "Samples waiting to be written per sink.")
+    for _, s := range stats {
+        value(w, "goagent_sink_queued_samples", labels("sink", s.Name), float64(s.Queued))
+    }
+}
+
+type cpuState struct {
+    name  string
+    value float64
+}
+
+// cpuStates lists the time-state percentages of a CPU.
+func cpuStates(t metrics.CPUTimes) []cpuState {
+    return []cpuState{
+        {"user", t.User}, {"nice", t.Nice}, {"system", t.System}, {"idle", t.Idle}, {"iowait", t.Iowait},
+        {"irq", t.Irq}, {"softirq", t.Softirq}, {"steal", t.Steal}, {"guest", t.Guest}, {"guest_nice", t.GuestNice},
+    }
+}
+
+func processLabels(p metrics.ProcessInfo) []string {
+    return labels("pid", strconv.Itoa(int(p.PID)), "name", p.Name)
+}
+
+func gauge(w *bufio.Writer, name, help string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+func counter(w *bufio.Writer, name, help string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+}
+
+func labels(pairs ...string) []string {
+    return pairs
+}
+
+// value writes one sample line. pairs alternates label names and values.
+func value(w *bufio.Writer, name string, pairs []string, v float64) {
+    w.WriteString(name)
+    if len(pairs) > 0 {
+        w.WriteByte('{')
+        for i := 0; i+1 < len(pairs); i += 2 {
+            if i > 0 {
+                w.WriteByte(',')
+            }
+            fmt.Fprintf(w, "%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1]))
+        }
+        w.WriteByte('}')
+    }
+    w.WriteByte(' ')
+    w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+    w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+    return labelEscaper.Replace(s)
+}
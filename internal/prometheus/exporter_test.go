@@ -0,0 +1,70 @@
+package prometheus
+
+import (
+    "context"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/sink"
+)
+
+// scrape returns what the exporter serves.
+func scrape(t *testing.T, e *Exporter) string {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+    if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+        t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+    }
+    return rec.Body.String()
+}
+
+func TestExporterExposition(t *testing.T) {
+    e := NewExporter(0)
+    e.SetSinkStats(func() []sink.Stats { return []sink.Stats{{Name: "otlp", Written: 7}} })
+    e.Write(context.Background(), []metrics.MetricsData{{
+        Timestamp:  time.Unix(1700000000, 0),
+        CPUPercent: 12.5,
+        Memory:     &metrics.MemoryInfo{Total: 1024},
+        ProcessInfo: []metrics.ProcessInfo{
+            {PID: 42, Name: `say "hi"`, CPUPercent: 3, VMS: 4096},
+            {PID: 43, Name: "idle"},
+        },
+    }})
+    first := scrape(t, e)
+
+    // The next sample only has what the network collector gathered
+    e.Write(context.Background(), []metrics.MetricsData{{
+        Timestamp: time.Unix(1700000030, 0),
+        ConnStats: []metrics.ConnectionStat{{}, {}},
+    }})
+    second := scrape(t, e)
+
+    tests := []struct {
+        name, body, line string
+        want             bool
+    }{
+        {"timestamp", first, "goagent_last_collection_timestamp_seconds 1.7e+09\n", true},
+        {"total CPU", first, "goagent_cpu_usage_percent 12.5\n", true},
+        {"escaped label", first, `goagent_process_cpu_percent{pid="42",name="say \"hi\""} 3` + "\n", true},
+        {"virtual memory", first, `goagent_process_virtual_memory_bytes{pid="42",name="say \"hi\""} 4096`, true},
+        {"swap not collected", first, "goagent_process_swap_bytes{", false},
+        {"connections not collected", first, "goagent_network_connections", false},
+        {"sink counters", first, `goagent_sink_written_samples_total{sink="otlp"} 7` + "\n", true},
+        {"connections collected", second, "goagent_network_connections 2\n", true},
+        {"memory carried over", second, "goagent_memory_total_bytes 1024\n", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := strings.Contains(tt.body, tt.line); got != tt.want {
+                t.Errorf("scrape contains %q = %v, want %v", tt.line, got, tt.want)
+            }
+        })
+    }
+    if n := strings.Count(first, "# TYPE goagent_process_cpu_percent "); n != 1 {
+        t.Errorf("goagent_process_cpu_percent has %d TYPE lines, want 1", n)
+    }
+}
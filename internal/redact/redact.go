@@ -0,0 +1,168 @@
+// Package redact hides secrets and sensitive fields from what the agent
+// logs. Keys are compared ignoring case, underscores, dashes and dots, so
+// remote_addr also matches RemoteAddr.
+package redact
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "net/url"
+    "regexp"
+    "strings"
+)
+
+// Mask replaces redacted values.
+const Mask = "[REDACTED]"
+
+// secretWords mark a key as holding a secret wherever they appear in it,
+// e.g. authorization, api_token or db_password.
+var secretWords = []string{"authorization", "token", "apikey", "password", "passwd", "secret", "credential", "cookie"}
+
+// Redactor decides which values to hide: secrets always, plus the
+// configured sensitive fields.
+type Redactor struct {
+    fields map[string]bool
+}
+
+// New returns a Redactor hiding secrets and the given fields.
+func New(fields []string) *Redactor {
+    r := &Redactor{fields: make(map[string]bool, len(fields))}
+    for _, field := range fields {
+        r.fields[normalize(field)] = true
+    }
+    return r
+}
+
+func normalize(key string) string {
+    return strings.Map(func(r rune) rune {
+        switch r {
+        case '_', '-', '.':
+            return -1
+        }
+        return r
+    }, strings.ToLower(key))
+}
+
+// Hides reports whether the value under key must not be logged.
+func (r *Redactor) Hides(key string) bool {
+    return r.fields[normalize(key)] || isSecret(key)
+}
+
+// isSecret reports whether key names a secret.
+func isSecret(key string) bool {
+    key = normalize(key)
+    for _, word := range secretWords {
+        if strings.Contains(key, word) {
+            return true
+        }
+    }
+    return false
+}
+
+// urlPassword matches the password of credentials in a URL.
+var urlPassword = regexp.MustCompile(`(://[^/@:\s]*:)[^/@\s]+@`)
+
+// assignment matches name=value pairs, also inside a longer argument such
+// as a shell script or a query string.
+var assignment = regexp.MustCompile(`([\w.-]+)=([^\s&;'"]+)`)
+
+// CommandLine joins a process's arguments with secrets masked: the values
+// of options and variables whose name holds a secret, as in --password=x,
+// --api-token x or DB_PASSWORD=x, and passwords in URLs.
+func CommandLine(args []string) string {
+    out := make([]string, len(args))
+    maskNext := false
+    for i, arg := range args {
+        if maskNext && !strings.HasPrefix(arg, "-") {
+            out[i] = Mask
+            maskNext = false
+            continue
+        }
+        maskNext = false
+
+        // An option without =, its value is the next argument
+        if i > 0 && strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && isSecret(arg) {
+            out[i] = arg
+            maskNext = true
+            continue
+        }
+
+        arg = assignment.ReplaceAllStringFunc(arg, func(pair string) string {
+            name, _, _ := strings.Cut(pair, "=")
+            if isSecret(name) {
+                return name + "=" + Mask
+            }
+            return pair
+        })
+        out[i] = urlPassword.ReplaceAllString(arg, "${1}"+Mask+"@")
+    }
+    return strings.Join(out, " ")
+}
+
+// ReplaceAttr masks hidden attributes, for use in slog.HandlerOptions.
+func (r *Redactor) ReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+    if a.Value.Kind() != slog.KindGroup && r.Hides(a.Key) {
+        return slog.String(a.Key, Mask)
+    }
+    return a
+}
+
+// JSON returns a copy of a JSON document with hidden values masked. A body
+// that cannot be parsed is masked entirely.
+func (r *Redactor) JSON(data []byte) []byte {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+
+    var doc interface{}
+    if err := dec.Decode(&doc); err != nil {
+        return []byte(Mask)
+    }
+    out, err := json.Marshal(r.walk(doc))
+    if err != nil {
+        return []byte(Mask)
+    }
+    return out
+}
+
+func (r *Redactor) walk(v interface{}) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for key, value := range v {
+            if r.Hides(key) {
+                v[key] = Mask
+            } else {
+                v[key] = r.walk(value)
+            }
+        }
+    case []interface{}:
+        for i, value := range v {
+            v[i] = r.walk(value)
+        }
+    }
+    return v
+}
+
+// Body masks a request body for logging. JSON bodies and JSON documents
+// inside form values, as sent to GoAWS, are redacted field by field.
+func (r *Redactor) Body(contentType string, body []byte) string {
+    if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+        return string(r.JSON(body))
+    }
+
+    form, err := url.ParseQuery(string(body))
+    if err != nil {
+        return Mask
+    }
+    for key, values := range form {
+        for i, value := range values {
+            switch {
+            case r.Hides(key):
+                values[i] = Mask
+            case strings.HasSuffix(key, "MessageBody"):
+                values[i] = string(r.JSON([]byte(value)))
+            }
+        }
+    }
+    return form.Encode()
+}
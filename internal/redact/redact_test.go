@@ -0,0 +1,31 @@
+package redact
+
+import "testing"
+
+func TestCommandLine(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        want string
+    }{
+        {"nothing secret", []string{"nginx", "-g", "daemon off;"}, "nginx -g daemon off;"},
+        {"option with =", []string{"app", "--password=hunter2", "--port=80"}, "app --password=[REDACTED] --port=80"},
+        {"option and value", []string{"app", "--api-token", "abc", "-v"}, "app --api-token [REDACTED] -v"},
+        {"option followed by a flag", []string{"app", "--token", "--verbose"}, "app --token --verbose"},
+        {"single dash option", []string{"app", "-secret", "abc"}, "app -secret [REDACTED]"},
+        {"environment style", []string{"env", "DB_PASSWORD=x", "HOME=/root", "app"}, "env DB_PASSWORD=[REDACTED] HOME=/root app"},
+        {"inside a script", []string{"bash", "-c", "export API_TOKEN=abc; run --client-secret=xyz"}, "bash -c export API_TOKEN=[REDACTED]; run --client-secret=[REDACTED]"},
+        {"query string", []string{"curl", "https://example.com/?user=bob&access_token=abc"}, "curl https://example.com/?user=bob&access_token=[REDACTED]"},
+        {"URL password", []string{"psql", "postgres://admin:s3cr3t@db:5432/app"}, "psql postgres://admin:[REDACTED]@db:5432/app"},
+        {"URL without password", []string{"curl", "https://user@example.com/"}, "curl https://user@example.com/"},
+        {"name alone is kept", []string{"/usr/bin/token-server", "--listen", ":80"}, "/usr/bin/token-server --listen :80"},
+        {"empty", nil, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := CommandLine(tt.args); got != tt.want {
+                t.Errorf("CommandLine(%q) = %q, want %q", tt.args, got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,112 @@
+// Package registration stores what the server issues when the agent
+// registers: the agent ID, the credential used for every later push and the
+// initial configuration.
+package registration
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const fileName = "registration.json"
+
+// State is the agent's registration as answered by the server.
+type State struct {
+    AgentID    string `json:"agent_id"`
+    Credential string `json:"credential"`
+
+    // Config holds settings in the layout of the config file, applied over
+    // the defaults and under the file and environment
+    Config json.RawMessage `json:"config,omitempty"`
+
+    RegisteredAt time.Time `json:"registered_at"`
+}
+
+// ParseResponse reads the server's answer to a registration request.
+func ParseResponse(body []byte) (*State, error) {
+    var st State
+    if err := json.Unmarshal(body, &st); err != nil {
+        return nil, fmt.Errorf("parsing registration response: %w", err)
+    }
+    if st.AgentID == "" || st.Credential == "" {
+        return nil, fmt.Errorf("registration response has no agent ID or credential")
+    }
+    if len(st.Config) > 0 && st.Config[0] != '{' {
+        return nil, fmt.Errorf("registration response config is not an object")
+    }
+    st.RegisteredAt = time.Now().UTC()
+    return &st, nil
+}
+
+// Load reads the registration stored in dir. It returns nil if the agent has
+// not registered yet.
+func Load(dir string) (*State, error) {
+    path := filepath.Join(dir, fileName)
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var st State
+    if err := json.Unmarshal(data, &st); err != nil {
+        return nil, fmt.Errorf("reading %s: %w", path, err)
+    }
+    return &st, nil
+}
+
+// Save stores the registration in dir. The file holds the credential, so
+// only the agent's user can read it.
+func (st *State) Save(dir string) error {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("creating state directory: %w", err)
+    }
+    data, err := json.MarshalIndent(st, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    // Write to a temporary file first so a crash never leaves a partial file
+    path := filepath.Join(dir, fileName)
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("writing %s: %w", path, err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("writing %s: %w", path, err)
+    }
+    return nil
+}
+
+// Credential holds the agent's own push credential and the agent ID it was
+// issued for, shared by everything that pushes. Until the agent has
+// registered it is empty and the shared bootstrap token is used instead.
+type Credential struct {
+    mu      sync.Mutex
+    agentID string
+    token   string
+}
+
+// Set replaces the credential.
+func (c *Credential) Set(agentID, token string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.agentID, c.token = agentID, token
+}
+
+// Get returns the agent ID and credential, or empty strings before the
+// first registration.
+func (c *Credential) Get() (agentID, token string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.agentID, c.token
+}
@@ -0,0 +1,87 @@
+package registration
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestParseResponse(t *testing.T) {
+    tests := []struct {
+        name, body string
+        want       string // Part of the error, empty for none
+    }{
+        {"valid", `{"agent_id": "a1", "credential": "secret", "config": {"push_interval": "1m"}}`, ""},
+        {"no config", `{"agent_id": "a1", "credential": "secret"}`, ""},
+        {"not JSON", `<html>`, "parsing registration response"},
+        {"no credential", `{"agent_id": "a1"}`, "no agent ID or credential"},
+        {"no agent ID", `{"credential": "secret"}`, "no agent ID or credential"},
+        {"config not an object", `{"agent_id": "a1", "credential": "secret", "config": "push_interval: 1m"}`, "not an object"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            st, err := ParseResponse([]byte(tt.body))
+            switch {
+            case tt.want == "" && err != nil:
+                t.Errorf("ParseResponse() error = %v", err)
+            case tt.want == "" && (st.AgentID != "a1" || st.RegisteredAt.IsZero()):
+                t.Errorf("ParseResponse() = %+v", st)
+            case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+                t.Errorf("ParseResponse() error = %v, want one containing %q", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestSaveLoad(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "state")
+    if st, err := Load(dir); st != nil || err != nil {
+        t.Fatalf("Load() before registering = %+v, %v, want nothing", st, err)
+    }
+
+    st, err := ParseResponse([]byte(`{"agent_id": "a1", "credential": "secret", "config": {"push_interval": "1m"}}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := st.Save(dir); err != nil {
+        t.Fatalf("Save() error = %v", err)
+    }
+    info, err := os.Stat(filepath.Join(dir, fileName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if perm := info.Mode().Perm(); perm&0077 != 0 {
+        t.Errorf("registration file mode = %v, readable by others", perm)
+    }
+
+    got, err := Load(dir)
+    if err != nil {
+        t.Fatalf("Load() error = %v", err)
+    }
+    // Save indents the config, so compare it compacted
+    var config bytes.Buffer
+    json.Compact(&config, got.Config)
+    if got.AgentID != st.AgentID || got.Credential != st.Credential || !got.RegisteredAt.Equal(st.RegisteredAt) ||
+        config.String() != `{"push_interval":"1m"}` {
+        t.Errorf("Load() = %+v, want %+v", got, st)
+    }
+
+    os.WriteFile(filepath.Join(dir, fileName), []byte("{"), 0600)
+    if _, err := Load(dir); err == nil {
+        t.Errorf("Load() accepted a corrupt file")
+    }
+}
+
+func TestCredential(t *testing.T) {
+    var c Credential
+    if id, token := c.Get(); id != "" || token != "" {
+        t.Errorf("Get() before Set() = %q, %q", id, token)
+    }
+    c.Set("a1", "secret")
+    if id, token := c.Get(); id != "a1" || token != "secret" {
+        t.Errorf("Get() = %q, %q, want a1, secret", id, token)
+    }
+}
@@ -0,0 +1,237 @@
+// Package rotate implements a file writer that rotates by size and age,
+// optionally compresses rotated files and keeps a limited number of them.
+package rotate
+
+import (
+    "compress/gzip"
+    "errors"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// timeLayout names rotated files in UTC; it sorts in chronological order.
+const timeLayout = "2006-01-02T15-04-05.000"
+
+// Options configures rotation. Zero values disable the respective limit.
+type Options struct {
+    MaxBytes int64         // Rotate before the file would grow beyond this size
+    MaxAge   time.Duration // Rotate once the file has been written to this long
+    Compress bool          // Gzip rotated files
+    MaxFiles int           // Rotated files to keep, older ones are deleted
+
+    // OnError, if set, is called with failures of the background
+    // compression and cleanup of rotated files.
+    OnError func(err error)
+}
+
+// Writer appends to a file and rotates it according to its options. Rotated
+// files are renamed to <path>.<timestamp>, plus .gz when compressed.
+type Writer struct {
+    path string
+    opts Options
+
+    mu      sync.Mutex
+    file    *os.File
+    size    int64
+    started time.Time
+
+    // Compression and cleanup run in the background, one at a time
+    cleanup sync.Mutex
+    pending sync.WaitGroup
+}
+
+// Open opens or creates the file at path for appending.
+func Open(path string, opts Options) (*Writer, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return nil, err
+    }
+    w := &Writer{path: path, opts: opts}
+    if err := w.open(); err != nil {
+        return nil, err
+    }
+    return w, nil
+}
+
+func (w *Writer) open() error {
+    file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+
+    w.file = file
+    w.size = info.Size()
+    w.started = time.Now()
+    if w.size > 0 {
+        // An existing file counts from when it was last written
+        w.started = info.ModTime()
+    }
+    return nil
+}
+
+// Write appends p, rotating first when p would not fit in the current file
+// or the file is due by age. A single write is never split across files.
+func (w *Writer) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.file == nil {
+        return 0, os.ErrClosed
+    }
+    if w.size > 0 && w.due(int64(len(p))) {
+        if err := w.rotate(); err != nil {
+            return 0, err
+        }
+    }
+
+    n, err := w.file.Write(p)
+    w.size += int64(n)
+    return n, err
+}
+
+func (w *Writer) due(next int64) bool {
+    if w.opts.MaxBytes > 0 && w.size+next > w.opts.MaxBytes {
+        return true
+    }
+    return w.opts.MaxAge > 0 && time.Since(w.started) >= w.opts.MaxAge
+}
+
+// Rotate closes the current file and starts a new one.
+func (w *Writer) Rotate() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.file == nil {
+        return os.ErrClosed
+    }
+    return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+    if err := w.file.Close(); err != nil {
+        return err
+    }
+    w.file = nil
+
+    rotated := w.path + "." + time.Now().UTC().Format(timeLayout)
+    if err := os.Rename(w.path, rotated); err != nil {
+        // Keep writing to the current file rather than losing data
+        if openErr := w.open(); openErr != nil {
+            return errors.Join(err, openErr)
+        }
+        return err
+    }
+    if err := w.open(); err != nil {
+        return err
+    }
+
+    w.pending.Add(1)
+    go func() {
+        defer w.pending.Done()
+        w.cleanup.Lock()
+        defer w.cleanup.Unlock()
+
+        var err error
+        if w.opts.Compress {
+            err = compress(rotated)
+        }
+        err = errors.Join(err, w.prune())
+        if err != nil && w.opts.OnError != nil {
+            w.opts.OnError(err)
+        }
+    }()
+    return nil
+}
+
+// Close closes the file and waits for background compression to finish.
+func (w *Writer) Close() error {
+    w.mu.Lock()
+    var err error
+    if w.file != nil {
+        err = w.file.Close()
+        w.file = nil
+    }
+    w.mu.Unlock()
+
+    w.pending.Wait()
+    return err
+}
+
+// compress gzips path next to it and removes the original. On failure the
+// uncompressed file is kept.
+func compress(path string) error {
+    src, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+
+    tmp := path + ".gz.tmp"
+    dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+    if err != nil {
+        return err
+    }
+
+    gz := gzip.NewWriter(dst)
+    _, err = io.Copy(gz, src)
+    if closeErr := gz.Close(); err == nil {
+        err = closeErr
+    }
+    if closeErr := dst.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(tmp, path+".gz")
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Remove(path)
+}
+
+// prune deletes the oldest rotated files beyond MaxFiles.
+func (w *Writer) prune() error {
+    if w.opts.MaxFiles <= 0 {
+        return nil
+    }
+
+    entries, err := os.ReadDir(filepath.Dir(w.path))
+    if err != nil {
+        return err
+    }
+
+    prefix := filepath.Base(w.path) + "."
+    var rotated []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+            continue
+        }
+        stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+        if _, err := time.Parse(timeLayout, stamp); err != nil {
+            continue
+        }
+        rotated = append(rotated, name)
+    }
+
+    // Names sort by rotation time, oldest first
+    sort.Strings(rotated)
+    var errs []error
+    for len(rotated) > w.opts.MaxFiles {
+        if err := os.Remove(filepath.Join(filepath.Dir(w.path), rotated[0])); err != nil {
+            errs = append(errs, err)
+        }
+        rotated = rotated[1:]
+    }
+    return errors.Join(errs...)
+}
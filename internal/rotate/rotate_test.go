@@ -0,0 +1,118 @@
+package rotate
+
+import (
+    "compress/gzip"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// readAll returns the contents of the rotated files, oldest first, and of
+// the current file, decompressing as needed.
+func readAll(t *testing.T, dir string) (rotated []string, content string) {
+    t.Helper()
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, entry := range entries {
+        names = append(names, entry.Name())
+    }
+    // The current file sorts before its rotated files, read it last
+    sort.Strings(names)
+    names = append(names[1:], names[0])
+
+    var b strings.Builder
+    for _, name := range names {
+        f, err := os.Open(filepath.Join(dir, name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        var r io.Reader = f
+        if strings.HasSuffix(name, ".gz") {
+            if r, err = gzip.NewReader(f); err != nil {
+                t.Fatalf("%s: %v", name, err)
+            }
+        }
+        io.Copy(&b, r)
+        f.Close()
+        if name != "out.log" {
+            rotated = append(rotated, name)
+        }
+    }
+    return rotated, b.String()
+}
+
+func TestWriter(t *testing.T) {
+    tests := []struct {
+        name    string
+        opts    Options
+        lines   []string
+        rotated int  // Rotated files left
+        gzip    bool // Whether they are compressed
+        kept    string
+    }{
+        {"no limits", Options{}, []string{"aaaaa\n", "bbbbb\n", "ccccc\n"}, 0, false, "aaaaa\nbbbbb\nccccc\n"},
+        {"by size", Options{MaxBytes: 10}, []string{"aaaaa\n", "bbbbb\n", "ccccc\n"}, 2, false, "aaaaa\nbbbbb\nccccc\n"},
+        {"write larger than the limit", Options{MaxBytes: 4}, []string{"aaaaa\n"}, 0, false, "aaaaa\n"},
+        {"by age", Options{MaxAge: time.Millisecond}, []string{"aaaaa\n", "bbbbb\n"}, 1, false, "aaaaa\nbbbbb\n"},
+        {"compressed", Options{MaxBytes: 10, Compress: true}, []string{"aaaaa\n", "bbbbb\n", "ccccc\n"}, 2, true, "aaaaa\nbbbbb\nccccc\n"},
+        {"oldest deleted", Options{MaxBytes: 10, MaxFiles: 1}, []string{"aaaaa\n", "bbbbb\n", "ccccc\n"}, 1, false, "bbbbb\nccccc\n"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            var errs []error
+            tt.opts.OnError = func(err error) { errs = append(errs, err) }
+            w, err := Open(filepath.Join(dir, "out.log"), tt.opts)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, line := range tt.lines {
+                // Rotated files are named by the millisecond
+                time.Sleep(2 * time.Millisecond)
+                if _, err := w.Write([]byte(line)); err != nil {
+                    t.Fatalf("Write() error = %v", err)
+                }
+            }
+            if err := w.Close(); err != nil {
+                t.Fatalf("Close() error = %v", err)
+            }
+            if len(errs) > 0 {
+                t.Errorf("background errors: %v", errs)
+            }
+
+            rotated, content := readAll(t, dir)
+            if len(rotated) != tt.rotated {
+                t.Errorf("rotated files = %q, want %d", rotated, tt.rotated)
+            }
+            for _, name := range rotated {
+                if strings.HasSuffix(name, ".gz") != tt.gzip {
+                    t.Errorf("rotated file %s, want compressed %v", name, tt.gzip)
+                }
+            }
+            if content != tt.kept {
+                t.Errorf("content = %q, want %q", content, tt.kept)
+            }
+        })
+    }
+}
+
+func TestWriterClosed(t *testing.T) {
+    w, err := Open(filepath.Join(t.TempDir(), "sub", "out.log"), Options{})
+    if err != nil {
+        t.Fatalf("Open() did not create the directory: %v", err)
+    }
+    w.Close()
+    if _, err := w.Write([]byte("x")); err != os.ErrClosed {
+        t.Errorf("Write() after Close() error = %v, want %v", err, os.ErrClosed)
+    }
+    if err := w.Rotate(); err != os.ErrClosed {
+        t.Errorf("Rotate() after Close() error = %v, want %v", err, os.ErrClosed)
+    }
+}
@@ -0,0 +1,45 @@
+package sink
+
+import (
+    "context"
+    "encoding/json"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/rotate"
+)
+
+// File writes every sample as one line of JSON to a rotating local file, for
+// hosts whose data is picked up by other means.
+type File struct {
+    w *rotate.Writer
+}
+
+// NewFile opens or creates the file at path, rotated according to opts.
+func NewFile(path string, opts rotate.Options) (*File, error) {
+    w, err := rotate.Open(path, opts)
+    if err != nil {
+        return nil, err
+    }
+    return &File{w: w}, nil
+}
+
+func (f *File) Name() string { return "file" }
+
+func (f *File) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    for _, sample := range samples {
+        line, err := json.Marshal(sample)
+        if err != nil {
+            return err
+        }
+        // One write per line so rotation never splits a sample
+        if _, err := f.w.Write(append(line, '\n')); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Close closes the file once pending compression of rotated files is done.
+func (f *File) Close() error {
+    return f.w.Close()
+}
@@ -0,0 +1,50 @@
+package sink
+
+import (
+    "context"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/rotate"
+)
+
+func TestFileWrite(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "metrics.jsonl")
+    f, err := NewFile(path, rotate.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    samples := []metrics.MetricsData{
+        {Timestamp: time.Unix(1700000000, 0).UTC(), UniqueID: "id-1", CPUPercent: 1},
+        {Timestamp: time.Unix(1700000030, 0).UTC(), UniqueID: "id-1", CPUPercent: 2},
+    }
+    if err := f.Write(context.Background(), samples); err != nil {
+        t.Fatalf("Write() error = %v", err)
+    }
+    if err := f.Close(); err != nil {
+        t.Fatalf("Close() error = %v", err)
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+    if len(lines) != len(samples) {
+        t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(samples), data)
+    }
+    for i, line := range lines {
+        var got metrics.MetricsData
+        if err := json.Unmarshal([]byte(line), &got); err != nil {
+            t.Fatalf("line %d is not JSON: %v", i+1, err)
+        }
+        if !got.Timestamp.Equal(samples[i].Timestamp) || got.CPUPercent != samples[i].CPUPercent {
+            t.Errorf("line %d = %+v, want %+v", i+1, got, samples[i])
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package sink
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+// Graphite writes samples to Carbon using the plaintext protocol over TCP.
+//
+// Every value becomes a path of the form
+// <prefix>.<hostname>.<measurement>[.<tag values>].<field>. With tags enabled
+// the host information and the series tags are also appended in the
+// Graphite 1.1 tagged format.
+type Graphite struct {
+    address      string
+    prefix       string
+    tagged       bool
+    timeout      time.Duration
+    host         Host
+    topProcesses int
+}
+
+// NewGraphite returns a sink writing to the Carbon plaintext listener at
+// address, usually port 2003.
+func NewGraphite(address, prefix string, tagged bool, timeout time.Duration, host Host, topProcesses int) *Graphite {
+    return &Graphite{
+        address:      address,
+        prefix:       prefix,
+        tagged:       tagged,
+        timeout:      timeout,
+        host:         host,
+        topProcesses: topProcesses,
+    }
+}
+
+func (g *Graphite) Name() string { return "graphite" }
+
+func (g *Graphite) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    if len(samples) == 0 {
+        return nil
+    }
+
+    dialer := &net.Dialer{Timeout: g.timeout}
+    conn, err := dialer.DialContext(ctx, "tcp", g.address)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if g.timeout > 0 {
+        conn.SetWriteDeadline(time.Now().Add(g.timeout))
+    }
+
+    w := bufio.NewWriter(conn)
+    hostTags := hostTags(g.host)
+    for _, s := range samples {
+        timestamp := strconv.FormatInt(s.Timestamp.Unix(), 10)
+        for _, sr := range flatten(s, g.topProcesses) {
+            for _, f := range sr.fields {
+                g.writeLine(w, sr, f, hostTags, timestamp)
+            }
+        }
+    }
+    return w.Flush()
+}
+
+// writeLine appends "path value timestamp".
+func (g *Graphite) writeLine(w *bufio.Writer, sr series, f field, hostTags []tag, timestamp string) {
+    parts := []string{}
+    if g.prefix != "" {
+        parts = append(parts, g.prefix)
+    }
+    parts = append(parts, sanitizePath(g.host.Hostname), sr.measurement)
+    for _, t := range sr.tags {
+        parts = append(parts, sanitizePath(t.value))
+    }
+    parts = append(parts, f.key)
+    w.WriteString(strings.Join(parts, "."))
+
+    if g.tagged {
+        for _, tags := range [][]tag{hostTags, sr.tags} {
+            for _, t := range tags {
+                if t.value != "" {
+                    fmt.Fprintf(w, ";%s=%s", t.key, sanitizeTag(t.value))
+                }
+            }
+        }
+    }
+
+    w.WriteByte(' ')
+    if f.isCount {
+        w.WriteString(strconv.FormatUint(f.count, 10))
+    } else {
+        w.WriteString(strconv.FormatFloat(f.value, 'f', -1, 64))
+    }
+    w.WriteByte(' ')
+    w.WriteString(timestamp)
+    w.WriteByte('\n')
+}
+
+// sanitizePath makes s safe to use as one node of a Graphite path.
+func sanitizePath(s string) string {
+    if s == "" {
+        return "unknown"
+    }
+    return pathReplacer.Replace(s)
+}
+
+// sanitizeTag makes s safe to use as a Graphite tag value.
+func sanitizeTag(s string) string {
+    return tagReplacer.Replace(s)
+}
+
+var (
+    pathReplacer = strings.NewReplacer(".", "_", " ", "_", "/", "_", ";", "_", "\n", "_")
+    tagReplacer  = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_")
+)
@@ -0,0 +1,57 @@
+package sink
+
+import (
+    "context"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+func TestGraphiteWrite(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    received := make(chan string, 1)
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            received <- ""
+            return
+        }
+        defer conn.Close()
+        b, _ := io.ReadAll(conn)
+        received <- string(b)
+    }()
+
+    graphite := NewGraphite(listener.Addr().String(), "agents", true, time.Second, Host{Hostname: "web.1", UniqueID: "id-1"}, 0)
+    if err := graphite.Write(context.Background(), []metrics.MetricsData{testSample()}); err != nil {
+        t.Fatalf("Write() error = %v", err)
+    }
+    body := <-received
+
+    tests := []struct {
+        name string
+        text string
+        want bool
+    }{
+        {"total CPU", "agents.web_1.cpu.usage_percent;host=web.1;host_id=id-1 12.5 1700000000\n", true},
+        {"integer clamped", ".mem.total;host=web.1;host_id=id-1 9223372036854775807 ", true},
+        {"NaN left out", "used_percent", false},
+        {"connections not collected", "netconn", false},
+        {"custom metric prefixed", "agents.web_1.statsd_cpu.prod.gauge;host=web.1;host_id=id-1;env=prod 3 1700000000\n", true},
+        {"series without finite values left out", "statsd_broken", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := strings.Contains(body, tt.text); got != tt.want {
+                t.Errorf("body contains %q = %v, want %v, body:\n%s", tt.text, got, tt.want, body)
+            }
+        })
+    }
+}
@@ -0,0 +1,101 @@
+package sink
+
+import (
+    "bytes"
+    "context"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// InfluxDB writes samples in line protocol to the InfluxDB HTTP write API.
+type InfluxDB struct {
+    client       *transport.Client
+    url          string
+    token        string
+    host         Host
+    topProcesses int
+}
+
+// NewInfluxDB returns a sink posting to url, the full write endpoint such as
+// http://localhost:8086/api/v2/write?org=acme&bucket=agents&precision=ns.
+// A non-empty token is sent as "Authorization: Token <token>".
+func NewInfluxDB(client *transport.Client, url, token string, host Host, topProcesses int) *InfluxDB {
+    return &InfluxDB{
+        client:       client,
+        url:          url,
+        token:        token,
+        host:         host,
+        topProcesses: topProcesses,
+    }
+}
+
+func (i *InfluxDB) Name() string { return "influxdb" }
+
+func (i *InfluxDB) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    if len(samples) == 0 {
+        return nil
+    }
+
+    var body bytes.Buffer
+    hostTags := hostTags(i.host)
+    for _, s := range samples {
+        timestamp := strconv.FormatInt(s.Timestamp.UnixNano(), 10)
+        for _, sr := range flatten(s, i.topProcesses) {
+            writeLine(&body, sr, hostTags, timestamp)
+        }
+    }
+
+    header := http.Header{}
+    header.Set("Content-Type", "text/plain; charset=utf-8")
+    if i.token != "" {
+        header.Set("Authorization", "Token "+i.token)
+    }
+    return i.client.Post(ctx, i.url, header, body.Bytes())
+}
+
+// writeLine appends one line of line protocol:
+// measurement,tag=value field=value timestamp
+func writeLine(b *bytes.Buffer, sr series, hostTags []tag, timestamp string) {
+    b.WriteString(measurementEscaper.Replace(sr.measurement))
+    for _, tags := range [][]tag{hostTags, sr.tags} {
+        for _, t := range tags {
+            // Empty tag values are not allowed
+            if t.value == "" {
+                continue
+            }
+            b.WriteByte(',')
+            b.WriteString(tagEscaper.Replace(t.key))
+            b.WriteByte('=')
+            b.WriteString(tagEscaper.Replace(t.value))
+        }
+    }
+
+    for n, f := range sr.fields {
+        if n == 0 {
+            b.WriteByte(' ')
+        } else {
+            b.WriteByte(',')
+        }
+        b.WriteString(tagEscaper.Replace(f.key))
+        b.WriteByte('=')
+        if f.isCount {
+            b.WriteString(strconv.FormatUint(f.count, 10))
+            b.WriteByte('i')
+        } else {
+            b.WriteString(strconv.FormatFloat(f.value, 'f', -1, 64))
+        }
+    }
+
+    b.WriteByte(' ')
+    b.WriteString(timestamp)
+    b.WriteByte('\n')
+}
+
+var (
+    measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+    tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
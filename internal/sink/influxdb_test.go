@@ -0,0 +1,70 @@
+package sink
+
+import (
+    "context"
+    "io"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// testSample has a value of every kind the line-based sinks treat specially.
+func testSample() metrics.MetricsData {
+    return metrics.MetricsData{
+        Timestamp:  time.Unix(1700000000, 0),
+        CPUPercent: 12.5,
+        Memory:     &metrics.MemoryInfo{Total: math.MaxUint64, UsedPercent: math.NaN()},
+        CustomMetrics: []metrics.CustomMetric{
+            {Name: "cpu", Type: "gauge", Value: 3, Tags: map[string]string{"env": "prod"}},
+            {Name: "broken", Type: "gauge", Value: math.Inf(1)},
+        },
+    }
+}
+
+func TestInfluxDBWrite(t *testing.T) {
+    var body, auth string
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, _ := io.ReadAll(r.Body)
+        body, auth = string(b), r.Header.Get("Authorization")
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer server.Close()
+
+    client, err := transport.NewClient(transport.Options{}, discardLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    influx := NewInfluxDB(client, server.URL, "secret", Host{Hostname: "web 1", UniqueID: "id-1"}, 0)
+    if err := influx.Write(context.Background(), []metrics.MetricsData{testSample()}); err != nil {
+        t.Fatalf("Write() error = %v", err)
+    }
+    if auth != "Token secret" {
+        t.Errorf("Authorization = %q, want %q", auth, "Token secret")
+    }
+
+    tests := []struct {
+        name string
+        text string
+        want bool
+    }{
+        {"total CPU", `cpu,host=web\ 1,host_id=id-1 usage_percent=12.5 1700000000000000000` + "\n", true},
+        {"integer clamped", " total=9223372036854775807i,", true},
+        {"NaN left out", "used_percent=", false},
+        {"connections not collected", "netconn", false},
+        {"custom metric prefixed", `statsd_cpu,host=web\ 1,host_id=id-1,env=prod gauge=3 1700000000000000000` + "\n", true},
+        {"series without finite values left out", "statsd_broken", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := strings.Contains(body, tt.text); got != tt.want {
+                t.Errorf("body contains %q = %v, want %v, body:\n%s", tt.text, got, tt.want, body)
+            }
+        })
+    }
+}
@@ -0,0 +1,355 @@
+package sink
+
+import (
+    "context"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "google.golang.org/protobuf/encoding/protowire"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// OTLPScopeName is the instrumentation scope reported with every metric.
+const OTLPScopeName = "github.com/dickiesanders/go-agent"
+
+// OTLP sends samples to an OpenTelemetry collector as OTLP/HTTP protobuf.
+//
+// Only the few OTLP messages the agent needs are encoded, by hand, to avoid
+// pulling the generated OTLP and gRPC packages into the agent.
+type OTLP struct {
+    client       *transport.Client
+    endpoint     string
+    headers      map[string]string
+    host         Host
+    topProcesses int
+
+    // Sections of collectors that were not due are sent with their last
+    // values, so series don't come and go between exports
+    mu   sync.Mutex
+    last *metrics.MetricsData
+}
+
+// NewOTLP returns a sink posting to endpoint, usually ending in /v1/metrics.
+// Only the topProcesses busiest processes are exported, 0 exports all.
+func NewOTLP(client *transport.Client, endpoint string, headers map[string]string, host Host, topProcesses int) *OTLP {
+    return &OTLP{
+        client:       client,
+        endpoint:     endpoint,
+        headers:      headers,
+        host:         host,
+        topProcesses: topProcesses,
+    }
+}
+
+func (o *OTLP) Name() string { return "otlp" }
+
+func (o *OTLP) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    if len(samples) == 0 {
+        return nil
+    }
+
+    // The samples are shared with the other sinks, merge into a copy
+    o.mu.Lock()
+    merged := make([]metrics.MetricsData, len(samples))
+    for i, s := range samples {
+        s.Merge(o.last)
+        merged[i] = s
+        o.last = &merged[i]
+    }
+    o.mu.Unlock()
+
+    header := http.Header{}
+    header.Set("Content-Type", "application/x-protobuf")
+    for key, value := range o.headers {
+        header.Set(key, value)
+    }
+    return o.client.Post(ctx, o.endpoint, header, o.encode(merged))
+}
+
+// Field numbers from opentelemetry/proto/metrics/v1/metrics.proto and
+// common/v1/common.proto.
+const (
+    fieldResourceMetrics = 1 // ExportMetricsServiceRequest.resource_metrics
+
+    fieldResource     = 1 // ResourceMetrics.resource
+    fieldScopeMetrics = 2 // ResourceMetrics.scope_metrics
+    fieldAttributes   = 1 // Resource.attributes
+
+    fieldScope        = 1 // ScopeMetrics.scope
+    fieldMetrics      = 2 // ScopeMetrics.metrics
+    fieldScopeName    = 1 // InstrumentationScope.name
+    fieldScopeVersion = 2 // InstrumentationScope.version
+
+    fieldMetricName        = 1 // Metric.name
+    fieldMetricDescription = 2 // Metric.description
+    fieldMetricUnit        = 3 // Metric.unit
+    fieldMetricGauge       = 5 // Metric.gauge
+    fieldMetricSum         = 7 // Metric.sum
+
+    fieldDataPoints  = 1 // Gauge.data_points and Sum.data_points
+    fieldTemporality = 2 // Sum.aggregation_temporality
+    fieldMonotonic   = 3 // Sum.is_monotonic
+
+    fieldPointStartTime  = 2 // NumberDataPoint.start_time_unix_nano
+    fieldPointTime       = 3 // NumberDataPoint.time_unix_nano
+    fieldPointDouble     = 4 // NumberDataPoint.as_double
+    fieldPointAttributes = 7 // NumberDataPoint.attributes
+
+    fieldKey         = 1 // KeyValue.key
+    fieldValue       = 2 // KeyValue.value
+    fieldStringValue = 1 // AnyValue.string_value
+    fieldBoolValue   = 2 // AnyValue.bool_value
+
+    temporalityCumulative = 2
+)
+
+// point is one data point of a metric.
+type point struct {
+    attrs []string // Alternating keys and values
+    value float64
+    time  time.Time
+    start time.Time // Start of a cumulative sum, left out when zero
+}
+
+// metric collects the data points of one metric across all samples.
+type metric struct {
+    name, description, unit string
+    sum                     bool // Monotonic cumulative sum, otherwise a gauge
+    points                  []point
+}
+
+func (o *OTLP) encode(samples []metrics.MetricsData) []byte {
+    var order []string
+    byName := map[string]*metric{}
+    addSince := func(start time.Time, name, description, unit string, sum bool, at time.Time, value float64, attrs ...string) {
+        m, ok := byName[name]
+        if !ok {
+            m = &metric{name: name, description: description, unit: unit, sum: sum}
+            byName[name] = m
+            order = append(order, name)
+        }
+        m.points = append(m.points, point{attrs: attrs, value: value, time: at, start: start})
+    }
+    // Host counters count from boot.
+    add := func(name, description, unit string, sum bool, at time.Time, value float64, attrs ...string) {
+        addSince(o.host.BootTime, name, description, unit, sum, at, value, attrs...)
+    }
+
+    for _, s := range samples {
+        at := s.Timestamp
+        // The total gets its own metric so that backends summing
+        // system.cpu.utilization across cores do not count it twice.
+        add("system.cpu.utilization.total", "Total CPU usage.", "1", false, at, s.CPUPercent/100)
+        if c := s.CPU; c != nil {
+            for _, t := range c.Cores {
+                for _, st := range []struct {
+                    name  string
+                    value float64
+                }{
+                    {"user", t.User}, {"nice", t.Nice}, {"system", t.System}, {"idle", t.Idle}, {"wait", t.Iowait},
+                    {"interrupt", t.Irq}, {"softirq", t.Softirq}, {"steal", t.Steal},
+                } {
+                    add("system.cpu.utilization", "CPU usage by core and state.", "1", false, at, st.value/100, "cpu", t.CPU, "state", st.name)
+                }
+            }
+            add("system.cpu.load_average.1m", "Load average over 1 minute.", "{thread}", false, at, c.Load1)
+            add("system.cpu.load_average.5m", "Load average over 5 minutes.", "{thread}", false, at, c.Load5)
+            add("system.cpu.load_average.15m", "Load average over 15 minutes.", "{thread}", false, at, c.Load15)
+            add("system.processes.count", "Processes by status.", "{process}", false, at, float64(c.ProcsRunning), "status", "running")
+            add("system.processes.count", "Processes by status.", "{process}", false, at, float64(c.ProcsBlocked), "status", "blocked")
+            add("system.cpu.context_switches", "Context switches since boot.", "{switch}", true, at, float64(c.ContextSwitches))
+            add("system.cpu.interrupts", "Interrupts serviced since boot.", "{interrupt}", true, at, float64(c.Interrupts))
+        }
+        if m := s.Memory; m != nil {
+            add("system.memory.limit", "Total memory.", "By", false, at, float64(m.Total))
+            add("system.memory.usage", "Memory in use by state.", "By", false, at, float64(m.Used), "state", "used")
+            add("system.memory.usage", "Memory in use by state.", "By", false, at, float64(m.Free), "state", "free")
+            add("system.memory.usage", "Memory in use by state.", "By", false, at, float64(m.Buffers), "state", "buffers")
+            add("system.memory.usage", "Memory in use by state.", "By", false, at, float64(m.Cached), "state", "cached")
+            add("system.memory.usage", "Memory in use by state.", "By", false, at, float64(m.Slab), "state", "slab")
+            add("system.linux.memory.available", "Memory available without swapping.", "By", false, at, float64(m.Available))
+            add("system.paging.usage", "Swap space in use.", "By", false, at, float64(m.SwapUsed), "state", "used")
+            add("system.paging.usage", "Swap space in use.", "By", false, at, float64(m.SwapTotal-m.SwapUsed), "state", "free")
+            add("system.paging.io", "Bytes swapped in and out.", "By", true, at, float64(m.SwapIn), "direction", "in")
+            add("system.paging.io", "Bytes swapped in and out.", "By", true, at, float64(m.SwapOut), "direction", "out")
+        }
+        if p := s.Pressure; p != nil {
+            for _, r := range []struct {
+                name string
+                stat *metrics.PressureStat
+            }{{"cpu", p.CPU}, {"memory", p.Memory}, {"io", p.IO}} {
+                if r.stat == nil {
+                    continue
+                }
+                add("system.linux.pressure.stall_time", "Time tasks were stalled waiting for a resource.", "s", true, at, float64(r.stat.Some.Total)/1e6, "resource", r.name, "kind", "some")
+                if r.stat.Full != nil {
+                    add("system.linux.pressure.stall_time", "Time tasks were stalled waiting for a resource.", "s", true, at, float64(r.stat.Full.Total)/1e6, "resource", r.name, "kind", "full")
+                }
+            }
+        }
+
+        for _, n := range s.NetworkStats {
+            add("system.network.io", "Bytes sent and received.", "By", true, at, float64(n.BytesSent), "device", n.Name, "direction", "transmit")
+            add("system.network.io", "Bytes sent and received.", "By", true, at, float64(n.BytesRecv), "device", n.Name, "direction", "receive")
+            add("system.network.packets", "Packets sent and received.", "{packet}", true, at, float64(n.PacketsSent), "device", n.Name, "direction", "transmit")
+            add("system.network.packets", "Packets sent and received.", "{packet}", true, at, float64(n.PacketsRecv), "device", n.Name, "direction", "receive")
+            add("system.network.errors", "Transmit and receive errors.", "{error}", true, at, float64(n.ErrOut), "device", n.Name, "direction", "transmit")
+            add("system.network.errors", "Transmit and receive errors.", "{error}", true, at, float64(n.ErrIn), "device", n.Name, "direction", "receive")
+            add("system.network.dropped", "Packets dropped.", "{packet}", true, at, float64(n.DropOut), "device", n.Name, "direction", "transmit")
+            add("system.network.dropped", "Packets dropped.", "{packet}", true, at, float64(n.DropIn), "device", n.Name, "direction", "receive")
+        }
+        if s.ConnStats != nil {
+            add("system.network.connections", "Open inet connections.", "{connection}", false, at, float64(len(s.ConnStats)))
+        }
+
+        devices := make([]string, 0, len(s.DiskIOStats))
+        for device := range s.DiskIOStats {
+            devices = append(devices, device)
+        }
+        sort.Strings(devices)
+        for _, device := range devices {
+            io := s.DiskIOStats[device]
+            add("system.disk.io", "Disk bytes transferred.", "By", true, at, float64(io.ReadBytes), "device", device, "direction", "read")
+            add("system.disk.io", "Disk bytes transferred.", "By", true, at, float64(io.WriteBytes), "device", device, "direction", "write")
+            add("system.disk.operations", "Disk operations completed.", "{operation}", true, at, float64(io.ReadCount), "device", device, "direction", "read")
+            add("system.disk.operations", "Disk operations completed.", "{operation}", true, at, float64(io.WriteCount), "device", device, "direction", "write")
+            add("system.disk.io_time", "Time the disk spent doing IO.", "s", true, at, float64(io.IoTime)/1000, "device", device)
+            add("system.disk.operation_time", "Time spent on completed operations.", "s", true, at, float64(io.ReadTime)/1000, "device", device, "direction", "read")
+            add("system.disk.operation_time", "Time spent on completed operations.", "s", true, at, float64(io.WriteTime)/1000, "device", device, "direction", "write")
+            add("system.disk.weighted_io_time", "Time spent doing IO weighted by requests in flight.", "s", true, at, float64(io.WeightedIO)/1000, "device", device)
+            add("system.disk.pending_operations", "Requests in flight.", "{operation}", false, at, float64(io.IopsInProgress), "device", device)
+        }
+
+        for _, u := range s.DiskUsageInfo {
+            add("system.filesystem.usage", "Filesystem space.", "By", false, at, float64(u.Used), "device", u.Device, "mountpoint", u.Mountpoint, "state", "used")
+            add("system.filesystem.usage", "Filesystem space.", "By", false, at, float64(u.Free), "device", u.Device, "mountpoint", u.Mountpoint, "state", "free")
+            add("system.filesystem.utilization", "Fraction of the filesystem in use.", "1", false, at, u.UsedPercent/100, "device", u.Device, "mountpoint", u.Mountpoint)
+        }
+
+        for _, p := range metrics.TopProcessesByCPU(s.ProcessInfo, o.topProcesses) {
+            pid := strconv.Itoa(int(p.PID))
+            // Process counters start with the process, not the host.
+            var started time.Time
+            if p.CreateTime > 0 {
+                started = time.UnixMilli(p.CreateTime)
+            }
+            add("process.cpu.utilization", "CPU usage of the busiest processes.", "1", false, at, p.CPUPercent/100, "process.pid", pid, "process.executable.name", p.Name)
+            add("process.memory.usage", "Resident memory of the busiest processes.", "By", false, at, float64(p.MemoryUsage), "process.pid", pid, "process.executable.name", p.Name)
+            if p.VMS > 0 {
+                add("process.memory.virtual", "Virtual memory size of the busiest processes.", "By", false, at, float64(p.VMS), "process.pid", pid, "process.executable.name", p.Name)
+            }
+            if p.Threads > 0 {
+                add("process.threads", "Threads of the busiest processes.", "{thread}", false, at, float64(p.Threads), "process.pid", pid, "process.executable.name", p.Name)
+            }
+            if p.FDs > 0 {
+                add("process.open_file_descriptors", "Open file descriptors of the busiest processes.", "{count}", false, at, float64(p.FDs), "process.pid", pid, "process.executable.name", p.Name)
+            }
+            if io := p.IO; io != nil {
+                addSince(started, "process.disk.io", "Disk bytes transferred by the busiest processes.", "By", true, at, float64(io.ReadBytes), "process.pid", pid, "process.executable.name", p.Name, "direction", "read")
+                addSince(started, "process.disk.io", "Disk bytes transferred by the busiest processes.", "By", true, at, float64(io.WriteBytes), "process.pid", pid, "process.executable.name", p.Name, "direction", "write")
+            }
+            if ctx := p.CtxSwitches; ctx != nil {
+                addSince(started, "process.context_switches", "Context switches of the busiest processes.", "{count}", true, at, float64(ctx.Voluntary), "process.pid", pid, "process.executable.name", p.Name, "type", "voluntary")
+                addSince(started, "process.context_switches", "Context switches of the busiest processes.", "{count}", true, at, float64(ctx.Involuntary), "process.pid", pid, "process.executable.name", p.Name, "type", "involuntary")
+            }
+        }
+    }
+
+    var scope []byte
+    scope = appendString(scope, fieldScopeName, OTLPScopeName)
+    scope = appendString(scope, fieldScopeVersion, "1")
+
+    var scopeMetrics []byte
+    scopeMetrics = appendMessage(scopeMetrics, fieldScope, scope)
+    for _, name := range order {
+        scopeMetrics = appendMessage(scopeMetrics, fieldMetrics, o.encodeMetric(byName[name]))
+    }
+
+    var resourceMetrics []byte
+    resourceMetrics = appendMessage(resourceMetrics, fieldResource, o.encodeResource())
+    resourceMetrics = appendMessage(resourceMetrics, fieldScopeMetrics, scopeMetrics)
+
+    return appendMessage(nil, fieldResourceMetrics, resourceMetrics)
+}
+
+// encodeResource turns the host information into resource attributes.
+func (o *OTLP) encodeResource() []byte {
+    var resource []byte
+    for _, kv := range [][2]string{
+        {"service.name", "go-agent"},
+        {"host.name", o.host.Hostname},
+        {"host.id", o.host.UniqueID},
+        {"host.fqdn", o.host.FQDN},
+        {"host.ip", o.host.IP},
+        {"host.virtualization", o.host.Virtualization},
+    } {
+        if kv[1] != "" {
+            resource = appendMessage(resource, fieldAttributes, stringAttribute(kv[0], kv[1]))
+        }
+    }
+
+    var virtual []byte
+    virtual = appendString(virtual, fieldKey, "host.virtual")
+    virtual = appendMessage(virtual, fieldValue, protowire.AppendVarint(protowire.AppendTag(nil, fieldBoolValue, protowire.VarintType), protowire.EncodeBool(o.host.IsVirtual)))
+    return appendMessage(resource, fieldAttributes, virtual)
+}
+
+func (o *OTLP) encodeMetric(m *metric) []byte {
+    var points []byte
+    for _, p := range m.points {
+        var dp []byte
+        for i := 0; i+1 < len(p.attrs); i += 2 {
+            dp = appendMessage(dp, fieldPointAttributes, stringAttribute(p.attrs[i], p.attrs[i+1]))
+        }
+        if m.sum && !p.start.IsZero() {
+            dp = appendFixed64(dp, fieldPointStartTime, uint64(p.start.UnixNano()))
+        }
+        dp = appendFixed64(dp, fieldPointTime, uint64(p.time.UnixNano()))
+        dp = appendFixed64(dp, fieldPointDouble, math.Float64bits(p.value))
+        points = appendMessage(points, fieldDataPoints, dp)
+    }
+
+    var data []byte
+    field := protowire.Number(fieldMetricGauge)
+    data = append(data, points...)
+    if m.sum {
+        field = fieldMetricSum
+        data = protowire.AppendTag(data, fieldTemporality, protowire.VarintType)
+        data = protowire.AppendVarint(data, temporalityCumulative)
+        data = protowire.AppendTag(data, fieldMonotonic, protowire.VarintType)
+        data = protowire.AppendVarint(data, 1)
+    }
+
+    var b []byte
+    b = appendString(b, fieldMetricName, m.name)
+    b = appendString(b, fieldMetricDescription, m.description)
+    b = appendString(b, fieldMetricUnit, m.unit)
+    return appendMessage(b, field, data)
+}
+
+func stringAttribute(key, value string) []byte {
+    var kv []byte
+    kv = appendString(kv, fieldKey, key)
+    return appendMessage(kv, fieldValue, appendString(nil, fieldStringValue, value))
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+    b = protowire.AppendTag(b, num, protowire.BytesType)
+    return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+    b = protowire.AppendTag(b, num, protowire.BytesType)
+    return protowire.AppendBytes(b, msg)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+    b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+    return protowire.AppendFixed64(b, v)
+}
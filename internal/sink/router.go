@@ -0,0 +1,224 @@
+package sink
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// maxBatch bounds how many queued samples are written in one call.
+const maxBatch = 100
+
+// RouteOptions configures how samples are delivered to one sink.
+type RouteOptions struct {
+    QueueSize int                   // Samples held while the sink is busy, more are dropped
+    Retry     transport.RetryPolicy // Applied to writes that fail with a retryable error
+}
+
+// Stats counts what happened to the samples routed to one sink.
+type Stats struct {
+    Name      string
+    Queued    int    // Samples waiting to be written
+    Written   uint64 // Samples written successfully
+    Dropped   uint64 // Samples that did not fit in the queue
+    Failed    uint64 // Samples given up on after the last attempt
+    Retries   uint64 // Write attempts repeated after a failure
+    LastError string
+}
+
+// route is one sink with its own queue, retry policy and counters.
+type route struct {
+    sink  Sink
+    queue chan metrics.MetricsData
+    retry transport.RetryPolicy
+
+    written atomic.Uint64
+    dropped atomic.Uint64
+    failed  atomic.Uint64
+    retries atomic.Uint64
+
+    mu        sync.Mutex
+    lastError string
+}
+
+// Router sends every sample to a set of sinks. Each sink is written from its
+// own goroutine and queue, so a slow or failing destination only delays and
+// drops its own samples.
+type Router struct {
+    routes       []*route
+    drainTimeout time.Duration
+    logger       *slog.Logger
+    wg           sync.WaitGroup
+}
+
+// NewRouter returns an empty router. When it stops, every sink gets up to
+// drainTimeout to write the samples still queued.
+func NewRouter(drainTimeout time.Duration, logger *slog.Logger) *Router {
+    return &Router{drainTimeout: drainTimeout, logger: logger}
+}
+
+// Add registers a sink. Sinks must be added before Run is called.
+func (r *Router) Add(s Sink, opts RouteOptions) {
+    if opts.QueueSize < 1 {
+        opts.QueueSize = 1
+    }
+    if opts.Retry.MaxAttempts < 1 {
+        opts.Retry.MaxAttempts = 1
+    }
+    r.routes = append(r.routes, &route{
+        sink:  s,
+        queue: make(chan metrics.MetricsData, opts.QueueSize),
+        retry: opts.Retry,
+    })
+}
+
+// Route queues the sample for every sink without blocking.
+func (r *Router) Route(sample metrics.MetricsData) {
+    for _, rt := range r.routes {
+        select {
+        case rt.queue <- sample:
+        default:
+            rt.dropped.Add(1)
+            r.logger.Warn("Sink is falling behind, dropping sample", "sink", rt.sink.Name())
+        }
+    }
+}
+
+// Run starts writing to every sink in the background. Once ctx is done the
+// sinks write what is still queued, sinks that are an io.Closer are closed,
+// and they stop; Wait blocks until they have.
+func (r *Router) Run(ctx context.Context) {
+    for _, rt := range r.routes {
+        r.wg.Add(1)
+        go func(rt *route) {
+            defer r.wg.Done()
+            r.run(ctx, rt)
+
+            if c, ok := rt.sink.(io.Closer); ok {
+                if err := c.Close(); err != nil {
+                    r.logger.Error("Error closing sink", "sink", rt.sink.Name(), "err", err)
+                }
+            }
+        }(rt)
+    }
+}
+
+// Wait blocks until every sink has stopped after Run's context is done.
+func (r *Router) Wait() {
+    r.wg.Wait()
+}
+
+// Stats returns the counters of every sink, in the order they were added.
+func (r *Router) Stats() []Stats {
+    stats := make([]Stats, 0, len(r.routes))
+    for _, rt := range r.routes {
+        rt.mu.Lock()
+        lastError := rt.lastError
+        rt.mu.Unlock()
+
+        stats = append(stats, Stats{
+            Name:      rt.sink.Name(),
+            Queued:    len(rt.queue),
+            Written:   rt.written.Load(),
+            Dropped:   rt.dropped.Load(),
+            Failed:    rt.failed.Load(),
+            Retries:   rt.retries.Load(),
+            LastError: lastError,
+        })
+    }
+    return stats
+}
+
+func (r *Router) run(ctx context.Context, rt *route) {
+    for {
+        select {
+        case <-ctx.Done():
+            r.drain(ctx, rt, nil)
+            return
+        case sample := <-rt.queue:
+            batch := rt.take([]metrics.MetricsData{sample})
+            if ctx.Err() != nil || !r.write(ctx, rt, batch) {
+                r.drain(ctx, rt, batch)
+                return
+            }
+        }
+    }
+}
+
+// drain writes batch and whatever is still queued once the router stops,
+// without the cancellation of the agent but bounded by the drain timeout.
+// Samples left when the timeout expires are counted as failed.
+func (r *Router) drain(ctx context.Context, rt *route, batch []metrics.MetricsData) {
+    drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.drainTimeout)
+    defer cancel()
+
+    for batch = rt.take(batch); len(batch) > 0; batch = rt.take(nil) {
+        if r.write(drainCtx, rt, batch) {
+            continue
+        }
+
+        left := len(batch)
+        for batch = rt.take(nil); len(batch) > 0; batch = rt.take(nil) {
+            left += len(batch)
+        }
+        rt.failed.Add(uint64(left))
+        r.logger.Error("Giving up on samples", "sink", rt.sink.Name(), "samples", left, "err", drainCtx.Err())
+        return
+    }
+}
+
+// take adds whatever is already waiting in the queue to batch.
+func (rt *route) take(batch []metrics.MetricsData) []metrics.MetricsData {
+    for len(batch) < maxBatch {
+        select {
+        case sample := <-rt.queue:
+            batch = append(batch, sample)
+        default:
+            return batch
+        }
+    }
+    return batch
+}
+
+// write delivers a batch, retrying according to the route's policy. It
+// returns false, leaving the batch to the caller, when ctx ends first.
+func (r *Router) write(ctx context.Context, rt *route, batch []metrics.MetricsData) bool {
+    for attempt := 1; ; attempt++ {
+        err := rt.sink.Write(ctx, batch)
+        if err == nil {
+            rt.written.Add(uint64(len(batch)))
+            return true
+        }
+        if ctx.Err() != nil {
+            return false
+        }
+
+        rt.mu.Lock()
+        rt.lastError = err.Error()
+        rt.mu.Unlock()
+
+        if attempt >= rt.retry.MaxAttempts || !transport.IsRetryable(err) {
+            rt.failed.Add(uint64(len(batch)))
+            r.logger.Error("Error writing samples to sink", "sink", rt.sink.Name(), "samples", len(batch), "err", err)
+            return true
+        }
+
+        delay := rt.retry.Delay(attempt, err)
+        r.logger.Warn("Writing to sink failed, retrying", "sink", rt.sink.Name(), "attempt", attempt, "max_attempts", rt.retry.MaxAttempts, "delay", delay.Round(time.Millisecond), "err", err)
+        rt.retries.Add(1)
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return false
+        case <-timer.C:
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package sink
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// recordingSink remembers the size of every batch written to it. When block
+// is set a write waits until its context ends.
+type recordingSink struct {
+    block bool
+    fail  int // Writes to fail with a retryable error first
+
+    mu      sync.Mutex
+    batches []int
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    if s.block {
+        <-ctx.Done()
+        return ctx.Err()
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.fail > 0 {
+        s.fail--
+        return &transport.StatusError{StatusCode: 503}
+    }
+    s.batches = append(s.batches, len(samples))
+    return nil
+}
+
+func discardLogger() *slog.Logger {
+    return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// runStopped routes n samples to a router whose context is already done and
+// waits for it to drain.
+func runStopped(r *Router, n int) {
+    for i := 0; i < n; i++ {
+        r.Route(metrics.MetricsData{})
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    r.Run(ctx)
+    r.Wait()
+}
+
+func TestRouterDrain(t *testing.T) {
+    tests := []struct {
+        name    string
+        sink    *recordingSink
+        queued  int
+        written uint64
+        failed  uint64
+        retries uint64
+    }{
+        {"empty", &recordingSink{}, 0, 0, 0, 0},
+        {"one batch", &recordingSink{}, 10, 10, 0, 0},
+        {"more than one batch", &recordingSink{}, 250, 250, 0, 0},
+        {"retried", &recordingSink{fail: 1}, 10, 10, 0, 1},
+        {"timeout", &recordingSink{block: true}, 250, 0, 250, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := NewRouter(50*time.Millisecond, discardLogger())
+            r.Add(tt.sink, RouteOptions{
+                QueueSize: 500,
+                Retry:     transport.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+            })
+            runStopped(r, tt.queued)
+
+            st := r.Stats()[0]
+            if st.Written != tt.written || st.Failed != tt.failed || st.Retries != tt.retries || st.Queued != 0 {
+                t.Errorf("stats = %+v, want %d written, %d failed, %d retries and nothing queued", st, tt.written, tt.failed, tt.retries)
+            }
+            for _, n := range tt.sink.batches {
+                if n > maxBatch {
+                    t.Errorf("wrote a batch of %d samples, more than %d", n, maxBatch)
+                }
+            }
+        })
+    }
+}
+
+func TestRouterRouteDrops(t *testing.T) {
+    slow, fast := &recordingSink{}, &recordingSink{}
+    r := NewRouter(time.Second, discardLogger())
+    r.Add(slow, RouteOptions{QueueSize: 2})
+    r.Add(fast, RouteOptions{QueueSize: 5})
+    runStopped(r, 4)
+
+    stats := r.Stats()
+    if stats[0].Dropped != 2 || stats[0].Written != 2 {
+        t.Errorf("slow sink stats = %+v, want 2 dropped and 2 written", stats[0])
+    }
+    if stats[1].Dropped != 0 || stats[1].Written != 4 {
+        t.Errorf("fast sink stats = %+v, want nothing dropped and 4 written", stats[1])
+    }
+}
@@ -0,0 +1,345 @@
+package sink
+
+import (
+    "math"
+    "slices"
+    "sort"
+    "strconv"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+// series is one measurement of a sample with its tags and fields, the shape
+// shared by the InfluxDB and Graphite sinks.
+type series struct {
+    measurement string
+    tags        []tag
+    fields      []field
+}
+
+type tag struct {
+    key, value string
+}
+
+// field holds either a counter or a floating point value.
+type field struct {
+    key     string
+    count   uint64
+    value   float64
+    isCount bool
+}
+
+// countField clamps v to the signed 64-bit range. InfluxDB integers are
+// signed and one value out of range rejects the whole batch, and switching
+// the field to unsigned would clash with the points already stored.
+func countField(key string, v uint64) field {
+    return field{key: key, count: min(v, math.MaxInt64), isCount: true}
+}
+
+func valueField(key string, v float64) field { return field{key: key, value: v} }
+
+// customPrefix keeps the StatsD metrics apart from the agent's own
+// measurements, so an application metric named "cpu" cannot mix with them.
+const customPrefix = "statsd_"
+
+// hostTags returns the tags that identify the host on every series.
+func hostTags(h Host) []tag {
+    tags := []tag{{"host", h.Hostname}, {"host_id", h.UniqueID}}
+    if h.Virtualization != "" {
+        tags = append(tags, tag{"virtualization", h.Virtualization})
+    }
+    return tags
+}
+
+// flatten turns a sample into series. Only the topProcesses busiest
+// processes are included, 0 includes all of them.
+func flatten(s metrics.MetricsData, topProcesses int) []series {
+    // The total stays untagged, cores are tagged with their name
+    cpu := series{measurement: "cpu", fields: []field{valueField("usage_percent", s.CPUPercent)}}
+    if c := s.CPU; c != nil {
+        cpu.fields = append(cpu.fields, cpuTimeFields(c.Total)...)
+        cpu.fields = append(cpu.fields,
+            valueField("load1", c.Load1),
+            valueField("load5", c.Load5),
+            valueField("load15", c.Load15),
+            countField("context_switches", c.ContextSwitches),
+            countField("interrupts", c.Interrupts),
+            countField("procs_running", uint64(c.ProcsRunning)),
+            countField("procs_blocked", uint64(c.ProcsBlocked)),
+        )
+        if r := c.Rates; r != nil {
+            cpu.fields = append(cpu.fields,
+                valueField("context_switches_per_sec", r.ContextSwitchesPerSec),
+                valueField("interrupts_per_sec", r.InterruptsPerSec),
+            )
+        }
+    }
+    out := []series{cpu}
+    if s.ConnStats != nil {
+        out = append(out, series{measurement: "netconn", fields: []field{countField("count", uint64(len(s.ConnStats)))}})
+    }
+    if c := s.CPU; c != nil {
+        for _, core := range c.Cores {
+            out = append(out, series{
+                measurement: "cpu",
+                tags:        []tag{{"cpu", core.CPU}},
+                fields:      append([]field{valueField("usage_percent", core.Usage)}, cpuTimeFields(core)...),
+            })
+        }
+    }
+
+    if m := s.Memory; m != nil {
+        out = append(out, series{
+            measurement: "mem",
+            fields: []field{
+                countField("total", m.Total),
+                countField("available", m.Available),
+                countField("used", m.Used),
+                valueField("used_percent", m.UsedPercent),
+                countField("free", m.Free),
+                countField("buffers", m.Buffers),
+                countField("cached", m.Cached),
+                countField("slab", m.Slab),
+                countField("dirty", m.Dirty),
+                countField("writeback", m.Writeback),
+                countField("huge_pages_total", m.HugePagesTotal),
+                countField("huge_pages_free", m.HugePagesFree),
+                countField("huge_page_size", m.HugePageSize),
+            },
+        })
+
+        swap := []field{
+            countField("total", m.SwapTotal),
+            countField("used", m.SwapUsed),
+            countField("in", m.SwapIn),
+            countField("out", m.SwapOut),
+        }
+        if r := m.SwapRates; r != nil {
+            swap = append(swap, valueField("in_per_sec", r.InPerSec), valueField("out_per_sec", r.OutPerSec))
+        }
+        out = append(out, series{measurement: "swap", fields: swap})
+    }
+
+    if p := s.Pressure; p != nil {
+        for _, r := range []struct {
+            name string
+            stat *metrics.PressureStat
+        }{{"cpu", p.CPU}, {"memory", p.Memory}, {"io", p.IO}} {
+            if r.stat == nil {
+                continue
+            }
+            fields := pressureFields("some", r.stat.Some)
+            if r.stat.Full != nil {
+                fields = append(fields, pressureFields("full", *r.stat.Full)...)
+            }
+            out = append(out, series{
+                measurement: "pressure",
+                tags:        []tag{{"resource", r.name}},
+                fields:      fields,
+            })
+        }
+    }
+
+    for _, n := range s.NetworkStats {
+        fields := []field{
+            countField("bytes_sent", n.BytesSent),
+            countField("bytes_recv", n.BytesRecv),
+            countField("packets_sent", n.PacketsSent),
+            countField("packets_recv", n.PacketsRecv),
+            countField("err_in", n.ErrIn),
+            countField("err_out", n.ErrOut),
+            countField("drop_in", n.DropIn),
+            countField("drop_out", n.DropOut),
+            countField("fifo_in", n.FifoIn),
+            countField("fifo_out", n.FifoOut),
+        }
+        if r := n.Rates; r != nil {
+            fields = append(fields,
+                valueField("bytes_sent_per_sec", r.BytesSent),
+                valueField("bytes_recv_per_sec", r.BytesRecv),
+                valueField("packets_sent_per_sec", r.PacketsSent),
+                valueField("packets_recv_per_sec", r.PacketsRecv),
+            )
+        }
+        out = append(out, series{
+            measurement: "net",
+            tags:        []tag{{"interface", n.Name}},
+            fields:      fields,
+        })
+    }
+
+    devices := make([]string, 0, len(s.DiskIOStats))
+    for device := range s.DiskIOStats {
+        devices = append(devices, device)
+    }
+    sort.Strings(devices)
+    for _, device := range devices {
+        io := s.DiskIOStats[device]
+        fields := []field{
+            countField("read_bytes", io.ReadBytes),
+            countField("write_bytes", io.WriteBytes),
+            countField("reads", io.ReadCount),
+            countField("writes", io.WriteCount),
+            countField("io_time_ms", io.IoTime),
+            countField("weighted_io_time_ms", io.WeightedIO),
+            countField("iops_in_progress", io.IopsInProgress),
+        }
+        if r := io.Stats; r != nil {
+            fields = append(fields,
+                valueField("reads_per_sec", r.ReadsPerSec),
+                valueField("writes_per_sec", r.WritesPerSec),
+                valueField("merged_reads_per_sec", r.MergedReadsPerSec),
+                valueField("merged_writes_per_sec", r.MergedWritesPerSec),
+                valueField("read_bytes_per_sec", r.ReadBytesPerSec),
+                valueField("write_bytes_per_sec", r.WriteBytesPerSec),
+                valueField("read_await_ms", r.ReadAwait),
+                valueField("write_await_ms", r.WriteAwait),
+                valueField("await_ms", r.Await),
+                valueField("svctm_ms", r.ServiceTime),
+                valueField("queue_depth", r.QueueDepth),
+                valueField("util_percent", r.UtilPercent),
+            )
+        }
+        out = append(out, series{
+            measurement: "diskio",
+            tags:        []tag{{"device", device}},
+            fields:      fields,
+        })
+    }
+
+    for _, u := range s.DiskUsageInfo {
+        out = append(out, series{
+            measurement: "disk",
+            tags:        []tag{{"device", u.Device}, {"path", u.Mountpoint}},
+            fields: []field{
+                countField("total", u.Total),
+                countField("free", u.Free),
+                countField("used", u.Used),
+                valueField("used_percent", u.UsedPercent),
+            },
+        })
+    }
+
+    for _, p := range metrics.TopProcessesByCPU(s.ProcessInfo, topProcesses) {
+        tags := []tag{{"pid", strconv.Itoa(int(p.PID))}, {"process_name", p.Name}}
+        if p.Username != "" {
+            tags = append(tags, tag{"user", p.Username})
+        }
+        out = append(out, series{
+            measurement: "procstat",
+            tags:        tags,
+            fields:      processFields(p),
+        })
+    }
+
+    for _, m := range s.CustomMetrics {
+        sr := series{measurement: customPrefix + m.Name}
+        keys := make([]string, 0, len(m.Tags))
+        for key := range m.Tags {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            sr.tags = append(sr.tags, tag{key, m.Tags[key]})
+        }
+
+        if st := m.Stats; st != nil {
+            sr.fields = []field{
+                valueField("count", st.Count),
+                valueField("sum", st.Sum),
+                valueField("min", st.Min),
+                valueField("max", st.Max),
+                valueField("mean", st.Mean),
+                valueField("median", st.Median),
+                valueField("p90", st.P90),
+                valueField("p95", st.P95),
+                valueField("p99", st.P99),
+            }
+        } else {
+            sr.fields = []field{valueField(m.Type, m.Value)}
+        }
+        out = append(out, sr)
+    }
+
+    return finite(out)
+}
+
+// finite removes the NaN and infinite values neither backend can store, and
+// the series left without fields.
+func finite(out []series) []series {
+    kept := out[:0]
+    for _, sr := range out {
+        sr.fields = slices.DeleteFunc(sr.fields, func(f field) bool {
+            return !f.isCount && (math.IsNaN(f.value) || math.IsInf(f.value, 0))
+        })
+        if len(sr.fields) > 0 {
+            kept = append(kept, sr)
+        }
+    }
+    return kept
+}
+
+// pressureFields returns the fields of one PSI line, prefixed with its kind.
+func pressureFields(kind string, line metrics.PressureLine) []field {
+    return []field{
+        valueField(kind+"_avg10", line.Avg10),
+        valueField(kind+"_avg60", line.Avg60),
+        valueField(kind+"_avg300", line.Avg300),
+        countField(kind+"_total_us", line.Total),
+    }
+}
+
+// cpuTimeFields returns the time-state percentages of a CPU.
+func cpuTimeFields(t metrics.CPUTimes) []field {
+    return []field{
+        valueField("usage_user", t.User),
+        valueField("usage_nice", t.Nice),
+        valueField("usage_system", t.System),
+        valueField("usage_idle", t.Idle),
+        valueField("usage_iowait", t.Iowait),
+        valueField("usage_irq", t.Irq),
+        valueField("usage_softirq", t.Softirq),
+        valueField("usage_steal", t.Steal),
+        valueField("usage_guest", t.Guest),
+        valueField("usage_guest_nice", t.GuestNice),
+    }
+}
+
+// processFields returns the fields of a process, the optional ones only
+// when they were collected.
+func processFields(p metrics.ProcessInfo) []field {
+    fields := []field{
+        valueField("cpu_percent", p.CPUPercent),
+        countField("rss", p.MemoryUsage),
+    }
+    if p.VMS > 0 {
+        fields = append(fields, countField("vms", p.VMS), countField("swap", p.Swap))
+    }
+    if p.PPID > 0 {
+        fields = append(fields, countField("ppid", uint64(p.PPID)))
+    }
+    if p.CreateTime > 0 {
+        fields = append(fields, countField("created_at", uint64(p.CreateTime)))
+    }
+    if p.Threads > 0 {
+        fields = append(fields, countField("num_threads", uint64(p.Threads)))
+    }
+    if p.FDs > 0 {
+        fields = append(fields, countField("num_fds", uint64(p.FDs)))
+    }
+    if io := p.IO; io != nil {
+        fields = append(fields,
+            countField("read_count", io.ReadCount),
+            countField("write_count", io.WriteCount),
+            countField("read_bytes", io.ReadBytes),
+            countField("write_bytes", io.WriteBytes),
+        )
+    }
+    if ctx := p.CtxSwitches; ctx != nil {
+        fields = append(fields,
+            countField("voluntary_context_switches", uint64(ctx.Voluntary)),
+            countField("involuntary_context_switches", uint64(ctx.Involuntary)),
+        )
+    }
+    return fields
+}
@@ -0,0 +1,30 @@
+// Package sink defines the destinations collected samples are written to and
+// the router that fans every sample out to them.
+package sink
+
+import (
+    "context"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+// Sink delivers samples to one destination.
+type Sink interface {
+    // Name identifies the sink in logs and configuration.
+    Name() string
+    // Write delivers the samples, oldest first.
+    Write(ctx context.Context, samples []metrics.MetricsData) error
+}
+
+// Host describes the machine the agent runs on. Sinks use it to label or tag
+// every sample they write.
+type Host struct {
+    Hostname       string
+    FQDN           string
+    IP             string
+    UniqueID       string
+    IsVirtual      bool
+    Virtualization string    // Virtualization system, e.g. "kvm", if known
+    BootTime       time.Time // Start of the cumulative counters
+}
@@ -0,0 +1,35 @@
+package sink
+
+import (
+    "context"
+    "encoding/json"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+    "github.com/dickiesanders/go-agent/internal/spool"
+)
+
+// Spool writes samples to the on-disk buffer that the API uploader pushes
+// from, so the API is one destination among the others.
+type Spool struct {
+    buffer *spool.Spool
+}
+
+// NewSpool returns a sink appending to buffer.
+func NewSpool(buffer *spool.Spool) *Spool {
+    return &Spool{buffer: buffer}
+}
+
+func (s *Spool) Name() string { return "api" }
+
+func (s *Spool) Write(ctx context.Context, samples []metrics.MetricsData) error {
+    for _, sample := range samples {
+        record, err := json.Marshal(sample)
+        if err != nil {
+            return err
+        }
+        if err := s.buffer.Append(record); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,239 @@
+// Package spool implements a disk-backed queue of encoded samples so that
+// collected metrics survive agent restarts and API outages.
+//
+// Each record is stored in its own file named after the time it was written,
+// so the directory listing is also the replay order. Records stay on disk
+// until they are acknowledged or pushed out by the size and age caps.
+package spool
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const recordExt = ".json"
+
+// Options limits how much data the spool keeps.
+type Options struct {
+    MaxBytes int64         // Oldest records are dropped beyond this size, 0 means unlimited
+    MaxAge   time.Duration // Records older than this are dropped, 0 means forever
+    Logger   *slog.Logger  // Defaults to slog.Default()
+}
+
+// Record is one spooled sample.
+type Record struct {
+    ID      string
+    Written time.Time
+    Data    []byte
+}
+
+type entry struct {
+    name    string
+    written time.Time
+    size    int64
+}
+
+// Spool is a directory of pending records, oldest first.
+type Spool struct {
+    mu      sync.Mutex
+    dir     string
+    opts    Options
+    entries []entry
+    size    int64
+    seq     uint64
+}
+
+// Open loads the spool in dir, creating the directory if needed.
+func Open(dir string, opts Options) (*Spool, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("creating spool directory: %w", err)
+    }
+
+    if opts.Logger == nil {
+        opts.Logger = slog.Default()
+    }
+    s := &Spool{dir: dir, opts: opts}
+
+    files, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, fmt.Errorf("reading spool directory: %w", err)
+    }
+    for _, f := range files {
+        name := f.Name()
+        if f.IsDir() {
+            continue
+        }
+        // Leftovers of a write interrupted by a crash
+        if strings.HasSuffix(name, ".tmp") {
+            os.Remove(filepath.Join(dir, name))
+            continue
+        }
+        written, ok := parseName(name)
+        if !ok {
+            continue
+        }
+        info, err := f.Info()
+        if err != nil {
+            continue
+        }
+        s.entries = append(s.entries, entry{name: name, written: written, size: info.Size()})
+        s.size += info.Size()
+    }
+    sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].name < s.entries[j].name })
+
+    s.mu.Lock()
+    s.prune(time.Now())
+    s.mu.Unlock()
+
+    return s, nil
+}
+
+// Append writes data as a new record at the end of the spool.
+func (s *Spool) Append(data []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    s.seq++
+    name := fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.seq%1000000, recordExt)
+    path := filepath.Join(s.dir, name)
+
+    // Write to a temporary file first so a crash never leaves a partial record
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("writing spool record: %w", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("committing spool record: %w", err)
+    }
+
+    s.entries = append(s.entries, entry{name: name, written: now, size: int64(len(data))})
+    s.size += int64(len(data))
+    s.prune(now)
+    return nil
+}
+
+// Pending returns up to limit of the oldest unacknowledged records in the
+// order they were written. A limit of 0 returns all of them.
+func (s *Spool) Pending(limit int) ([]Record, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.prune(time.Now())
+
+    var records []Record
+    var unreadable []string
+    for _, e := range s.entries {
+        if limit > 0 && len(records) >= limit {
+            break
+        }
+        data, err := os.ReadFile(filepath.Join(s.dir, e.name))
+        if err != nil {
+            s.opts.Logger.Warn("Dropping unreadable spool record", "record", e.name, "err", err)
+            unreadable = append(unreadable, e.name)
+            continue
+        }
+        records = append(records, Record{ID: e.name, Written: e.written, Data: data})
+    }
+    s.remove(unreadable...)
+
+    return records, nil
+}
+
+// Ack removes records that have been delivered.
+func (s *Spool) Ack(ids ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.remove(ids...)
+}
+
+// Len returns the number of pending records.
+func (s *Spool) Len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return len(s.entries)
+}
+
+// Size returns the total size of pending records in bytes.
+func (s *Spool) Size() int64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.size
+}
+
+// prune drops expired records and then the oldest ones until the spool fits
+// in MaxBytes. Must be called with mu held.
+func (s *Spool) prune(now time.Time) {
+    var drop []string
+    var dropped int64
+    for _, e := range s.entries {
+        expired := s.opts.MaxAge > 0 && now.Sub(e.written) > s.opts.MaxAge
+        oversize := s.opts.MaxBytes > 0 && s.size-dropped > s.opts.MaxBytes
+        if !expired && !oversize {
+            break
+        }
+        drop = append(drop, e.name)
+        dropped += e.size
+    }
+    if len(drop) == 0 {
+        return
+    }
+
+    s.opts.Logger.Warn("Dropping spooled records over the size or age limit", "records", len(drop), "bytes", dropped)
+    s.remove(drop...)
+}
+
+// remove deletes the named records. Must be called with mu held.
+func (s *Spool) remove(names ...string) error {
+    if len(names) == 0 {
+        return nil
+    }
+
+    doomed := make(map[string]bool, len(names))
+    for _, name := range names {
+        doomed[name] = true
+    }
+
+    var firstErr error
+    kept := s.entries[:0]
+    for _, e := range s.entries {
+        if !doomed[e.name] {
+            kept = append(kept, e)
+            continue
+        }
+        if err := os.Remove(filepath.Join(s.dir, e.name)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+            firstErr = fmt.Errorf("removing spool record: %w", err)
+        }
+        s.size -= e.size
+    }
+    s.entries = kept
+    return firstErr
+}
+
+// parseName extracts the write time from a record file name.
+func parseName(name string) (time.Time, bool) {
+    if !strings.HasSuffix(name, recordExt) {
+        return time.Time{}, false
+    }
+    stamp, _, ok := strings.Cut(strings.TrimSuffix(name, recordExt), "-")
+    if !ok {
+        return time.Time{}, false
+    }
+    nanos, err := strconv.ParseInt(stamp, 10, 64)
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix(0, nanos), true
+}
@@ -0,0 +1,144 @@
+package spool
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "slices"
+    "testing"
+    "time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func open(t *testing.T, dir string, opts Options) *Spool {
+    t.Helper()
+    opts.Logger = quiet
+    s, err := Open(dir, opts)
+    if err != nil {
+        t.Fatalf("Open() error = %v", err)
+    }
+    return s
+}
+
+func appendAll(t *testing.T, s *Spool, data ...string) {
+    t.Helper()
+    for _, d := range data {
+        if err := s.Append([]byte(d)); err != nil {
+            t.Fatalf("Append(%q) error = %v", d, err)
+        }
+    }
+}
+
+func pendingData(t *testing.T, s *Spool, limit int) []string {
+    t.Helper()
+    records, err := s.Pending(limit)
+    if err != nil {
+        t.Fatalf("Pending() error = %v", err)
+    }
+    var data []string
+    for _, r := range records {
+        data = append(data, string(r.Data))
+    }
+    return data
+}
+
+func TestOrderSurvivesReopen(t *testing.T) {
+    dir := t.TempDir()
+    s := open(t, dir, Options{})
+    appendAll(t, s, "a", "b", "c", "d")
+
+    if got, want := pendingData(t, s, 2), []string{"a", "b"}; !slices.Equal(got, want) {
+        t.Errorf("Pending(2) = %q, want %q", got, want)
+    }
+
+    // Leftovers of an interrupted write and foreign files are not records
+    os.WriteFile(filepath.Join(dir, "00000000000000000001-000001.json.tmp"), []byte("partial"), 0600)
+    os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0600)
+
+    s = open(t, dir, Options{})
+    if got, want := pendingData(t, s, 0), []string{"a", "b", "c", "d"}; !slices.Equal(got, want) {
+        t.Errorf("Pending(0) after reopen = %q, want %q", got, want)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "00000000000000000001-000001.json.tmp")); !os.IsNotExist(err) {
+        t.Errorf("temporary file was not removed on open")
+    }
+}
+
+func TestAck(t *testing.T) {
+    dir := t.TempDir()
+    s := open(t, dir, Options{})
+    appendAll(t, s, "a", "bb", "ccc")
+
+    records, _ := s.Pending(0)
+    if err := s.Ack(records[0].ID, records[2].ID); err != nil {
+        t.Fatalf("Ack() error = %v", err)
+    }
+    if got, want := pendingData(t, s, 0), []string{"bb"}; !slices.Equal(got, want) {
+        t.Errorf("Pending() after Ack = %q, want %q", got, want)
+    }
+    if s.Len() != 1 || s.Size() != 2 {
+        t.Errorf("Len(), Size() = %d, %d, want 1, 2", s.Len(), s.Size())
+    }
+
+    // Acknowledged records stay gone after a restart, acking twice is fine
+    if err := s.Ack(records[0].ID); err != nil {
+        t.Errorf("second Ack() error = %v", err)
+    }
+    s = open(t, dir, Options{})
+    if got, want := pendingData(t, s, 0), []string{"bb"}; !slices.Equal(got, want) {
+        t.Errorf("Pending() after reopen = %q, want %q", got, want)
+    }
+}
+
+func TestPruneMaxBytes(t *testing.T) {
+    s := open(t, t.TempDir(), Options{MaxBytes: 10})
+    appendAll(t, s, "1111", "2222", "3333")
+
+    if got, want := pendingData(t, s, 0), []string{"2222", "3333"}; !slices.Equal(got, want) {
+        t.Errorf("Pending() = %q, want %q", got, want)
+    }
+    if s.Size() != 8 {
+        t.Errorf("Size() = %d, want 8", s.Size())
+    }
+}
+
+func TestPruneMaxAge(t *testing.T) {
+    dir := t.TempDir()
+    old := time.Now().Add(-2 * time.Hour)
+    name := fmt.Sprintf("%020d-%06d%s", old.UnixNano(), 1, recordExt)
+    if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    s := open(t, dir, Options{MaxAge: time.Hour})
+    appendAll(t, s, "new")
+    if got, want := pendingData(t, s, 0), []string{"new"}; !slices.Equal(got, want) {
+        t.Errorf("Pending() = %q, want %q", got, want)
+    }
+    if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+        t.Errorf("expired record was not deleted")
+    }
+}
+
+func TestParseName(t *testing.T) {
+    tests := []struct {
+        name string
+        want int64
+        ok   bool
+    }{
+        {"00000000000000001000-000001.json", 1000, true},
+        {"00000000000000001000-000001.json.tmp", 0, false},
+        {"00000000000000001000.json", 0, false},
+        {"abc-000001.json", 0, false},
+        {"registration.json", 0, false},
+    }
+    for _, tt := range tests {
+        got, ok := parseName(tt.name)
+        if ok != tt.ok || ok && got.UnixNano() != tt.want {
+            t.Errorf("parseName(%q) = %v, %v, want %d, %v", tt.name, got.UnixNano(), ok, tt.want, tt.ok)
+        }
+    }
+}
@@ -0,0 +1,222 @@
+package statsd
+
+import (
+    "math"
+    "math/rand"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+// series accumulates one metric, identified by name, kind and tags.
+type series struct {
+    name    string
+    kind    string
+    tags    map[string]string
+    value   float64 // Counter total or gauge value
+    updated bool    // Gauges keep their value but are only reported when updated
+    idle    int     // Flushes since a gauge was last updated
+    members map[string]struct{}
+    values  []float64 // Sample of at most maxValues values for percentiles
+    count   float64
+    seen    int // Values received, including those not kept
+    sum     float64
+    min     float64
+    max     float64
+}
+
+// maxValues caps the values kept per timer, histogram or distribution
+// between flushes. Beyond it a uniform random sample is kept for the
+// percentiles, while count, sum, min and max stay exact.
+const maxValues = 1000
+
+// observe records one value of a timer, histogram or distribution. It
+// reports false when the value was not kept for the percentiles.
+func (s *series) observe(v float64) bool {
+    if s.seen == 0 || v < s.min {
+        s.min = v
+    }
+    if s.seen == 0 || v > s.max {
+        s.max = v
+    }
+    s.sum += v
+    s.seen++
+
+    if len(s.values) < maxValues {
+        s.values = append(s.values, v)
+        return true
+    }
+    // Reservoir sampling: every value so far is kept with equal chance
+    if i := rand.Intn(s.seen); i < maxValues {
+        s.values[i] = v
+    }
+    return false
+}
+
+// gaugeExpiry is how many flushes a gauge is kept without updates, so that
+// gauges with short-lived tags do not pile up.
+const gaugeExpiry = 10
+
+// Aggregator combines samples until they are flushed.
+type Aggregator struct {
+    mu        sync.Mutex
+    series    map[string]*series
+    maxSeries int
+    active    int // Series updated since the last flush
+    dropped   int
+    sampled   int // Values left out of the percentiles by maxValues
+}
+
+// NewAggregator returns an aggregator that tracks at most maxSeries distinct
+// metrics between flushes. Zero means no limit. Gauges kept from earlier
+// flushes only count once they are updated again.
+func NewAggregator(maxSeries int) *Aggregator {
+    return &Aggregator{
+        series:    map[string]*series{},
+        maxSeries: maxSeries,
+    }
+}
+
+func (a *Aggregator) add(samples []sample) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    for _, smp := range samples {
+        key := seriesKey(smp)
+        s, ok := a.series[key]
+        if !ok || !s.updated {
+            if a.maxSeries > 0 && a.active >= a.maxSeries {
+                a.dropped++
+                continue
+            }
+            if !ok {
+                s = &series{name: smp.name, kind: smp.kind, tags: smp.tags}
+                a.series[key] = s
+            }
+            a.active++
+        }
+
+        switch smp.kind {
+        case KindCounter:
+            s.value += smp.value / smp.rate
+        case KindGauge:
+            if smp.delta {
+                s.value += smp.value
+            } else {
+                s.value = smp.value
+            }
+        case KindSet:
+            if s.members == nil {
+                s.members = map[string]struct{}{}
+            }
+            s.members[smp.member] = struct{}{}
+        default:
+            if !s.observe(smp.value) {
+                a.sampled++
+            }
+            s.count += 1 / smp.rate
+        }
+        s.updated = true
+    }
+}
+
+// Flush returns the aggregates since the previous flush and starts over.
+// It also returns how many samples were dropped because of the series limit
+// and how many values were left out of percentiles because of maxValues.
+func (a *Aggregator) Flush() ([]metrics.CustomMetric, int, int) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    keys := make([]string, 0, len(a.series))
+    for key := range a.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    var out []metrics.CustomMetric
+    for _, key := range keys {
+        s := a.series[key]
+        if !s.updated {
+            s.idle++
+            if s.idle >= gaugeExpiry {
+                delete(a.series, key)
+            }
+            continue
+        }
+
+        m := metrics.CustomMetric{Name: s.name, Type: s.kind, Tags: s.tags}
+        switch s.kind {
+        case KindCounter:
+            m.Value = s.value
+        case KindGauge:
+            m.Value = s.value
+        case KindSet:
+            m.Value = float64(len(s.members))
+        default:
+            m.Stats = summarize(s)
+        }
+        out = append(out, m)
+
+        // Gauges keep their value so later changes apply to it
+        if s.kind == KindGauge {
+            s.updated = false
+            s.idle = 0
+        } else {
+            delete(a.series, key)
+        }
+    }
+
+    dropped, sampled := a.dropped, a.sampled
+    a.active = 0
+    a.dropped = 0
+    a.sampled = 0
+    return out, dropped, sampled
+}
+
+// summarize computes the statistics of a timer, histogram or distribution,
+// using nearest-rank percentiles over the kept values.
+func summarize(s *series) *metrics.DistributionStats {
+    values := s.values
+    sort.Float64s(values)
+    stats := &metrics.DistributionStats{
+        Count: s.count,
+        Sum:   s.sum,
+        Min:   s.min,
+        Max:   s.max,
+        Mean:  s.sum / float64(s.seen),
+    }
+    stats.Median = percentile(values, 50)
+    stats.P90 = percentile(values, 90)
+    stats.P95 = percentile(values, 95)
+    stats.P99 = percentile(values, 99)
+    return stats
+}
+
+func percentile(sorted []float64, p float64) float64 {
+    rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+    if rank < 1 {
+        rank = 1
+    }
+    return sorted[rank-1]
+}
+
+// seriesKey identifies a series by name, kind and sorted tags.
+func seriesKey(s sample) string {
+    var b strings.Builder
+    b.WriteString(s.name)
+    b.WriteByte('|')
+    b.WriteString(s.kind)
+
+    tags := make([]string, 0, len(s.tags))
+    for key, value := range s.tags {
+        tags = append(tags, key+":"+value)
+    }
+    sort.Strings(tags)
+    for _, t := range tags {
+        b.WriteByte('|')
+        b.WriteString(t)
+    }
+    return b.String()
+}
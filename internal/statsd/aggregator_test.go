@@ -0,0 +1,192 @@
+package statsd
+
+import (
+    "testing"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+func TestPercentile(t *testing.T) {
+    sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+    tests := []struct {
+        p    float64
+        want float64
+    }{
+        {0, 1},
+        {10, 1},
+        {11, 2},
+        {50, 5},
+        {90, 9},
+        {95, 10},
+        {99, 10},
+        {100, 10},
+    }
+    for _, tt := range tests {
+        if got := percentile(sorted, tt.p); got != tt.want {
+            t.Errorf("percentile(1..10, %v) = %v, want %v", tt.p, got, tt.want)
+        }
+    }
+
+    if got := percentile([]float64{42}, 99); got != 42 {
+        t.Errorf("percentile([42], 99) = %v, want 42", got)
+    }
+}
+
+func TestSummarize(t *testing.T) {
+    s := &series{}
+    for _, v := range []float64{30, 10, 20, 40} {
+        s.observe(v)
+    }
+    s.count = 8
+    got := summarize(s)
+    want := metrics.DistributionStats{
+        Count:  8,
+        Sum:    100,
+        Min:    10,
+        Max:    40,
+        Mean:   25,
+        Median: 20,
+        P90:    40,
+        P95:    40,
+        P99:    40,
+    }
+    if *got != want {
+        t.Errorf("summarize() = %+v, want %+v", *got, want)
+    }
+}
+
+// feed parses lines into the aggregator, failing the test on bad lines.
+func feed(t *testing.T, a *Aggregator, lines ...string) {
+    t.Helper()
+    for _, line := range lines {
+        samples, err := parseLine(line)
+        if err != nil {
+            t.Fatalf("parseLine(%q) error = %v", line, err)
+        }
+        a.add(samples)
+    }
+}
+
+func byName(out []metrics.CustomMetric) map[string]metrics.CustomMetric {
+    m := map[string]metrics.CustomMetric{}
+    for _, c := range out {
+        m[c.Name] = c
+    }
+    return m
+}
+
+func TestAggregatorFlush(t *testing.T) {
+    a := NewAggregator(0)
+    feed(t, a,
+        "hits:1|c", "hits:2|c|@0.5",
+        "temp:20|g", "temp:+5|g",
+        "users:alice|s", "users:bob|s", "users:alice|s",
+        "lat:10:20:30|ms",
+    )
+
+    got := byName(mustFlush(t, a, 0))
+    if v := got["hits"].Value; v != 5 {
+        t.Errorf("counter = %v, want 5", v)
+    }
+    if v := got["temp"].Value; v != 25 {
+        t.Errorf("gauge = %v, want 25", v)
+    }
+    if v := got["users"].Value; v != 2 {
+        t.Errorf("set = %v, want 2", v)
+    }
+    if s := got["lat"].Stats; s == nil || s.Count != 3 || s.Mean != 20 {
+        t.Errorf("timer stats = %+v, want count 3 and mean 20", s)
+    }
+
+    // Counters, sets and timers start over, gauges keep their value but are
+    // only reported again once updated
+    if out := mustFlush(t, a, 0); len(out) != 0 {
+        t.Errorf("second Flush() = %+v, want nothing", out)
+    }
+    feed(t, a, "temp:-3|g")
+    if got := byName(mustFlush(t, a, 0)); got["temp"].Value != 22 {
+        t.Errorf("gauge after delta = %v, want 22", got["temp"].Value)
+    }
+}
+
+func TestAggregatorSeriesLimit(t *testing.T) {
+    a := NewAggregator(2)
+    feed(t, a, "a:1|c", "b:1|c", "c:1|c", "a:1|c")
+    if out := mustFlush(t, a, 1); len(out) != 2 {
+        t.Errorf("Flush() = %+v, want a and b", out)
+    }
+
+    // Gauges that were not updated since the last flush do not count
+    feed(t, a, "g1:1|g", "g2:1|g")
+    mustFlush(t, a, 0)
+    feed(t, a, "c:1|c", "d:1|c", "g1:2|g")
+    if out := mustFlush(t, a, 1); len(out) != 2 {
+        t.Errorf("Flush() = %+v, want c and d", out)
+    }
+}
+
+func TestAggregatorGaugeExpiry(t *testing.T) {
+    a := NewAggregator(0)
+    feed(t, a, "temp:20|g")
+    for i := 0; i < gaugeExpiry; i++ {
+        mustFlush(t, a, 0)
+    }
+    if _, ok := a.series[seriesKey(sample{name: "temp", kind: KindGauge})]; !ok {
+        t.Fatalf("gauge expired after %d idle flushes, want it kept", gaugeExpiry-1)
+    }
+    mustFlush(t, a, 0)
+    if len(a.series) != 0 {
+        t.Fatalf("gauge kept after %d idle flushes", gaugeExpiry)
+    }
+
+    // An expired gauge starts from scratch, so deltas apply to zero
+    feed(t, a, "temp:+1|g")
+    if got := byName(mustFlush(t, a, 0)); got["temp"].Value != 1 {
+        t.Errorf("expired gauge after delta = %v, want 1", got["temp"].Value)
+    }
+}
+
+func TestAggregatorValueCap(t *testing.T) {
+    a := NewAggregator(0)
+    for i := 1; i <= 3*maxValues; i++ {
+        a.add([]sample{{name: "lat", kind: KindTimer, value: float64(i), rate: 1}})
+    }
+    if got := len(a.series[seriesKey(sample{name: "lat", kind: KindTimer})].values); got != maxValues {
+        t.Errorf("kept %d values, want %d", got, maxValues)
+    }
+
+    out, _, sampled := a.Flush()
+    if sampled != 2*maxValues {
+        t.Errorf("Flush() sampled %d values, want %d", sampled, 2*maxValues)
+    }
+    // Everything but the percentiles is still exact
+    s := out[0].Stats
+    n := float64(3 * maxValues)
+    if s.Count != n || s.Min != 1 || s.Max != n || s.Sum != n*(n+1)/2 || s.Mean != (n+1)/2 {
+        t.Errorf("stats = %+v, want exact count, min, max, sum and mean", s)
+    }
+    if s.Median < s.Min || s.P99 > s.Max || s.Median > s.P99 {
+        t.Errorf("percentiles out of order: %+v", s)
+    }
+}
+
+func TestSeriesKeyTagOrder(t *testing.T) {
+    a := sample{name: "hits", kind: KindCounter, tags: map[string]string{"a": "1", "b": "2"}}
+    b := sample{name: "hits", kind: KindCounter, tags: map[string]string{"b": "2", "a": "1"}}
+    if seriesKey(a) != seriesKey(b) {
+        t.Errorf("seriesKey depends on tag order: %q != %q", seriesKey(a), seriesKey(b))
+    }
+    gauge := sample{name: "hits", kind: KindGauge, tags: a.tags}
+    if seriesKey(a) == seriesKey(gauge) {
+        t.Errorf("counter and gauge share the key %q", seriesKey(a))
+    }
+}
+
+func mustFlush(t *testing.T, a *Aggregator, wantDropped int) []metrics.CustomMetric {
+    t.Helper()
+    out, dropped, _ := a.Flush()
+    if dropped != wantDropped {
+        t.Errorf("Flush() dropped %d samples, want %d", dropped, wantDropped)
+    }
+    return out
+}
@@ -0,0 +1,119 @@
+// Package statsd receives custom metrics from local applications over the
+// StatsD and DogStatsD protocols and aggregates them between collections.
+package statsd
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Metric kinds as reported in metrics.CustomMetric.Type.
+const (
+    KindCounter      = "counter"
+    KindGauge        = "gauge"
+    KindTimer        = "timer"
+    KindHistogram    = "histogram"
+    KindDistribution = "distribution"
+    KindSet          = "set"
+)
+
+var kinds = map[string]string{
+    "c":  KindCounter,
+    "g":  KindGauge,
+    "ms": KindTimer,
+    "h":  KindHistogram,
+    "d":  KindDistribution,
+    "s":  KindSet,
+}
+
+var errMalformed = errors.New("malformed statsd line")
+
+// sample is one value parsed from a line.
+type sample struct {
+    name   string
+    kind   string
+    value  float64
+    member string  // Set member
+    delta  bool    // Gauge change instead of a new value
+    rate   float64 // Sample rate, 1 when not given
+    tags   map[string]string
+}
+
+// parseLine parses one line of the form
+//
+//	name:value[:value...]|type[|@rate][|#tag:value,tag...]
+//
+// DogStatsD events and service checks are accepted and ignored.
+func parseLine(line string) ([]sample, error) {
+    if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+        return nil, nil
+    }
+
+    name, rest, ok := strings.Cut(line, ":")
+    if !ok || name == "" {
+        return nil, fmt.Errorf("%w: %q", errMalformed, line)
+    }
+    fields := strings.Split(rest, "|")
+    if len(fields) < 2 {
+        return nil, fmt.Errorf("%w: %q", errMalformed, line)
+    }
+
+    kind, ok := kinds[fields[1]]
+    if !ok {
+        return nil, fmt.Errorf("%w: unknown type %q", errMalformed, fields[1])
+    }
+
+    rate := 1.0
+    var tags map[string]string
+    for _, f := range fields[2:] {
+        switch {
+        case strings.HasPrefix(f, "@"):
+            r, err := strconv.ParseFloat(f[1:], 64)
+            // Written so that NaN fails too
+            if err != nil || !(r > 0 && r <= 1) {
+                return nil, fmt.Errorf("%w: bad sample rate %q", errMalformed, f)
+            }
+            rate = r
+        case strings.HasPrefix(f, "#"):
+            tags = parseTags(f[1:])
+        default:
+            // Container IDs, timestamps and future extensions
+        }
+    }
+
+    // DogStatsD packs several values of the same metric into one line
+    var samples []sample
+    for _, raw := range strings.Split(fields[0], ":") {
+        s := sample{name: name, kind: kind, rate: rate, tags: tags}
+        if kind == KindSet {
+            s.member = raw
+        } else {
+            // NaN and infinities cannot be encoded in JSON or line protocol
+            v, err := strconv.ParseFloat(raw, 64)
+            if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+                return nil, fmt.Errorf("%w: bad value %q", errMalformed, raw)
+            }
+            s.value = v
+            s.delta = kind == KindGauge && (raw[0] == '+' || raw[0] == '-')
+        }
+        samples = append(samples, s)
+    }
+    return samples, nil
+}
+
+// parseTags splits "key:value,flag" into a map. Tags without a value map to
+// the empty string.
+func parseTags(s string) map[string]string {
+    tags := map[string]string{}
+    for _, t := range strings.Split(s, ",") {
+        if t == "" {
+            continue
+        }
+        key, value, _ := strings.Cut(t, ":")
+        tags[key] = value
+    }
+    return tags
+}
@@ -0,0 +1,75 @@
+package statsd
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestParseLine(t *testing.T) {
+    tests := []struct {
+        line string
+        want []sample
+    }{
+        {"hits:1|c", []sample{{name: "hits", kind: KindCounter, value: 1, rate: 1}}},
+        {"hits:3|c|@0.5", []sample{{name: "hits", kind: KindCounter, value: 3, rate: 0.5}}},
+        {"temp:21.5|g", []sample{{name: "temp", kind: KindGauge, value: 21.5, rate: 1}}},
+        {"temp:+2|g", []sample{{name: "temp", kind: KindGauge, value: 2, delta: true, rate: 1}}},
+        {"temp:-2|g", []sample{{name: "temp", kind: KindGauge, value: -2, delta: true, rate: 1}}},
+        {"db.query:12|ms", []sample{{name: "db.query", kind: KindTimer, value: 12, rate: 1}}},
+        {"size:5|h", []sample{{name: "size", kind: KindHistogram, value: 5, rate: 1}}},
+        {"users:alice|s", []sample{{name: "users", kind: KindSet, member: "alice", rate: 1}}},
+        {"lat:1:2:3|d", []sample{
+            {name: "lat", kind: KindDistribution, value: 1, rate: 1},
+            {name: "lat", kind: KindDistribution, value: 2, rate: 1},
+            {name: "lat", kind: KindDistribution, value: 3, rate: 1},
+        }},
+        {"hits:1|c|#env:prod,canary", []sample{{
+            name: "hits", kind: KindCounter, value: 1, rate: 1,
+            tags: map[string]string{"env": "prod", "canary": ""},
+        }}},
+        {"hits:1|c|@0.1|#env:prod|c:abc123|T1700000000", []sample{{
+            name: "hits", kind: KindCounter, value: 1, rate: 0.1,
+            tags: map[string]string{"env": "prod"},
+        }}},
+        {"_e{5,4}:title|text", nil},
+        {"_sc|check|0", nil},
+    }
+    for _, tt := range tests {
+        got, err := parseLine(tt.line)
+        if err != nil {
+            t.Errorf("parseLine(%q) error = %v", tt.line, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+        }
+    }
+}
+
+func TestParseLineMalformed(t *testing.T) {
+    for _, line := range []string{
+        "",
+        "hits",
+        ":1|c",
+        "hits:1",
+        "hits:1|x",
+        "hits:abc|c",
+        "hits:|c",
+        "hits:1:two|d",
+        "hits:1|c|@0",
+        "hits:1|c|@1.5",
+        "hits:1|c|@often",
+        "hits:1|c|@NaN",
+        "temp:NaN|g",
+        "temp:nan|g",
+        "temp:Inf|g",
+        "temp:+Inf|g",
+        "temp:-Inf|g",
+        "lat:1:Infinity|d",
+    } {
+        if _, err := parseLine(line); !errors.Is(err, errMalformed) {
+            t.Errorf("parseLine(%q) error = %v, want errMalformed", line, err)
+        }
+    }
+}
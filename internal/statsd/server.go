@@ -0,0 +1,118 @@
+package statsd
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/dickiesanders/go-agent/internal/metrics"
+)
+
+// maxPacketSize is the largest datagram the server reads.
+const maxPacketSize = 65535
+
+// Server receives StatsD datagrams over UDP or a Unix socket and aggregates
+// them. It is also the collector that moves the aggregates into each sample,
+// so custom metrics travel the same way as the host metrics.
+type Server struct {
+    agg       *Aggregator
+    every     time.Duration
+    malformed atomic.Int64
+    logger    *slog.Logger
+}
+
+// NewServer returns a server that keeps at most maxSeries distinct metrics
+// between flushes and flushes every flushInterval, or on every collection
+// tick when it is zero.
+func NewServer(maxSeries int, flushInterval time.Duration, logger *slog.Logger) *Server {
+    return &Server{
+        agg:    NewAggregator(maxSeries),
+        every:  flushInterval,
+        logger: logger,
+    }
+}
+
+func (s *Server) Name() string            { return "statsd" }
+func (s *Server) Interval() time.Duration { return s.every }
+
+// Collect flushes the aggregates into data.
+func (s *Server) Collect(ctx context.Context, data *metrics.MetricsData) error {
+    custom, dropped, sampled := s.agg.Flush()
+    data.CustomMetrics = custom
+
+    if dropped > 0 {
+        s.logger.Warn("Dropped StatsD samples over the series limit", "samples", dropped)
+    }
+    if sampled > 0 {
+        s.logger.Warn("Left StatsD values out of percentiles over the per-series limit", "values", sampled, "limit", maxValues)
+    }
+    if malformed := s.malformed.Swap(0); malformed > 0 {
+        s.logger.Warn("Ignored malformed StatsD lines", "lines", malformed)
+    }
+    return nil
+}
+
+// ListenUDP receives datagrams on addr until ctx is done.
+func (s *Server) ListenUDP(ctx context.Context, addr string) error {
+    conn, err := net.ListenPacket("udp", addr)
+    if err != nil {
+        return err
+    }
+    s.logger.Info("Listening for StatsD", "network", "udp", "address", addr)
+    return s.serve(ctx, conn)
+}
+
+// ListenUnix receives datagrams on a Unix socket at path until ctx is done.
+// A stale socket left behind by a previous run is replaced.
+func (s *Server) ListenUnix(ctx context.Context, path string) error {
+    if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+        os.Remove(path)
+    }
+    conn, err := net.ListenPacket("unixgram", path)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(path)
+    s.logger.Info("Listening for StatsD", "network", "unixgram", "address", path)
+    return s.serve(ctx, conn)
+}
+
+func (s *Server) serve(ctx context.Context, conn net.PacketConn) error {
+    go func() {
+        <-ctx.Done()
+        conn.Close()
+    }()
+
+    buf := make([]byte, maxPacketSize)
+    for {
+        n, _, err := conn.ReadFrom(buf)
+        if err != nil {
+            if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+                return nil
+            }
+            return err
+        }
+        s.handlePacket(string(buf[:n]))
+    }
+}
+
+// handlePacket aggregates every line of a datagram.
+func (s *Server) handlePacket(packet string) {
+    for _, line := range strings.Split(packet, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        samples, err := parseLine(line)
+        if err != nil {
+            s.malformed.Add(1)
+            continue
+        }
+        s.agg.add(samples)
+    }
+}
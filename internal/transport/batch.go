@@ -0,0 +1,94 @@
+package transport
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+)
+
+// Limits of a single SQS SendMessageBatch call.
+const (
+    SQSMaxBatchEntries = 10
+    SQSMaxBatchBytes   = 256 << 10
+)
+
+// EnvelopeVersion is bumped whenever the batch format changes incompatibly.
+const EnvelopeVersion = 1
+
+// Envelope carries many samples in one upload.
+type Envelope struct {
+    Version int               `json:"version"`
+    Count   int               `json:"count"`
+    Samples []json.RawMessage `json:"samples"`
+}
+
+// NewEnvelope wraps already encoded samples.
+func NewEnvelope(samples []json.RawMessage) Envelope {
+    return Envelope{
+        Version: EnvelopeVersion,
+        Count:   len(samples),
+        Samples: samples,
+    }
+}
+
+// envelopeOverhead is a generous estimate of the bytes an envelope adds around
+// its samples, including the {"message": ...} wrapper used by the gateway.
+const envelopeOverhead = 128
+
+// BatchLimits bounds the size of one upload. Zero means no limit.
+type BatchLimits struct {
+    MaxSamples int
+    MaxBytes   int
+}
+
+// Min returns limits that satisfy both l and other.
+func (l BatchLimits) Min(other BatchLimits) BatchLimits {
+    return BatchLimits{
+        MaxSamples: minLimit(l.MaxSamples, other.MaxSamples),
+        MaxBytes:   minLimit(l.MaxBytes, other.MaxBytes),
+    }
+}
+
+func minLimit(a, b int) int {
+    if a == 0 || (b != 0 && b < a) {
+        return b
+    }
+    return a
+}
+
+// PlanBatches splits samples of the given encoded sizes into consecutive
+// batches within the limits and returns the number of samples in each one.
+// A sample larger than MaxBytes on its own is still sent, alone.
+func PlanBatches(sizes []int, limits BatchLimits) []int {
+    var counts []int
+    count, bytes := 0, envelopeOverhead
+    for _, size := range sizes {
+        // Every sample after the first also needs a separating comma
+        full := limits.MaxSamples > 0 && count >= limits.MaxSamples
+        tooBig := limits.MaxBytes > 0 && count > 0 && bytes+size+1 > limits.MaxBytes
+        if full || tooBig {
+            counts = append(counts, count)
+            count, bytes = 0, envelopeOverhead
+        }
+        count++
+        bytes += size + 1
+    }
+    if count > 0 {
+        counts = append(counts, count)
+    }
+    return counts
+}
+
+// SendMessageBatchForm encodes samples as an SQS SendMessageBatch request
+// with one entry per sample. Callers keep batches within SQSMaxBatchEntries
+// and SQSMaxBatchBytes.
+func SendMessageBatchForm(samples []json.RawMessage) url.Values {
+    form := url.Values{}
+    form.Set("Action", "SendMessageBatch")
+    for i, sample := range samples {
+        prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i+1)
+        form.Set(prefix+"Id", fmt.Sprintf("msg%d", i+1))
+        form.Set(prefix+"MessageBody", string(sample))
+    }
+    return form
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+    "encoding/json"
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestPlanBatches(t *testing.T) {
+    tests := []struct {
+        name   string
+        sizes  []int
+        limits BatchLimits
+        want   []int
+    }{
+        {"empty", nil, BatchLimits{MaxSamples: 10}, nil},
+        {"no limits", []int{100, 100, 100}, BatchLimits{}, []int{3}},
+        {"sample limit", []int{1, 1, 1, 1, 1}, BatchLimits{MaxSamples: 2}, []int{2, 2, 1}},
+        // Each sample costs its size plus a comma on top of the envelope
+        {"byte limit", []int{100, 100, 100}, BatchLimits{MaxBytes: envelopeOverhead + 202}, []int{2, 1}},
+        {"exact fit", []int{99, 99}, BatchLimits{MaxBytes: envelopeOverhead + 200}, []int{2}},
+        {"oversized sample alone", []int{10, 5000, 10}, BatchLimits{MaxBytes: 1000}, []int{1, 1, 1}},
+        {"both limits", []int{10, 10, 10, 500, 10}, BatchLimits{MaxSamples: 2, MaxBytes: 600}, []int{2, 1, 1, 1}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := PlanBatches(tt.sizes, tt.limits); !slices.Equal(got, tt.want) {
+                t.Errorf("PlanBatches(%v, %+v) = %v, want %v", tt.sizes, tt.limits, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestBatchLimitsMin(t *testing.T) {
+    sqs := BatchLimits{MaxSamples: SQSMaxBatchEntries, MaxBytes: SQSMaxBatchBytes}
+    tests := []struct {
+        limits BatchLimits
+        want   BatchLimits
+    }{
+        {BatchLimits{}, sqs},
+        {BatchLimits{MaxSamples: 100, MaxBytes: 1 << 20}, sqs},
+        {BatchLimits{MaxSamples: 5, MaxBytes: 1024}, BatchLimits{MaxSamples: 5, MaxBytes: 1024}},
+        {BatchLimits{MaxSamples: 5}, BatchLimits{MaxSamples: 5, MaxBytes: SQSMaxBatchBytes}},
+    }
+    for _, tt := range tests {
+        if got := tt.limits.Min(sqs); got != tt.want {
+            t.Errorf("%+v.Min(%+v) = %+v, want %+v", tt.limits, sqs, got, tt.want)
+        }
+    }
+}
+
+// The planned batches must really fit once encoded as an envelope inside
+// the gateway's {"message": ...} wrapper.
+func TestPlanBatchesFitEnvelope(t *testing.T) {
+    var samples []json.RawMessage
+    var sizes []int
+    for i := 0; i < 50; i++ {
+        sample := json.RawMessage(`{"cpu":12.5,"padding":"` + strings.Repeat("x", i*3) + `"}`)
+        samples = append(samples, sample)
+        sizes = append(sizes, len(sample))
+    }
+
+    limits := BatchLimits{MaxBytes: 512}
+    start := 0
+    for _, count := range PlanBatches(sizes, limits) {
+        body, err := json.Marshal(map[string]interface{}{"message": NewEnvelope(samples[start : start+count])})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(body) > limits.MaxBytes {
+            t.Errorf("batch of %d samples encodes to %d bytes, over %d", count, len(body), limits.MaxBytes)
+        }
+        start += count
+    }
+    if start != len(samples) {
+        t.Errorf("batches cover %d samples, want %d", start, len(samples))
+    }
+}
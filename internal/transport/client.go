@@ -0,0 +1,335 @@
+// Package transport implements the HTTP client the agent uses to push data,
+// with timeouts, retries with exponential backoff and body compression.
+package transport
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// maxResponseBytes caps how much of a response body is read.
+const maxResponseBytes = 1 << 20
+
+// Options configures the upload client.
+type Options struct {
+    ConnectTimeout time.Duration // Time allowed to establish the TCP and TLS connection
+    ReadTimeout    time.Duration // Time allowed to wait for the response headers
+    RequestTimeout time.Duration // Upper bound for a whole attempt, 0 means none
+    Retry          RetryPolicy
+    Compression    string // One of the Encoding constants, empty means none
+    TLS            TLSOptions
+    Proxy          string // Proxy URL, empty to use the environment, see ParseProxy
+}
+
+// RetryPolicy describes how failed requests are retried. The delay before
+// attempt n is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff, with
+// up to Jitter (a fraction between 0 and 1) of it randomized.
+type RetryPolicy struct {
+    MaxAttempts    int
+    InitialBackoff time.Duration
+    MaxBackoff     time.Duration
+    Multiplier     float64
+    Jitter         float64
+}
+
+// Backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+    multiplier := p.Multiplier
+    if multiplier < 1 {
+        multiplier = 1
+    }
+
+    delay := float64(p.InitialBackoff)
+    for i := 1; i < retry && delay < float64(p.MaxBackoff); i++ {
+        delay *= multiplier
+    }
+    if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+        delay = float64(p.MaxBackoff)
+    }
+
+    if p.Jitter > 0 {
+        // Spread retries from many agents so they don't hit the API in lockstep
+        delay -= delay * p.Jitter * rand.Float64()
+    }
+    return time.Duration(delay)
+}
+
+// Delay returns the pause before the given retry after err. A Retry-After
+// longer than the backoff is honored, up to MaxBackoff, so a server cannot
+// stall the caller for hours.
+func (p RetryPolicy) Delay(retry int, err error) time.Duration {
+    delay := p.Backoff(retry)
+    var statusErr *StatusError
+    if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+        delay = statusErr.RetryAfter
+        if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+            delay = p.MaxBackoff
+        }
+    }
+    return delay
+}
+
+// StatusError is returned when the server answers with a non-2xx status.
+type StatusError struct {
+    StatusCode     int
+    RetryAfter     time.Duration // Parsed from the Retry-After header, if any
+    AcceptEncoding string        // Encodings the server supports, sent along with a 415
+}
+
+func (e *StatusError) Error() string {
+    return fmt.Sprintf("server returned status %d", e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed if sent again.
+func (e *StatusError) Temporary() bool {
+    return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// IsRetryable reports whether err is worth retrying: server errors, rate
+// limiting and network failures are, other client errors and cancellation
+// are not.
+func IsRetryable(err error) bool {
+    if err == nil || errors.Is(err, context.Canceled) {
+        return false
+    }
+
+    var statusErr *StatusError
+    if errors.As(err, &statusErr) {
+        return statusErr.Temporary()
+    }
+
+    // A certificate the agent rejected once will be rejected again
+    var certErr *tls.CertificateVerificationError
+    if errors.As(err, &certErr) || errors.Is(err, errPinMismatch) {
+        return false
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) {
+        return true
+    }
+    return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Client sends requests and retries them according to its policy.
+type Client struct {
+    http   *http.Client
+    retry  RetryPolicy
+    logger *slog.Logger
+
+    mu       sync.Mutex
+    encoding string // Content encoding for request bodies, lowered on 415
+}
+
+// NewClient builds a client with the given timeouts, TLS settings, proxy
+// and retry policy. It fails if the certificate files cannot be loaded.
+func NewClient(opts Options, logger *slog.Logger) (*Client, error) {
+    tlsConfig, err := opts.TLS.Config()
+    if err != nil {
+        return nil, err
+    }
+    proxy, err := ParseProxy(opts.Proxy)
+    if err != nil {
+        return nil, err
+    }
+
+    dialer := &net.Dialer{
+        Timeout:   opts.ConnectTimeout,
+        KeepAlive: 30 * time.Second,
+    }
+    transport := &http.Transport{
+        Proxy:                 proxy,
+        DialContext:           dialer.DialContext,
+        TLSClientConfig:       tlsConfig,
+        ForceAttemptHTTP2:     true,
+        TLSHandshakeTimeout:   opts.ConnectTimeout,
+        ResponseHeaderTimeout: opts.ReadTimeout,
+        IdleConnTimeout:       90 * time.Second,
+        MaxIdleConns:          4,
+    }
+
+    retry := opts.Retry
+    if retry.MaxAttempts < 1 {
+        retry.MaxAttempts = 1
+    }
+
+    encoding, err := ParseEncoding(opts.Compression)
+    if err != nil {
+        logger.Warn("Sending uncompressed requests", "err", err)
+        encoding = EncodingIdentity
+    }
+
+    return &Client{
+        http: &http.Client{
+            Transport: transport,
+            Timeout:   opts.RequestTimeout,
+        },
+        retry:    retry,
+        logger:   logger,
+        encoding: encoding,
+    }, nil
+}
+
+// Encoding returns the content encoding currently used for request bodies.
+func (c *Client) Encoding() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.encoding
+}
+
+// Post sends body to endpoint with the given headers, compressed with the
+// client's content encoding. If the server answers 415 the client falls back
+// to an encoding from the server's Accept-Encoding, or to none, and keeps
+// using it for later requests. An encoding rejected once is not tried again
+// for the same request, and a second 415 falls back to no compression.
+func (c *Client) Post(ctx context.Context, endpoint string, header http.Header, body []byte) error {
+    _, err := c.PostResponse(ctx, endpoint, header, body, nil)
+    return err
+}
+
+// PostResponse is Post for requests whose answer is needed. It returns the
+// body of the successful response, up to 1MB. If signer is not nil it signs
+// every attempt.
+func (c *Client) PostResponse(ctx context.Context, endpoint string, header http.Header, body []byte, signer Signer) ([]byte, error) {
+    encoding := c.Encoding()
+    rejected := map[string]bool{}
+    for {
+        payload, err := compress(encoding, body)
+        if err != nil {
+            c.logger.Warn("Error compressing request body, sending it uncompressed", "err", err)
+            encoding, payload = EncodingIdentity, body
+        }
+
+        respBody, err := c.DoResponse(ctx, func(ctx context.Context) (*http.Request, error) {
+            req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+            if err != nil {
+                return nil, err
+            }
+            for key, values := range header {
+                req.Header[key] = values
+            }
+            if encoding != EncodingIdentity {
+                req.Header.Set("Content-Encoding", encoding)
+            }
+            if signer != nil {
+                if err := signer.Sign(req, payload); err != nil {
+                    return nil, err
+                }
+            }
+            return req, nil
+        })
+
+        var statusErr *StatusError
+        if encoding == EncodingIdentity || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnsupportedMediaType {
+            return respBody, err
+        }
+
+        rejected[encoding] = true
+        fallback := EncodingIdentity
+        if len(rejected) == 1 {
+            fallback = negotiate(rejected, statusErr.AcceptEncoding)
+        }
+        c.logger.Warn("Server does not accept the request encoding, switching", "encoding", encoding, "fallback", fallback)
+        c.mu.Lock()
+        c.encoding = fallback
+        c.mu.Unlock()
+        encoding = fallback
+    }
+}
+
+// Do sends the request built by newRequest until it succeeds, fails with a
+// permanent error or runs out of attempts. newRequest is called once per
+// attempt so the body can be replayed. The last error is returned.
+func (c *Client) Do(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) error {
+    _, err := c.DoResponse(ctx, newRequest)
+    return err
+}
+
+// DoResponse is Do for requests whose answer is needed. It returns the body
+// of the successful response, up to 1MB.
+func (c *Client) DoResponse(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+    var err error
+    for attempt := 1; attempt <= c.retry.MaxAttempts; attempt++ {
+        if attempt > 1 {
+            delay := c.retry.Delay(attempt-1, err)
+            c.logger.Info("Retrying request", "delay", delay.Round(time.Millisecond), "attempt", attempt, "max_attempts", c.retry.MaxAttempts)
+
+            timer := time.NewTimer(delay)
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return nil, ctx.Err()
+            case <-timer.C:
+            }
+        }
+
+        var body []byte
+        body, err = c.send(ctx, newRequest)
+        if err == nil {
+            return body, nil
+        }
+        if !IsRetryable(err) {
+            return nil, err
+        }
+        c.logger.Warn("Request attempt failed", "attempt", attempt, "err", err)
+    }
+    return nil, err
+}
+
+func (c *Client) send(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+    req, err := newRequest(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        // Drain the body so the connection can be reused
+        io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+        return nil, &StatusError{
+            StatusCode:     resp.StatusCode,
+            RetryAfter:     parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+            AcceptEncoding: resp.Header.Get("Accept-Encoding"),
+        }
+    }
+
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+    if err != nil {
+        return nil, fmt.Errorf("reading response: %w", err)
+    }
+    return body, nil
+}
+
+// parseRetryAfter accepts both forms of the header: delay seconds and an
+// HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+    if value == "" {
+        return 0
+    }
+    if seconds, err := strconv.Atoi(value); err == nil {
+        if seconds < 0 {
+            return 0
+        }
+        return time.Duration(seconds) * time.Second
+    }
+    if when, err := http.ParseTime(value); err == nil && when.After(now) {
+        return when.Sub(now)
+    }
+    return 0
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestBackoff(t *testing.T) {
+    policy := RetryPolicy{
+        InitialBackoff: time.Second,
+        MaxBackoff:     10 * time.Second,
+        Multiplier:     2,
+    }
+    tests := []struct {
+        retry int
+        want  time.Duration
+    }{
+        {1, time.Second},
+        {2, 2 * time.Second},
+        {3, 4 * time.Second},
+        {4, 8 * time.Second},
+        {5, 10 * time.Second},
+        {50, 10 * time.Second},
+    }
+    for _, tt := range tests {
+        if got := policy.Backoff(tt.retry); got != tt.want {
+            t.Errorf("Backoff(%d) = %v, want %v", tt.retry, got, tt.want)
+        }
+    }
+
+    // A multiplier below 1 never shrinks the delay
+    flat := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 0.5}
+    if got := flat.Backoff(3); got != time.Second {
+        t.Errorf("Backoff(3) with multiplier 0.5 = %v, want 1s", got)
+    }
+}
+
+func TestDelay(t *testing.T) {
+    policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2}
+    tests := []struct {
+        name string
+        err  error
+        want time.Duration
+    }{
+        {"network error", errors.New("connection refused"), 2 * time.Second},
+        {"no Retry-After", &StatusError{StatusCode: 503}, 2 * time.Second},
+        {"shorter Retry-After", &StatusError{StatusCode: 429, RetryAfter: time.Second}, 2 * time.Second},
+        {"longer Retry-After", &StatusError{StatusCode: 429, RetryAfter: 30 * time.Second}, 30 * time.Second},
+        {"capped Retry-After", &StatusError{StatusCode: 503, RetryAfter: 24 * time.Hour}, time.Minute},
+        {"wrapped", fmt.Errorf("push: %w", &StatusError{StatusCode: 429, RetryAfter: 10 * time.Second}), 10 * time.Second},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := policy.Delay(2, tt.err); got != tt.want {
+                t.Errorf("Delay(2, %v) = %v, want %v", tt.err, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestBackoffJitter(t *testing.T) {
+    policy := RetryPolicy{
+        InitialBackoff: time.Second,
+        MaxBackoff:     8 * time.Second,
+        Multiplier:     2,
+        Jitter:         0.25,
+    }
+    for retry, base := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 10: 8 * time.Second} {
+        lowest := base - base/4
+        for i := 0; i < 1000; i++ {
+            if got := policy.Backoff(retry); got < lowest || got > base {
+                t.Fatalf("Backoff(%d) = %v, want within [%v, %v]", retry, got, lowest, base)
+            }
+        }
+    }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        value string
+        want  time.Duration
+    }{
+        {"", 0},
+        {"0", 0},
+        {"120", 2 * time.Minute},
+        {"-5", 0},
+        {"soon", 0},
+        {now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+        {now.Add(-time.Minute).Format(http.TimeFormat), 0},
+    }
+    for _, tt := range tests {
+        if got := parseRetryAfter(tt.value, now); got != tt.want {
+            t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestIsRetryable(t *testing.T) {
+    tests := []struct {
+        err  error
+        want bool
+    }{
+        {nil, false},
+        {context.Canceled, false},
+        {&StatusError{StatusCode: http.StatusInternalServerError}, true},
+        {&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+        {&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+        {&StatusError{StatusCode: http.StatusRequestTimeout}, true},
+        {&StatusError{StatusCode: http.StatusBadRequest}, false},
+        {&StatusError{StatusCode: http.StatusUnauthorized}, false},
+        {fmt.Errorf("push: %w", &StatusError{StatusCode: http.StatusBadGateway}), true},
+        {io.ErrUnexpectedEOF, true},
+        {errors.New("something else"), false},
+    }
+    for _, tt := range tests {
+        if got := IsRetryable(tt.err); got != tt.want {
+            t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "strings"
+
+    "github.com/klauspost/compress/zstd"
+)
+
+// Content encodings the agent can send.
+const (
+    EncodingIdentity = "identity"
+    EncodingGzip     = "gzip"
+    EncodingZstd     = "zstd"
+)
+
+// ParseEncoding validates a configured compression setting. An empty value
+// and "none" both mean no compression.
+func ParseEncoding(name string) (string, error) {
+    switch strings.ToLower(strings.TrimSpace(name)) {
+    case "", "none", EncodingIdentity:
+        return EncodingIdentity, nil
+    case EncodingGzip:
+        return EncodingGzip, nil
+    case EncodingZstd:
+        return EncodingZstd, nil
+    }
+    return "", fmt.Errorf("unsupported compression %q", name)
+}
+
+// compress encodes body with the given content encoding.
+func compress(encoding string, body []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    switch encoding {
+    case EncodingIdentity:
+        return body, nil
+
+    case EncodingGzip:
+        w := gzip.NewWriter(&buf)
+        if _, err := w.Write(body); err != nil {
+            return nil, err
+        }
+        if err := w.Close(); err != nil {
+            return nil, err
+        }
+
+    case EncodingZstd:
+        w, err := zstd.NewWriter(&buf)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := w.Write(body); err != nil {
+            w.Close()
+            return nil, err
+        }
+        if err := w.Close(); err != nil {
+            return nil, err
+        }
+
+    default:
+        return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+    }
+    return buf.Bytes(), nil
+}
+
+// negotiate picks the encoding to fall back to after the server rejected
+// the encodings in rejected with 415 Unsupported Media Type. accepted is the
+// server's Accept-Encoding header, which may be empty.
+func negotiate(rejected map[string]bool, accepted string) string {
+    offered := map[string]bool{}
+    for _, part := range strings.Split(accepted, ",") {
+        name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        // Skip encodings the server explicitly refuses with q=0
+        if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+            continue
+        }
+        offered[strings.ToLower(strings.TrimSpace(name))] = true
+    }
+
+    for _, candidate := range []string{EncodingZstd, EncodingGzip} {
+        if !rejected[candidate] && offered[candidate] {
+            return candidate
+        }
+    }
+    return EncodingIdentity
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+    tests := []struct {
+        name     string
+        rejected []string
+        accepted string
+        want     string
+    }{
+        {"no header", []string{EncodingGzip}, "", EncodingIdentity},
+        {"prefers zstd", []string{EncodingIdentity}, "gzip, zstd", EncodingZstd},
+        {"skips rejected", []string{EncodingZstd}, "zstd, gzip", EncodingGzip},
+        {"skips q=0", []string{EncodingGzip}, "zstd;q=0, gzip", EncodingIdentity},
+        {"q=0 with spaces", []string{EncodingGzip}, "zstd; q = 0", EncodingIdentity},
+        {"case insensitive", []string{EncodingGzip}, "ZSTD", EncodingZstd},
+        {"all rejected", []string{EncodingGzip, EncodingZstd}, "gzip, zstd", EncodingIdentity},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rejected := map[string]bool{}
+            for _, e := range tt.rejected {
+                rejected[e] = true
+            }
+            if got := negotiate(rejected, tt.accepted); got != tt.want {
+                t.Errorf("negotiate(%v, %q) = %q, want %q", tt.rejected, tt.accepted, got, tt.want)
+            }
+        })
+    }
+}
+
+// A server that rejects every compressed body and always advertises the
+// other encoding must not make the client switch back and forth.
+func TestPostResponseFallbackEnds(t *testing.T) {
+    var encodings []string
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(io.Discard, r.Body)
+        encoding := r.Header.Get("Content-Encoding")
+        encodings = append(encodings, encoding)
+        switch encoding {
+        case EncodingGzip:
+            w.Header().Set("Accept-Encoding", EncodingZstd)
+        case EncodingZstd:
+            w.Header().Set("Accept-Encoding", EncodingGzip)
+        default:
+            return
+        }
+        w.WriteHeader(http.StatusUnsupportedMediaType)
+    }))
+    defer server.Close()
+
+    client, err := NewClient(Options{Compression: EncodingGzip}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Post(context.Background(), server.URL, nil, []byte("body")); err != nil {
+        t.Fatalf("Post() error = %v", err)
+    }
+
+    if want := []string{EncodingGzip, EncodingZstd, ""}; !slices.Equal(encodings, want) {
+        t.Fatalf("server saw encodings %q, want %q", encodings, want)
+    }
+    if got := client.Encoding(); got != EncodingIdentity {
+        t.Errorf("Encoding() = %q, want %q", got, EncodingIdentity)
+    }
+}
@@ -0,0 +1,87 @@
+package transport
+
+import (
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// The canonical string is part of the wire contract with the server, so the
+// expected signatures were computed independently of this package.
+func TestSignature(t *testing.T) {
+    tests := []struct {
+        method, uri, timestamp, nonce string
+        body                          string
+        want                          string
+    }{
+        {
+            "POST", "/agent?x=1", "1700000000", "00112233445566778899aabbccddeeff", `{"a":1}`,
+            "0431df604394cbd057e25332bb74a3ec6716e08da2df9d4a9426f8f19b18e730",
+        },
+        {
+            "POST", "/agent", "1700000000", "n", "",
+            "d1a24b33f696f3045bbcaa090698be97d221194488eb48f6b2050032fc062d86",
+        },
+    }
+    for _, tt := range tests {
+        if got := Signature([]byte("secret"), tt.method, tt.uri, tt.timestamp, tt.nonce, []byte(tt.body)); got != tt.want {
+            t.Errorf("Signature(%q, %q, %q, %q, %q) = %s, want %s", tt.method, tt.uri, tt.timestamp, tt.nonce, tt.body, got, tt.want)
+        }
+    }
+}
+
+func TestSignatureCoversEveryPart(t *testing.T) {
+    base := Signature([]byte("secret"), "POST", "/agent", "1700000000", "nonce", []byte("body"))
+    for name, sig := range map[string]string{
+        "secret":    Signature([]byte("other"), "POST", "/agent", "1700000000", "nonce", []byte("body")),
+        "method":    Signature([]byte("secret"), "PUT", "/agent", "1700000000", "nonce", []byte("body")),
+        "uri":       Signature([]byte("secret"), "POST", "/register", "1700000000", "nonce", []byte("body")),
+        "timestamp": Signature([]byte("secret"), "POST", "/agent", "1700000001", "nonce", []byte("body")),
+        "nonce":     Signature([]byte("secret"), "POST", "/agent", "1700000000", "other", []byte("body")),
+        "body":      Signature([]byte("secret"), "POST", "/agent", "1700000000", "nonce", []byte("Body")),
+    } {
+        if sig == base {
+            t.Errorf("changing the %s does not change the signature", name)
+        }
+    }
+}
+
+func TestHMACSignerSign(t *testing.T) {
+    signer := HMACSigner{KeyID: "agent-1", Secret: []byte("secret")}
+    body := []byte(`{"a":1}`)
+
+    var nonces []string
+    for i := 0; i < 2; i++ {
+        req, _ := http.NewRequest(http.MethodPost, "https://api.example.com/agent?x=1", nil)
+        before := time.Now().Unix()
+        if err := signer.Sign(req, body); err != nil {
+            t.Fatalf("Sign() error = %v", err)
+        }
+
+        if got := req.Header.Get(HeaderKeyID); got != "agent-1" {
+            t.Errorf("%s = %q, want agent-1", HeaderKeyID, got)
+        }
+        timestamp := req.Header.Get(HeaderTimestamp)
+        unix, err := strconv.ParseInt(timestamp, 10, 64)
+        if err != nil || unix < before || unix > time.Now().Unix() {
+            t.Errorf("%s = %q, want the current Unix time", HeaderTimestamp, timestamp)
+        }
+        nonce := req.Header.Get(HeaderNonce)
+        if len(nonce) != 32 {
+            t.Errorf("%s = %q, want 16 hex encoded bytes", HeaderNonce, nonce)
+        }
+        nonces = append(nonces, nonce)
+
+        want := Signature([]byte("secret"), http.MethodPost, "/agent?x=1", timestamp, nonce, body)
+        if got := req.Header.Get(HeaderSignature); got != want {
+            t.Errorf("%s = %q, want %q", HeaderSignature, got, want)
+        }
+        if req.Header.Get("Authorization") != "" {
+            t.Errorf("signed request carries an Authorization header")
+        }
+    }
+    if nonces[0] == nonces[1] {
+        t.Errorf("two requests got the same nonce %q", nonces[0])
+    }
+}
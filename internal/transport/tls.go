@@ -0,0 +1,147 @@
+package transport
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+)
+
+// ProxyDirect disables the proxy, including one set in the environment.
+const ProxyDirect = "direct"
+
+// TLSOptions configures how the client authenticates itself and the server.
+type TLSOptions struct {
+    CertFile   string   // Client certificate for mutual TLS, PEM
+    KeyFile    string   // Key of the client certificate, PEM
+    CAFile     string   // PEM bundle trusted in addition to the system roots
+    MinVersion string   // 1.0, 1.1, 1.2 or 1.3, empty means 1.2
+    ServerName string   // Name the server certificate is checked against, instead of the URL host
+    Pins       []string // Base64 SHA-256 hashes of trusted public keys, see ParsePin
+}
+
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a minimum TLS version, empty meaning 1.2.
+func ParseTLSVersion(s string) (uint16, error) {
+    if s == "" {
+        return tls.VersionTLS12, nil
+    }
+    version, ok := tlsVersions[s]
+    if !ok {
+        return 0, fmt.Errorf("unknown TLS version %q", s)
+    }
+    return version, nil
+}
+
+// ParsePin decodes a public key pin: the base64 SHA-256 hash of a
+// certificate's DER-encoded SubjectPublicKeyInfo, optionally prefixed with
+// "sha256/" as curl writes it.
+func ParsePin(pin string) ([]byte, error) {
+    hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+    if err != nil || len(hash) != sha256.Size {
+        return nil, fmt.Errorf("invalid public key pin %q", pin)
+    }
+    return hash, nil
+}
+
+// ParseProxy returns the proxy function for a proxy setting: empty uses
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment, "direct" uses
+// none and anything else is the URL of the proxy.
+func ParseProxy(proxy string) (func(*http.Request) (*url.URL, error), error) {
+    switch proxy {
+    case "":
+        return http.ProxyFromEnvironment, nil
+    case ProxyDirect:
+        return nil, nil
+    }
+
+    u, err := url.Parse(proxy)
+    if err != nil {
+        return nil, fmt.Errorf("invalid proxy URL: %w", err)
+    }
+    switch u.Scheme {
+    case "http", "https", "socks5":
+    default:
+        return nil, fmt.Errorf("proxy URL %q must use http, https or socks5", proxy)
+    }
+    return http.ProxyURL(u), nil
+}
+
+// Config builds the TLS configuration, reading the certificate files.
+func (o TLSOptions) Config() (*tls.Config, error) {
+    minVersion, err := ParseTLSVersion(o.MinVersion)
+    if err != nil {
+        return nil, err
+    }
+    cfg := &tls.Config{
+        MinVersion: minVersion,
+        ServerName: o.ServerName,
+    }
+
+    if o.CertFile != "" || o.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("loading client certificate: %w", err)
+        }
+        cfg.Certificates = []tls.Certificate{cert}
+    }
+
+    if o.CAFile != "" {
+        pem, err := os.ReadFile(o.CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("reading CA bundle: %w", err)
+        }
+        pool, err := x509.SystemCertPool()
+        if err != nil {
+            pool = x509.NewCertPool()
+        }
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+        }
+        cfg.RootCAs = pool
+    }
+
+    if len(o.Pins) > 0 {
+        pins := make(map[string]bool, len(o.Pins))
+        for _, pin := range o.Pins {
+            hash, err := ParsePin(pin)
+            if err != nil {
+                return nil, err
+            }
+            pins[string(hash)] = true
+        }
+        cfg.VerifyConnection = verifyPins(pins)
+    }
+    return cfg, nil
+}
+
+// errPinMismatch is a certificate error, so it is not retried.
+var errPinMismatch = errors.New("server certificate chain matches none of the pinned public keys")
+
+// verifyPins accepts a connection when any certificate of the verified
+// chain has a pinned public key. It runs after the normal verification.
+func verifyPins(pins map[string]bool) func(tls.ConnectionState) error {
+    return func(state tls.ConnectionState) error {
+        for _, chain := range state.VerifiedChains {
+            for _, cert := range chain {
+                hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+                if pins[string(hash[:])] {
+                    return nil
+                }
+            }
+        }
+        return errPinMismatch
+    }
+}
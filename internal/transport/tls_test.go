@@ -0,0 +1,143 @@
+package transport
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    uint16
+        wantErr bool
+    }{
+        {"", tls.VersionTLS12, false},
+        {"1.0", tls.VersionTLS10, false},
+        {"1.3", tls.VersionTLS13, false},
+        {"TLS1.3", 0, true},
+        {"1.4", 0, true},
+    }
+    for _, tt := range tests {
+        got, err := ParseTLSVersion(tt.in)
+        if got != tt.want || (err != nil) != tt.wantErr {
+            t.Errorf("ParseTLSVersion(%q) = %#x, %v, want %#x", tt.in, got, err, tt.want)
+        }
+    }
+}
+
+func TestParsePin(t *testing.T) {
+    hash := sha256.Sum256([]byte("key"))
+    pin := base64.StdEncoding.EncodeToString(hash[:])
+    tests := []struct {
+        name, in string
+        wantErr  bool
+    }{
+        {"plain", pin, false},
+        {"curl prefix", "sha256/" + pin, false},
+        {"not base64", "not a pin!", true},
+        {"wrong length", base64.StdEncoding.EncodeToString(hash[:16]), true},
+        {"empty", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := ParsePin(tt.in)
+            if (err != nil) != tt.wantErr || (!tt.wantErr && string(got) != string(hash[:])) {
+                t.Errorf("ParsePin(%q) = %x, %v", tt.in, got, err)
+            }
+        })
+    }
+}
+
+func TestParseProxy(t *testing.T) {
+    req, _ := http.NewRequest("GET", "https://api.example.com/", nil)
+    tests := []struct {
+        in      string
+        want    string // Proxy URL for req, empty for none
+        wantErr bool
+    }{
+        {ProxyDirect, "", false},
+        {"http://proxy.example.com:3128", "http://proxy.example.com:3128", false},
+        {"socks5://127.0.0.1:1080", "socks5://127.0.0.1:1080", false},
+        {"ftp://proxy.example.com", "", true},
+        {"proxy.example.com:3128", "", true},
+    }
+    for _, tt := range tests {
+        proxy, err := ParseProxy(tt.in)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("ParseProxy(%q) error = %v", tt.in, err)
+            continue
+        }
+        var got string
+        if proxy != nil {
+            u, _ := proxy(req)
+            got = u.String()
+        }
+        if got != tt.want {
+            t.Errorf("ParseProxy(%q) proxies through %q, want %q", tt.in, got, tt.want)
+        }
+    }
+
+    if proxy, err := ParseProxy(""); err != nil || proxy == nil {
+        t.Errorf("ParseProxy(\"\") error = %v or no proxy function, want the environment", err)
+    }
+}
+
+func TestTLSConfigPins(t *testing.T) {
+    server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer server.Close()
+
+    cert := server.Certificate()
+    caFile := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    serverPin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+    other := sha256.Sum256([]byte("other key"))
+    otherPin := base64.StdEncoding.EncodeToString(other[:])
+
+    tests := []struct {
+        name    string
+        opts    TLSOptions
+        wantErr error // From the request, nil for success
+    }{
+        {"CA only", TLSOptions{CAFile: caFile}, nil},
+        {"matching pin", TLSOptions{CAFile: caFile, Pins: []string{otherPin, serverPin}}, nil},
+        {"no matching pin", TLSOptions{CAFile: caFile, Pins: []string{otherPin}}, errPinMismatch},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg, err := tt.opts.Config()
+            if err != nil {
+                t.Fatalf("Config() error = %v", err)
+            }
+            client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+            resp, err := client.Get(server.URL)
+            if err == nil {
+                resp.Body.Close()
+            }
+            if !errors.Is(err, tt.wantErr) {
+                t.Errorf("request error = %v, want %v", err, tt.wantErr)
+            }
+        })
+    }
+
+    for name, opts := range map[string]TLSOptions{
+        "unknown version":  {MinVersion: "1.4"},
+        "missing CA file":  {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+        "key without cert": {KeyFile: caFile},
+        "invalid pin":      {Pins: []string{"abc"}},
+    } {
+        if _, err := opts.Config(); err == nil {
+            t.Errorf("Config() accepted options with %s", name)
+        }
+    }
+}
@@ -1,32 +1,239 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"bytes"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/dickiesanders/go-agent/internal/transport"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	validAPIToken    = "9876543210"           // Replace with your actual token
 	baseSQSEndpoint  = "http://localhost:4100/queue/" // Base SQS endpoint
+	acceptedEncodings = "gzip, zstd"          // Request body encodings we can decode
+	registerQueue    = "register"             // Registrations are answered with an agent credential
+	bootstrapKeyID   = "bootstrap"            // Key ID of requests signed with the API token
+	maxClockSkew     = 5 * time.Minute        // Signed requests older or newer than this are stale
 )
 
-// Middleware to check API token
-func checkAPIToken(next http.Handler) http.Handler {
+// Settings handed to every agent that registers, in the config file layout
+var initialConfig = json.RawMessage(`{"collection_interval": "30s"}`)
+
+// Credentials issued at registration, by agent ID
+var (
+	credentialsMu sync.Mutex
+	credentials   = map[string]string{}
+)
+
+// Nonces of signed requests seen within the clock skew window, with the time
+// they expire. A nonce seen twice is a replay.
+var (
+	noncesMu sync.Mutex
+	nonces   = map[string]time.Time{}
+)
+
+// Context key of the agent ID a request authenticated as, empty for the
+// bootstrap token
+type agentIDKey struct{}
+
+// Unsigned requests carrying the token in the Authorization header are
+// rejected when REQUIRE_SIGNED=true, once every agent has api.sign_requests on
+var allowUnsigned = os.Getenv("REQUIRE_SIGNED") != "true"
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Middleware to decompress gzip or zstd request bodies. Unknown encodings are
+// answered with 415 and the list of supported ones, so the agent can fall
+// back to something we understand.
+func decompressBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token != validAPIToken {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			// Nothing to do
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			r.Body = gz
+		case "zstd":
+			zr, err := zstd.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid zstd body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r.Body = zr.IOReadCloser()
+		default:
+			w.Header().Set("Accept-Encoding", acceptedEncodings)
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
 			return
 		}
+
+		log.Printf("Request body encoding: %q", r.Header.Get("Content-Encoding"))
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Middleware to check API token. Requests authenticate with the bootstrap
+// token or a credential issued at registration; the agent ID of the latter
+// is passed on in the request context.
+func checkAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var agentID string
+		if r.Header.Get(transport.HeaderSignature) != "" {
+			keyID, err := verifySignature(r)
+			if err != nil {
+				log.Printf("Rejected signed request: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if keyID != bootstrapKeyID {
+				agentID = keyID
+			}
+		} else {
+			token := r.Header.Get("Authorization")
+			if token != validAPIToken {
+				agentID = credentialOwner(token)
+			}
+			if !allowUnsigned || token != validAPIToken && agentID == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), agentIDKey{}, agentID)))
+	})
+}
+
+// Return the agent ID a credential was issued to, or "" if it is unknown
+func credentialOwner(token string) string {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	for agentID, credential := range credentials {
+		if hmac.Equal([]byte(credential), []byte(token)) {
+			return agentID
+		}
+	}
+	return ""
+}
+
+// Verify a signed request: the key must be known, the timestamp recent, the
+// nonce unused and the signature must match the body as received. Returns
+// the key ID the request was signed with.
+func verifySignature(r *http.Request) (string, error) {
+	keyID := r.Header.Get(transport.HeaderKeyID)
+	var secret string
+	if keyID == bootstrapKeyID {
+		secret = validAPIToken
+	} else {
+		credentialsMu.Lock()
+		secret = credentials[keyID]
+		credentialsMu.Unlock()
+	}
+	if secret == "" {
+		return "", fmt.Errorf("unknown key ID %q", keyID)
+	}
+
+	timestamp := r.Header.Get(transport.HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", fmt.Errorf("stale timestamp, %s off", skew.Round(time.Second))
+	}
+
+	// Read the body as sent, before decompression, and put it back
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading body: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	nonce := r.Header.Get(transport.HeaderNonce)
+	want := transport.Signature([]byte(secret), r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(transport.HeaderSignature))) {
+		return "", fmt.Errorf("signature mismatch for key ID %q", keyID)
+	}
+
+	// Only remember nonces of valid requests, so garbage can't fill the cache
+	if nonce == "" || !useNonce(nonce) {
+		return "", fmt.Errorf("replayed nonce %q", nonce)
+	}
+	return keyID, nil
+}
+
+// Record a nonce, returning false if it was already used. Nonces are kept
+// until their request would be stale anyway.
+func useNonce(nonce string) bool {
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+
+	now := time.Now()
+	for n, expires := range nonces {
+		if now.After(expires) {
+			delete(nonces, n)
+		}
+	}
+	if _, seen := nonces[nonce]; seen {
+		return false
+	}
+	nonces[nonce] = now.Add(2 * maxClockSkew)
+	return true
+}
+
+// Answer a registration with the agent's ID, a new credential and the
+// initial settings. The bootstrap token always gets a new ID, so it cannot
+// take over an agent; an agent authenticated with its current credential
+// keeps its ID and gets the credential rotated. The ID in the body is never
+// trusted.
+func answerRegistration(w http.ResponseWriter, agentID string) {
+	credential := randomHex(32)
+
+	credentialsMu.Lock()
+	if agentID == "" {
+		for agentID == "" || credentials[agentID] != "" {
+			agentID = randomHex(32)
+		}
+		log.Printf("Registered agent %s", agentID)
+	} else {
+		log.Printf("Rotated the credential of agent %s", agentID)
+	}
+	credentials[agentID] = credential
+	credentialsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent_id":   agentID,
+		"credential": credential,
+		"config":     initialConfig,
+	})
+}
+
 // Handler to receive data and forward to the correct SQS queue
 func receiveAndForwardToSQS(w http.ResponseWriter, r *http.Request) {
 	// Log the received request
@@ -59,6 +266,7 @@ func receiveAndForwardToSQS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
 		return
 	}
+	log.Printf("Received %d bytes", len(body))
 
 	// Forward the data to the GoAWS SQS queue
 	resp, err := http.Post(sqsEndpoint, "application/x-www-form-urlencoded", bytes.NewReader(body))
@@ -69,6 +277,12 @@ func receiveAndForwardToSQS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	if queueName == registerQueue {
+		agentID, _ := r.Context().Value(agentIDKey{}).(string)
+		answerRegistration(w, agentID)
+		return
+	}
+
 	// Respond to the client
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Data successfully forwarded to SQS queue: %s", queueName)
@@ -79,7 +293,7 @@ func main() {
 	mux.HandleFunc("/", receiveAndForwardToSQS) // The trailing slash allows dynamic paths
 
 	// Apply token-checking middleware
-	http.Handle("/", checkAPIToken(mux)) // Apply to the entire path
+	http.Handle("/", checkAPIToken(decompressBody(mux))) // Apply to the entire path
 
 	port := "8080"
 	if p := os.Getenv("PORT"); p != "" {
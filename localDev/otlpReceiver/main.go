@@ -0,0 +1,196 @@
+// A stand-in for an OpenTelemetry collector that accepts OTLP/HTTP protobuf
+// metrics and logs what it received, for testing the agent's OTLP export.
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field is one decoded protobuf field
+type field struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	value uint64
+}
+
+// Split a protobuf message into its top-level fields
+func parse(b []byte) ([]field, error) {
+	var fields []field
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Decode a KeyValue into "key=value"
+func keyValue(b []byte) string {
+	fields, _ := parse(b)
+	var key, value string
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			anyValue, _ := parse(f.bytes)
+			for _, v := range anyValue {
+				switch v.num {
+				case 1:
+					value = string(v.bytes)
+				case 2:
+					value = fmt.Sprint(v.value != 0)
+				}
+			}
+		}
+	}
+	return key + "=" + value
+}
+
+// Log the resource attributes and a summary of every metric in the request
+func describe(body []byte) error {
+	request, err := parse(body)
+	if err != nil {
+		return err
+	}
+	for _, rm := range request {
+		resourceMetrics, err := parse(rm.bytes)
+		if err != nil {
+			return err
+		}
+		for _, f := range resourceMetrics {
+			switch f.num {
+			case 1: // Resource
+				resource, _ := parse(f.bytes)
+				var attrs []string
+				for _, a := range resource {
+					attrs = append(attrs, keyValue(a.bytes))
+				}
+				log.Printf("Resource: %s", strings.Join(attrs, ", "))
+			case 2: // ScopeMetrics
+				scopeMetrics, _ := parse(f.bytes)
+				for _, sm := range scopeMetrics {
+					if sm.num == 2 {
+						describeMetric(sm.bytes)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func describeMetric(b []byte) {
+	fields, _ := parse(b)
+	var name, unit, kind string
+	var points int
+	var last float64
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			name = string(f.bytes)
+		case 3:
+			unit = string(f.bytes)
+		case 5, 7:
+			kind = map[protowire.Number]string{5: "gauge", 7: "sum"}[f.num]
+			data, _ := parse(f.bytes)
+			for _, d := range data {
+				if d.num != 1 {
+					continue
+				}
+				points++
+				dp, _ := parse(d.bytes)
+				for _, v := range dp {
+					if v.num == 4 {
+						last = math.Float64frombits(v.value)
+					}
+				}
+			}
+		}
+	}
+	log.Printf("  %s (%s, %s): %d points, last value %g", name, kind, unit, points, last)
+}
+
+func receiveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		http.Error(w, "Only application/x-protobuf is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Received %d bytes of OTLP metrics", len(data))
+	if err := describe(data); err != nil {
+		log.Printf("Invalid OTLP request: %v", err)
+		http.Error(w, "Invalid protobuf", http.StatusBadRequest)
+		return
+	}
+
+	// An empty ExportMetricsServiceResponse means full success
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func main() {
+	http.HandleFunc("/v1/metrics", receiveMetrics)
+
+	port := "4318"
+	if p := os.Getenv("PORT"); p != "" {
+		port = p
+	}
+
+	log.Printf("Starting OTLP receiver on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
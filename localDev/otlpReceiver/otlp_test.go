@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dickiesanders/go-agent/internal/metrics"
+	"github.com/dickiesanders/go-agent/internal/sink"
+	"github.com/dickiesanders/go-agent/internal/transport"
+)
+
+// exported is what the receiver decoded of one metric
+type exported struct {
+	sum         bool
+	temporality uint64
+	monotonic   bool
+	starts      []uint64 // start_time_unix_nano of every point, 0 if unset
+}
+
+// decodeMetrics returns the resource attributes and the metrics of an
+// ExportMetricsServiceRequest by name
+func decodeMetrics(t *testing.T, body []byte) ([]string, map[string]exported) {
+	t.Helper()
+	var attrs []string
+	byName := map[string]exported{}
+
+	request, err := parse(body)
+	if err != nil {
+		t.Fatalf("parsing the request: %v", err)
+	}
+	for _, rm := range request {
+		resourceMetrics, _ := parse(rm.bytes)
+		for _, f := range resourceMetrics {
+			switch f.num {
+			case 1:
+				resource, _ := parse(f.bytes)
+				for _, a := range resource {
+					attrs = append(attrs, keyValue(a.bytes))
+				}
+			case 2:
+				scopeMetrics, _ := parse(f.bytes)
+				for _, sm := range scopeMetrics {
+					if sm.num != 2 {
+						continue
+					}
+					name, m := decodeMetric(sm.bytes)
+					byName[name] = m
+				}
+			}
+		}
+	}
+	return attrs, byName
+}
+
+func decodeMetric(b []byte) (string, exported) {
+	var name string
+	var m exported
+	fields, _ := parse(b)
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			name = string(f.bytes)
+		case 5, 7:
+			m.sum = f.num == 7
+			data, _ := parse(f.bytes)
+			for _, d := range data {
+				switch d.num {
+				case 1:
+					var start uint64
+					dp, _ := parse(d.bytes)
+					for _, v := range dp {
+						if v.num == 2 {
+							start = v.value
+						}
+					}
+					m.starts = append(m.starts, start)
+				case 2:
+					m.temporality = d.value
+				case 3:
+					m.monotonic = d.value != 0
+				}
+			}
+		}
+	}
+	return name, m
+}
+
+func TestOTLPExport(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		receiveMetrics(w, r)
+	}))
+	defer server.Close()
+
+	client, err := transport.NewClient(transport.Options{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot := time.Unix(1700000000, 0)
+	created := time.UnixMilli(1700000500123)
+	host := sink.Host{Hostname: "web-1", UniqueID: "id-1", IsVirtual: true, Virtualization: "kvm", BootTime: boot}
+	otlp := sink.NewOTLP(client, server.URL, nil, host, 0)
+
+	sample := metrics.MetricsData{
+		Timestamp:  boot.Add(time.Hour),
+		CPUPercent: 25,
+		CPU:        &metrics.CPUStats{ContextSwitches: 1000},
+		ProcessInfo: []metrics.ProcessInfo{{
+			PID:        42,
+			Name:       "nginx",
+			CreateTime: created.UnixMilli(),
+			IO:         &metrics.ProcessIO{ReadBytes: 10},
+		}},
+	}
+	if err := otlp.Write(context.Background(), []metrics.MetricsData{sample}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	attrs, byName := decodeMetrics(t, body)
+	for _, want := range []string{"service.name=go-agent", "host.name=web-1", "host.id=id-1", "host.virtualization=kvm", "host.virtual=true"} {
+		if !slices.Contains(attrs, want) {
+			t.Errorf("resource attributes %q lack %q", attrs, want)
+		}
+	}
+	if _, ok := byName["system.network.connections"]; ok {
+		t.Errorf("connections exported without the network collector")
+	}
+
+	tests := []struct {
+		name  string
+		sum   bool
+		start time.Time // Zero for gauges
+	}{
+		{"system.cpu.utilization.total", false, time.Time{}},
+		{"system.cpu.load_average.1m", false, time.Time{}},
+		{"system.cpu.context_switches", true, boot},
+		{"process.cpu.utilization", false, time.Time{}},
+		{"process.disk.io", true, created},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ok := byName[tt.name]
+			if !ok {
+				t.Fatalf("metric not exported, got %v", slices.Sorted(maps.Keys(byName)))
+			}
+			if m.sum != tt.sum {
+				t.Errorf("sum = %v, want %v", m.sum, tt.sum)
+			}
+			if tt.sum && (m.temporality != 2 || !m.monotonic) {
+				t.Errorf("temporality = %d, monotonic = %v, want a cumulative monotonic sum", m.temporality, m.monotonic)
+			}
+			var want uint64
+			if !tt.start.IsZero() {
+				want = uint64(tt.start.UnixNano())
+			}
+			for _, start := range m.starts {
+				if start != want {
+					t.Errorf("start time = %d, want %d", start, want)
+				}
+			}
+		})
+	}
+}
@@ -144,7 +144,9 @@ resource "aws_apigatewayv2_route" "agent_route" {
   target    = "integrations/${aws_apigatewayv2_integration.sqs_agent_integration.id}"
 }
 
-# API Gateway route for Register Queue
+# API Gateway route for Register Queue. It only queues the host information
+# and does not answer with an agent ID and credential, so agents pushing to
+# this API keep api.register at its default of false.
 resource "aws_apigatewayv2_route" "register_route" {
   api_id    = aws_apigatewayv2_api.api_gw.id
   route_key = "POST /register"